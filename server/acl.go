@@ -0,0 +1,464 @@
+package main
+
+import (
+	"OttoDB/server/resp"
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	aclFile  = flag.String("aclfile", "", "File of users allowed to connect, relative to -dir. Clients don't need to AUTH when empty")
+	peerUser = flag.String("peer-user", "default", "User this node authenticates as on other nodes, when replicating and migrating keys")
+	peerPass = flag.String("peer-pass", "", "Password this node authenticates with on other nodes, none when empty")
+)
+
+// Settings CONFIG GET doesn't show the value of. Unlike users' passwords in -aclfile,
+// -peer-pass can't be hashed, since it's sent to the other nodes.
+var secretSettings = map[string]bool{"peer-pass": true}
+
+// Value of a setting as CONFIG GET shows it
+func shownSetting(name string) string {
+	value := settings.String(name)
+	if secretSettings[name] && value != "" {
+		return "<redacted>"
+	}
+	return value
+}
+
+// Categories of commands that ACL rules allow or deny, as +@category or -@category
+var commandCategories = map[string][]string{
+	"get":      {"read"},
+	"getv":     {"read"},
+	"json.get": {"read"},
+	"keys":     {"read"},
+	"find":     {"read"},
+	"history":  {"read", "dangerous"},
+
+	"set":      {"write"},
+	"cas":      {"write"},
+	"del":      {"write"},
+	"json.set": {"write"},
+	"json.del": {"write"},
+	"create":   {"write"},
+	"drop":     {"write"},
+
+	"begin":    {"txn"},
+	"commit":   {"txn"},
+	"abort":    {"txn"},
+	"prepare":  {"txn"},
+	"rollback": {"txn"},
+	"prepared": {"txn"},
+
+	"publish":    {"pubsub"},
+	"subscribe":  {"pubsub"},
+	"psubscribe": {"pubsub"},
+
+	"ping":   {"connection"},
+	"quit":   {"connection"},
+	"auth":   {"connection"},
+	"asking": {"connection"},
+
+	"info":            {"admin"},
+	"slowlog":         {"admin"},
+	"txn":             {"admin"},
+	"client":          {"admin"},
+	"acl":             {"admin"},
+	"cluster":         {"admin"},
+	"raft":            {"admin"},
+	"replicaof":       {"admin"},
+	"migrate":         {"admin", "write"},
+	"config":          {"admin", "dangerous"},
+	"backup":          {"admin", "dangerous"},
+	"cdc":             {"admin", "dangerous"},
+	"replsync":        {"admin", "dangerous"},
+	"restoreversions": {"admin", "dangerous", "write"},
+	"print":           {"admin", "dangerous"},
+	"txnprint":        {"admin", "dangerous"},
+	"printw":          {"admin", "dangerous"},
+}
+
+var aclCategories = []string{"admin", "all", "connection", "dangerous", "pubsub", "read", "txn", "write"}
+
+// A user of the ACL file, written as
+//
+//	user <name> [on|off] [nopass] [#<sha256 of password>]... [~<key pattern>|allkeys]... [+|-<command>|@<category>|allcommands|nocommands]...
+//
+// Command rules apply in order, so later rules win over earlier ones.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords [][]byte
+	keys      []string
+	rules     []aclRule
+}
+
+type aclRule struct {
+	allow    bool
+	command  string
+	category string
+}
+
+var acl = struct {
+	sync.RWMutex
+	enabled bool
+	users   map[string]*aclUser
+}{users: make(map[string]*aclUser)}
+
+// Reads the users of -aclfile, replacing the ones loaded before. Clients keep their
+// user, and get its new permissions from their next command.
+func loadACL() error {
+	if *aclFile == "" {
+		acl.Lock()
+		acl.enabled = false
+		acl.users = make(map[string]*aclUser)
+		acl.Unlock()
+		return nil
+	}
+	f, err := os.Open(dataPath(*aclFile))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users, err := parseACL(bufio.NewScanner(f))
+	if err != nil {
+		return fmt.Errorf("%s: %v", *aclFile, err)
+	}
+
+	acl.Lock()
+	defer acl.Unlock()
+	acl.enabled = true
+	acl.users = users
+	return nil
+}
+
+func parseACL(scanner *bufio.Scanner) (map[string]*aclUser, error) {
+	users := make(map[string]*aclUser)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: expected user <name> followed by rules", line)
+		}
+		user := &aclUser{name: fields[1]}
+		for _, rule := range fields[2:] {
+			if err := user.apply(rule); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		users[user.name] = user
+	}
+	return users, scanner.Err()
+}
+
+func (user *aclUser) apply(rule string) error {
+	switch {
+	case rule == "on":
+		user.enabled = true
+	case rule == "off":
+		user.enabled = false
+	case rule == "nopass":
+		user.nopass = true
+		user.passwords = nil
+	case rule == "resetpass":
+		user.nopass = false
+		user.passwords = nil
+	case strings.HasPrefix(rule, "#"):
+		hash, err := hex.DecodeString(rule[1:])
+		if err != nil || len(hash) != sha256.Size {
+			return fmt.Errorf("%s is not a sha256 hash of a password in hex", rule)
+		}
+		user.nopass = false
+		user.passwords = append(user.passwords, hash)
+	case rule == "allkeys":
+		user.keys = append(user.keys, "*")
+	case rule == "resetkeys":
+		user.keys = nil
+	case strings.HasPrefix(rule, "~"):
+		user.keys = append(user.keys, rule[1:])
+	case rule == "allcommands":
+		user.rules = append(user.rules, aclRule{allow: true, category: "all"})
+	case rule == "nocommands":
+		user.rules = append(user.rules, aclRule{allow: false, category: "all"})
+	case strings.HasPrefix(rule, "+@") || strings.HasPrefix(rule, "-@"):
+		category := strings.ToLower(rule[2:])
+		if i := sort.SearchStrings(aclCategories, category); i == len(aclCategories) || aclCategories[i] != category {
+			return fmt.Errorf("unknown category %s", category)
+		}
+		user.rules = append(user.rules, aclRule{allow: rule[0] == '+', category: category})
+	case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+		user.rules = append(user.rules, aclRule{allow: rule[0] == '+', command: strings.ToLower(rule[1:])})
+	default:
+		return fmt.Errorf("unknown rule %s", rule)
+	}
+	return nil
+}
+
+func (user *aclUser) canRun(command string) bool {
+	allowed := false
+	for _, rule := range user.rules {
+		if rule.matches(command) {
+			allowed = rule.allow
+		}
+	}
+	return allowed
+}
+
+func (rule aclRule) matches(command string) bool {
+	if rule.category == "all" || (rule.command != "" && rule.command == command) {
+		return true
+	}
+	for _, category := range commandCategories[command] {
+		if category == rule.category {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *aclUser) canAccess(key string) bool {
+	for _, pattern := range user.keys {
+		if matchPattern(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *aclUser) canAccessAll() bool {
+	for _, pattern := range user.keys {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (user *aclUser) checkPassword(password string) bool {
+	if user.nopass {
+		return true
+	}
+	hash := sha256.Sum256([]byte(password))
+	for _, allowed := range user.passwords {
+		if subtle.ConstantTimeCompare(hash[:], allowed) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// The user as a line of the ACL file
+func (user *aclUser) String() string {
+	fields := []string{"user", user.name}
+	if user.enabled {
+		fields = append(fields, "on")
+	} else {
+		fields = append(fields, "off")
+	}
+	if user.nopass {
+		fields = append(fields, "nopass")
+	}
+	for _, hash := range user.passwords {
+		fields = append(fields, "#"+hex.EncodeToString(hash))
+	}
+	for _, pattern := range user.keys {
+		fields = append(fields, "~"+pattern)
+	}
+	for _, rule := range user.rules {
+		sign := "-"
+		if rule.allow {
+			sign = "+"
+		}
+		if rule.category != "" {
+			fields = append(fields, sign+"@"+rule.category)
+		} else {
+			fields = append(fields, sign+rule.command)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// User a new client starts as: default when it can be used without a password,
+// and none otherwise, until the client sends AUTH
+func initialUser() string {
+	acl.RLock()
+	defer acl.RUnlock()
+	if !acl.enabled {
+		return "default"
+	}
+	if user, ok := acl.users["default"]; ok && user.enabled && user.nopass {
+		return "default"
+	}
+	return ""
+}
+
+// Checks the client's user may run the command and use its key. Clients can always
+// AUTH and QUIT.
+func checkACL(conn redcon.Conn, cmd redcon.Command) error {
+	command := strings.ToLower(string(cmd.Args[0]))
+	if command == "auth" || command == "quit" {
+		return nil
+	}
+	acl.RLock()
+	defer acl.RUnlock()
+	if !acl.enabled {
+		return nil
+	}
+	user, ok := acl.users[clientUser(conn)]
+	if !ok || !user.enabled {
+		return errors.New("NOAUTH Authentication required.")
+	}
+	if !user.canRun(command) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", command)
+	}
+	if keyedCommands[command] && len(cmd.Args) > 1 && !user.canAccess(string(cmd.Args[1])) {
+		return errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+	}
+	return nil
+}
+
+// Leaves out the keys the client's user can't access, for commands that reply with keys
+func accessibleKeys(conn redcon.Conn, keys []string) []string {
+	acl.RLock()
+	defer acl.RUnlock()
+	user, ok := acl.users[clientUser(conn)]
+	if !acl.enabled || !ok {
+		return keys
+	}
+	accessible := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if user.canAccess(key) {
+			accessible = append(accessible, key)
+		}
+	}
+	return accessible
+}
+
+// Keyspace notifications name keys in their channel or message, so subscribing to them
+// needs access to those keys. Keyevent channels and patterns that could match keyspace
+// channels need access to every key, unless a pattern is one of the user's key patterns.
+func checkChannelACL(conn redcon.Conn, channel string, isPattern bool) error {
+	acl.RLock()
+	defer acl.RUnlock()
+	user, ok := acl.users[clientUser(conn)]
+	if !acl.enabled || !ok || user.canAccessAll() {
+		return nil
+	}
+
+	allowed := true
+	if !isPattern {
+		if strings.HasPrefix(channel, keyspaceChannel) {
+			allowed = user.canAccess(channel[len(keyspaceChannel):])
+		} else if strings.HasPrefix(channel, keyeventChannel) {
+			allowed = false
+		}
+	} else {
+		literal := channel
+		if i := strings.IndexAny(channel, "*?[\\"); i >= 0 {
+			literal = channel[:i]
+		}
+		if strings.HasPrefix(keyspaceChannel, literal) || strings.HasPrefix(keyeventChannel, literal) ||
+			strings.HasPrefix(literal, keyspaceChannel) || strings.HasPrefix(literal, keyeventChannel) {
+			allowed = false
+			for _, pattern := range user.keys {
+				if channel == keyspaceChannel+pattern {
+					allowed = true
+				}
+			}
+		}
+	}
+	if !allowed {
+		return errors.New("NOPERM this user has no permissions to access one of the channels used as arguments")
+	}
+	return nil
+}
+
+// AUTH [username] password, for the default user when no username is given
+func authenticate(conn redcon.Conn, name string, password string) error {
+	acl.RLock()
+	defer acl.RUnlock()
+	if !acl.enabled {
+		return errors.New("ERR AUTH called without any password configured for the default user. Are you sure your configuration is correct?")
+	}
+	user, ok := acl.users[name]
+	if !ok || !user.enabled || !user.checkPassword(password) {
+		logger.Warn("authentication failed", "client", conn.RemoteAddr(), "user", name)
+		return errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	setClientUser(conn, name)
+	return nil
+}
+
+// ACL LIST, ACL USERS, ACL WHOAMI, ACL CAT [category] and ACL LOAD
+func aclCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "list", "users":
+		acl.RLock()
+		names := make([]string, 0, len(acl.users))
+		for name := range acl.users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		conn.WriteArray(len(names))
+		for _, name := range names {
+			if strings.ToLower(string(cmd.Args[1])) == "list" {
+				conn.WriteBulkString(acl.users[name].String())
+			} else {
+				conn.WriteBulkString(name)
+			}
+		}
+		acl.RUnlock()
+	case "whoami":
+		conn.WriteBulkString(clientUser(conn))
+	case "cat":
+		if len(cmd.Args) == 2 {
+			conn.WriteArray(len(aclCategories))
+			for _, category := range aclCategories {
+				conn.WriteBulkString(category)
+			}
+			return
+		}
+		category := strings.ToLower(string(cmd.Args[2]))
+		commands := make([]string, 0)
+		for command := range commandCategories {
+			if (aclRule{category: category}).matches(command) {
+				commands = append(commands, command)
+			}
+		}
+		sort.Strings(commands)
+		conn.WriteArray(len(commands))
+		for _, command := range commands {
+			conn.WriteBulkString(command)
+		}
+	case "load":
+		if err := loadACL(); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown ACL subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
+
+// Connects to another node, authenticating with -peer-user and -peer-pass
+func dialPeer(addr string) (*resp.Client, error) {
+	return resp.DialAuth(addr, *peerUser, *peerPass)
+}
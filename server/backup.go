@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Writes every committed value visible at a new txID to path, while writes carry on.
+// The backup is itself a log, holding a single txn that restores each key's visible
+// version, so restoring it is just replaying it. Returns the txID it's consistent at.
+func backupTo(path string) (uint64, error) {
+	snapshotTxID := clock.Now()
+	activeTransactions.RLock()
+	activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.RUnlock()
+
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %v", tmpPath, err)
+	}
+	// Cleans up the temporary file on failure, and does nothing after the rename
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	var chain logChain
+	if err := writeFrame(f, &chain, &Operation{Op: "format", Value: logFormat}); err != nil {
+		return 0, err
+	}
+	for _, key := range tree.Keys() {
+		value, version, err := tree.GetVersionAsOf(key, snapshotTxID, activeTxdSnapshot)
+		if err != nil {
+			// Deleted, or not committed yet as of the snapshot
+			continue
+		}
+		payload, err := json.Marshal([]migratedVersion{{Value: value, CreatedBy: version}})
+		if err != nil {
+			return 0, err
+		}
+		if err := writeFrame(f, &chain, &Operation{TxID: snapshotTxID, Op: "restore", Key: key, Value: string(payload)}); err != nil {
+			return 0, err
+		}
+	}
+	if err := writeFrame(f, &chain, &Operation{TxID: snapshotTxID, Op: "commit"}); err != nil {
+		return 0, err
+	}
+
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("could not sync %s: %v", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return 0, fmt.Errorf("could not close %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("could not rename %s to %s: %v", tmpPath, path, err)
+	}
+	return snapshotTxID, nil
+}
+
+func writeFrame(f *os.File, chain *logChain, operation *Operation) error {
+	frame, err := chain.encode(operation)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(frame); err != nil {
+		return fmt.Errorf("could not write to %s: %v", f.Name(), err)
+	}
+	return nil
+}
+
+// ottodb restore [-dir path] [-key-file path] backup
+// Rebuilds a data directory from a backup taken with BACKUP. The server must not be
+// running on the directory, and the directory must not have a log yet.
+func runRestore(args []string) int {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := flags.String("dir", ".", "Data directory to restore into")
+	keyFile := flags.String("key-file", "", "Key file the backup was encrypted with, as given to -wal-key-file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: ottodb restore [-dir path] [-key-file path] backup")
+		return 2
+	}
+	if err := setWalKeyFile(*keyFile); err != nil {
+		fmt.Fprintf(os.Stderr, "could not load keys: %v\n", err)
+		return 1
+	}
+	backupPath := flags.Arg(0)
+
+	// A backup is only usable if it's complete, which its commit at the end shows
+	operations, err := readLog(backupPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read backup: %v\n", err)
+		return 1
+	}
+	if len(operations) == 0 || operations[len(operations)-1].Op != "commit" {
+		fmt.Fprintf(os.Stderr, "%s is not a complete backup\n", backupPath)
+		return 1
+	}
+
+	logPath := filepath.Join(*dir, walName)
+	if _, err := os.Stat(logPath); err == nil {
+		fmt.Fprintf(os.Stderr, "%s already exists, restore into an empty data directory\n", logPath)
+		return 1
+	}
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "could not create %s: %v\n", *dir, err)
+		return 1
+	}
+
+	b, err := ioutil.ReadFile(backupPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not read backup: %v\n", err)
+		return 1
+	}
+	tmpPath := logPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0666); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write %s: %v\n", tmpPath, err)
+		return 1
+	}
+	if err := os.Rename(tmpPath, logPath); err != nil {
+		os.Remove(tmpPath)
+		fmt.Fprintf(os.Stderr, "could not rename %s to %s: %v\n", tmpPath, logPath, err)
+		return 1
+	}
+
+	restored := 0
+	for _, operation := range operations {
+		if operation.Op == "restore" {
+			restored++
+		}
+	}
+	fmt.Printf("Restored %d keys as of txid %d into %s\n", restored, operations[len(operations)-1].TxID, logPath)
+	return 0
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/tidwall/redcon"
+)
+
+// Groups logged operations by transaction until the transaction commits or aborts
+type commitTracker struct {
+	pending map[uint64][]Operation
+}
+
+func newCommitTracker() *commitTracker {
+	return &commitTracker{pending: make(map[uint64][]Operation)}
+}
+
+// Feeds the next logged operation to the tracker. Once a transaction's commit comes
+// through, its operations are returned in the order they were logged.
+func (tracker *commitTracker) track(operation Operation) ([]Operation, bool) {
+	switch operation.Op {
+	case "commit":
+		operations := tracker.pending[operation.TxID]
+		delete(tracker.pending, operation.TxID)
+		return operations, true
+	case "abort":
+		delete(tracker.pending, operation.TxID)
+		return nil, false
+	case "prepare":
+		// Only a commit decides the outcome of a prepared transaction
+		return nil, false
+	case "format":
+		return nil, false
+	default:
+		tracker.pending[operation.TxID] = append(tracker.pending[operation.TxID], operation)
+		return nil, false
+	}
+}
+
+// Streams every transaction committed after fromTxID to the client in commit order,
+// first from the log and then as they commit. A fromTxID of 0 streams the whole log.
+func streamChanges(conn redcon.DetachedConn, fromTxID uint64) {
+	defer conn.Close()
+
+	entries, follower, err := followLog(0)
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		conn.Flush()
+		return
+	}
+	defer unfollowLog(follower)
+
+	tracker := newCommitTracker()
+	started := fromTxID == 0
+	for _, entry := range entries {
+		operation := entry.operation
+		committedOps, isCommit := tracker.track(operation)
+		if !isCommit {
+			continue
+		}
+		if !started {
+			started = operation.TxID == fromTxID
+			continue
+		}
+		writeCommittedTxn(conn, operation.TxID, committedOps)
+	}
+	if !started {
+		conn.WriteError(fmt.Sprintf("ERR txid %d has no commit in the log", fromTxID))
+		conn.Flush()
+		return
+	}
+	if err := conn.Flush(); err != nil {
+		return
+	}
+
+	for entry := range follower {
+		operation := entry.operation
+		committedOps, isCommit := tracker.track(operation)
+		if !isCommit || len(committedOps) == 0 {
+			continue
+		}
+		writeCommittedTxn(conn, operation.TxID, committedOps)
+		if err := conn.Flush(); err != nil {
+			return
+		}
+	}
+
+	// The log closed our channel because we weren't keeping up
+	conn.WriteError("ERR CDC consumer fell behind, resume with CDC FROM the last txid received")
+	conn.Flush()
+}
+
+// Writes a committed transaction as ["commit", txid, [[op, key, value], ...]]. Index
+// entries are internal, so they're left out, and JSON patches are written as sets of
+// the value they resulted in.
+func writeCommittedTxn(conn redcon.Conn, txID uint64, committedOps []Operation) {
+	operations := make([]Operation, 0, len(committedOps))
+	for _, operation := range resolveJSONPatches(txID, committedOps) {
+		if !isReservedKey(operation.Key) {
+			operations = append(operations, operation)
+		}
+	}
+	if len(operations) == 0 {
+		return
+	}
+	conn.WriteArray(3)
+	conn.WriteBulkString("commit")
+	conn.WriteInt64(int64(txID))
+	conn.WriteArray(len(operations))
+	for _, operation := range operations {
+		conn.WriteArray(3)
+		conn.WriteBulkString(operation.Op)
+		conn.WriteBulkString(operation.Key)
+		conn.WriteBulkString(operation.Value)
+	}
+}
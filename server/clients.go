@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// A connected client, kept as its connection's context
+type clientInfo struct {
+	sync.Mutex
+	id          uint64
+	addr        string
+	name        string
+	user        string // ACL user, none until the client authenticates
+	conn        redcon.Conn
+	connected   time.Time
+	lastCommand time.Time
+	command     string     // Last command run
+	txnLock     sync.Mutex // Held while the client runs a command, so its txn isn't aborted midway
+	abortedTxn  uint64     // Txn aborted for the client, until the client ends it with COMMIT or ABORT
+}
+
+var clientRegistry = struct {
+	sync.Mutex
+	nextID  uint64
+	clients map[uint64]*clientInfo
+}{clients: make(map[uint64]*clientInfo)}
+
+var errNoSuchClient = errors.New("ERR No such client")
+
+func registerClient(conn redcon.Conn) {
+	clientRegistry.Lock()
+	defer clientRegistry.Unlock()
+	clientRegistry.nextID++
+	now := time.Now()
+	info := &clientInfo{id: clientRegistry.nextID, addr: conn.RemoteAddr(), user: initialUser(), conn: conn, connected: now, lastCommand: now}
+	clientRegistry.clients[info.id] = info
+	conn.SetContext(info)
+}
+
+func unregisterClient(conn redcon.Conn) {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		clientRegistry.Lock()
+		delete(clientRegistry.clients, info.id)
+		clientRegistry.Unlock()
+	}
+}
+
+func touchClient(conn redcon.Conn, command string) {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		info.Lock()
+		info.lastCommand = time.Now()
+		info.command = command
+		info.Unlock()
+	}
+}
+
+// CLIENT LIST in Redis' format, one line of fields per client, oldest first
+func listClients() string {
+	clientRegistry.Lock()
+	clients := make([]*clientInfo, 0, len(clientRegistry.clients))
+	for _, info := range clientRegistry.clients {
+		clients = append(clients, info)
+	}
+	clientRegistry.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+
+	transactionManager.RLock()
+	defer transactionManager.RUnlock()
+	var sb strings.Builder
+	now := time.Now()
+	for _, info := range clients {
+		txID, inTransaction := transactionManager.Transactions[info.addr]
+		multi := 0
+		if inTransaction {
+			multi = 1
+		}
+		info.Lock()
+		sb.WriteString(fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d txid=%d multi=%d cmd=%s user=%s\n",
+			info.id, info.addr, info.name, int64(now.Sub(info.connected).Seconds()), int64(now.Sub(info.lastCommand).Seconds()), txID, multi, info.command, info.user))
+		info.Unlock()
+	}
+	return sb.String()
+}
+
+// Disconnects the client with the address or ID, aborting its txn
+func killClient(filter string, value string) error {
+	var killed *clientInfo
+	clientRegistry.Lock()
+	for _, info := range clientRegistry.clients {
+		if (filter == "addr" && info.addr == value) || (filter == "id" && strconv.FormatUint(info.id, 10) == value) {
+			killed = info
+			break
+		}
+	}
+	clientRegistry.Unlock()
+	if killed == nil {
+		return errNoSuchClient
+	}
+
+	abortClientTxn(killed.addr, 0)
+	killed.conn.Close()
+	return nil
+}
+
+// Aborts the txn a client has open, as if the client sent ABORT. Only aborts txID unless
+// it's 0, and returns false when there was nothing to abort. The client is told about
+// the abort by its next command.
+func abortClientTxn(client string, txID uint64) bool {
+	info := clientByAddr(client)
+	if info != nil {
+		info.txnLock.Lock()
+		defer info.txnLock.Unlock()
+	}
+
+	transactionManager.RLock()
+	current, inTransaction := transactionManager.Transactions[client]
+	transactionManager.RUnlock()
+	if !inTransaction || (txID != 0 && current != txID) {
+		return false
+	}
+	txID = current
+
+	transactionMap.Lock()
+	transaction := transactionMap.Transactions[txID]
+	delete(transactionMap.Transactions, txID)
+	transactionMap.Unlock()
+
+	writeAbortToLog(txID)
+	transaction.Abort()
+	txnAborts.Inc("client")
+	removeTxnData(txID, activeTransactions)
+	removeClientData(client, transactionManager)
+	name := ""
+	if info != nil {
+		info.Lock()
+		info.abortedTxn = txID
+		name = info.name
+		info.Unlock()
+	}
+	observeTxn(client, name, txID, "ABORT")
+	logger.Info("aborted txn for its client", "client", client, "txid", txID)
+	return true
+}
+
+func clientByAddr(addr string) *clientInfo {
+	clientRegistry.Lock()
+	defer clientRegistry.Unlock()
+	for _, info := range clientRegistry.clients {
+		if info.addr == addr {
+			return info
+		}
+	}
+	return nil
+}
+
+// Locks the client's txn until the returned func is called
+func lockClientTxn(conn redcon.Conn) func() {
+	info, ok := conn.Context().(*clientInfo)
+	if !ok {
+		return func() {}
+	}
+	info.txnLock.Lock()
+	return info.txnLock.Unlock
+}
+
+// Txn aborted for the client by someone else, 0 if none. COMMIT and ABORT clear it, since
+// they end the txn as far as the client is concerned.
+func takeAbortedTxn(conn redcon.Conn, command string) uint64 {
+	info, ok := conn.Context().(*clientInfo)
+	if !ok {
+		return 0
+	}
+	info.Lock()
+	defer info.Unlock()
+	txID := info.abortedTxn
+	if command == "commit" || command == "abort" {
+		info.abortedTxn = 0
+	}
+	return txID
+}
+
+func clientUser(conn redcon.Conn) string {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		info.Lock()
+		defer info.Unlock()
+		return info.user
+	}
+	return ""
+}
+
+func setClientUser(conn redcon.Conn, user string) {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		info.Lock()
+		info.user = user
+		info.Unlock()
+	}
+}
+
+func setClientName(conn redcon.Conn, name string) error {
+	if strings.ContainsAny(name, " \n") {
+		return errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+	}
+	if info, ok := conn.Context().(*clientInfo); ok {
+		info.Lock()
+		info.name = name
+		info.Unlock()
+	}
+	return nil
+}
+
+func clientName(conn redcon.Conn) string {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		info.Lock()
+		defer info.Unlock()
+		return info.name
+	}
+	return ""
+}
+
+func clientID(conn redcon.Conn) uint64 {
+	if info, ok := conn.Context().(*clientInfo); ok {
+		return info.id
+	}
+	return 0
+}
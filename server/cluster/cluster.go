@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var ErrSlotOutOfRange = errors.New("Invalid or out of range slot")
+
+type Node struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"` // Address clients reach the node on, as host:port
+}
+
+// A run of consecutive slots owned by the same node
+type SlotRange struct {
+	Start int
+	End   int
+	Node  Node
+}
+
+// Which node owns each slot, plus the slots moving to or from this node. There is no
+// gossip between nodes, every change is made on each node it concerns with CLUSTER SETSLOT.
+type Map struct {
+	sync.RWMutex
+	path      string
+	self      Node
+	owners    [SlotCount]Node // A zero Node means the slot isn't assigned
+	migrating map[int]Node    // Slots this node is handing to another node
+	importing map[int]Node    // Slots another node is handing to this node
+}
+
+// On disk form of the map. Owners are stored as ranges, since most slots are in long runs.
+type mapState struct {
+	Owners    []rangeState `json:"owners"`
+	Migrating map[int]Node `json:"migrating"`
+	Importing map[int]Node `json:"importing"`
+}
+
+type rangeState struct {
+	Start int  `json:"start"`
+	End   int  `json:"end"`
+	Node  Node `json:"node"`
+}
+
+// Loads the slot map saved at path, or starts an empty one if there isn't one yet
+func Open(path string, self Node) (*Map, error) {
+	slots := &Map{path: path, self: self, migrating: make(map[int]Node), importing: make(map[int]Node)}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return slots, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	var state mapState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, fmt.Errorf("could not decode %s: %v", path, err)
+	}
+	for _, owned := range state.Owners {
+		for slot := owned.Start; slot <= owned.End && slot < SlotCount; slot++ {
+			slots.owners[slot] = owned.Node
+		}
+	}
+	for slot, node := range state.Migrating {
+		slots.migrating[slot] = node
+	}
+	for slot, node := range state.Importing {
+		slots.importing[slot] = node
+	}
+	return slots, nil
+}
+
+func (slots *Map) Self() Node {
+	return slots.self
+}
+
+// Owner of slot, and whether it is assigned at all
+func (slots *Map) Owner(slot int) (Node, bool) {
+	slots.RLock()
+	defer slots.RUnlock()
+	owner := slots.owners[slot]
+	return owner, owner.ID != ""
+}
+
+func (slots *Map) Migrating(slot int) (Node, bool) {
+	slots.RLock()
+	defer slots.RUnlock()
+	node, ok := slots.migrating[slot]
+	return node, ok
+}
+
+func (slots *Map) Importing(slot int) (Node, bool) {
+	slots.RLock()
+	defer slots.RUnlock()
+	node, ok := slots.importing[slot]
+	return node, ok
+}
+
+// Assigns unassigned slots to this node
+func (slots *Map) AddSlots(slotList ...int) error {
+	slots.Lock()
+	defer slots.Unlock()
+
+	for _, slot := range slotList {
+		if slot < 0 || slot >= SlotCount {
+			return ErrSlotOutOfRange
+		}
+		if owner := slots.owners[slot]; owner.ID != "" {
+			return fmt.Errorf("Slot %d is already owned by %s", slot, owner.ID)
+		}
+	}
+	for _, slot := range slotList {
+		slots.owners[slot] = slots.self
+	}
+	return slots.save()
+}
+
+// Records node as the owner of slot. This ends any migration of the slot, which is how
+// a finished migration is made final on both ends.
+func (slots *Map) SetOwner(slot int, node Node) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrSlotOutOfRange
+	}
+	slots.Lock()
+	defer slots.Unlock()
+
+	slots.owners[slot] = node
+	delete(slots.migrating, slot)
+	delete(slots.importing, slot)
+	return slots.save()
+}
+
+// Starts handing slot over to node. Only the owner of a slot can migrate it.
+func (slots *Map) SetMigrating(slot int, node Node) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrSlotOutOfRange
+	}
+	slots.Lock()
+	defer slots.Unlock()
+
+	if slots.owners[slot].ID != slots.self.ID {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	slots.migrating[slot] = node
+	return slots.save()
+}
+
+// Starts taking slot over from node. The owner can't import its own slot.
+func (slots *Map) SetImporting(slot int, node Node) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrSlotOutOfRange
+	}
+	slots.Lock()
+	defer slots.Unlock()
+
+	if slots.owners[slot].ID == slots.self.ID {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	slots.importing[slot] = node
+	return slots.save()
+}
+
+// Cancels any migration of slot
+func (slots *Map) SetStable(slot int) error {
+	if slot < 0 || slot >= SlotCount {
+		return ErrSlotOutOfRange
+	}
+	slots.Lock()
+	defer slots.Unlock()
+
+	delete(slots.migrating, slot)
+	delete(slots.importing, slot)
+	return slots.save()
+}
+
+// Assigned slots grouped into runs owned by the same node, in slot order
+func (slots *Map) Ranges() []SlotRange {
+	slots.RLock()
+	defer slots.RUnlock()
+	return slots.ranges()
+}
+
+func (slots *Map) ranges() []SlotRange {
+	ranges := make([]SlotRange, 0)
+	for slot := 0; slot < SlotCount; slot++ {
+		owner := slots.owners[slot]
+		if owner.ID == "" {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == slot-1 && ranges[last].Node == owner {
+			ranges[last].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot, Node: owner})
+		}
+	}
+	return ranges
+}
+
+// Decides where a command on a key in slot has to be served. Returns nil if this node
+// serves it, or the MOVED, ASK or CLUSTERDOWN error to send back. keyExists is only
+// called while the slot is migrating away, since only then does the key decide it.
+// asking is set when the client sent ASKING right before the command.
+func (slots *Map) Redirect(slot int, asking bool, keyExists func() bool) error {
+	slots.RLock()
+	owner := slots.owners[slot]
+	migratingTo, migrating := slots.migrating[slot]
+	_, importing := slots.importing[slot]
+	slots.RUnlock()
+
+	if owner.ID == slots.self.ID {
+		// Keys that were already moved, or never existed, are served by the new owner
+		if migrating && !keyExists() {
+			return errors.New("ASK " + strconv.Itoa(slot) + " " + migratingTo.Addr)
+		}
+		return nil
+	}
+	if importing && asking {
+		return nil
+	}
+	if owner.ID == "" {
+		return errors.New("CLUSTERDOWN Hash slot not served")
+	}
+	return errors.New("MOVED " + strconv.Itoa(slot) + " " + owner.Addr)
+}
+
+// Writes the map to a temporary file then renames it over the old one, so a crash
+// never leaves a half written map behind
+func (slots *Map) save() error {
+	state := mapState{Owners: make([]rangeState, 0), Migrating: slots.migrating, Importing: slots.importing}
+	for _, owned := range slots.ranges() {
+		state.Owners = append(state.Owners, rangeState{Start: owned.Start, End: owned.End, Node: owned.Node})
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := slots.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0666); err != nil {
+		return fmt.Errorf("could not write %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, slots.path); err != nil {
+		return fmt.Errorf("could not replace %s: %v", slots.path, err)
+	}
+	return nil
+}
+
+// Parses a slot number argument
+func ParseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, ErrSlotOutOfRange
+	}
+	return slot, nil
+}
@@ -0,0 +1,106 @@
+package cluster
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestKeySlot(t *testing.T) {
+	// Known slots from Redis Cluster
+	expected := map[string]int{
+		"123456789": 12739,
+		"foo":       12182,
+		"bar":       5061,
+	}
+	for key, slot := range expected {
+		if actual := KeySlot(key); actual != slot {
+			t.Errorf("expected %s in slot %d, got %d", key, slot, actual)
+		}
+	}
+
+	if KeySlot("{user1000}.following") != KeySlot("{user1000}.followers") {
+		t.Errorf("expected keys with the same hash tag to share a slot")
+	}
+	// An empty tag doesn't count, so the whole key is hashed
+	if KeySlot("{}foo") != int(crc16("{}foo"))%SlotCount {
+		t.Errorf("expected an empty hash tag to be ignored")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	self := Node{ID: "a", Addr: "127.0.0.1:8080"}
+	other := Node{ID: "b", Addr: "127.0.0.1:8081"}
+	slots, err := Open(filepath.Join(t.TempDir(), "cluster.state"), self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func() bool { return true }
+	missing := func() bool { return false }
+
+	if err := slots.Redirect(0, false, exists); err == nil || err.Error() != "CLUSTERDOWN Hash slot not served" {
+		t.Errorf("expected an unassigned slot to be down, got %v", err)
+	}
+
+	slots.AddSlots(0, 1)
+	slots.SetOwner(2, other)
+	if err := slots.Redirect(0, false, exists); err != nil {
+		t.Errorf("expected an owned slot to be served, got %v", err)
+	}
+	if err := slots.Redirect(2, false, exists); err == nil || err.Error() != "MOVED 2 127.0.0.1:8081" {
+		t.Errorf("expected a MOVED redirect, got %v", err)
+	}
+
+	// Keys still here are served, the rest are sent to the node the slot is moving to
+	slots.SetMigrating(1, other)
+	if err := slots.Redirect(1, false, exists); err != nil {
+		t.Errorf("expected an existing key of a migrating slot to be served, got %v", err)
+	}
+	if err := slots.Redirect(1, false, missing); err == nil || err.Error() != "ASK 1 127.0.0.1:8081" {
+		t.Errorf("expected an ASK redirect, got %v", err)
+	}
+
+	// An importing slot is only served after ASKING
+	slots.SetImporting(2, other)
+	if err := slots.Redirect(2, false, missing); err == nil || err.Error() != "MOVED 2 127.0.0.1:8081" {
+		t.Errorf("expected a MOVED redirect without ASKING, got %v", err)
+	}
+	if err := slots.Redirect(2, true, missing); err != nil {
+		t.Errorf("expected an importing slot to be served after ASKING, got %v", err)
+	}
+}
+
+func TestMapPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cluster.state")
+	self := Node{ID: "a", Addr: "127.0.0.1:8080"}
+	other := Node{ID: "b", Addr: "127.0.0.1:8081"}
+	slots, err := Open(path, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := slots.AddSlots(0, 1, 2, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := slots.AddSlots(2); err == nil {
+		t.Errorf("expected adding an owned slot to fail")
+	}
+	slots.SetOwner(3, other)
+	slots.SetMigrating(5, other)
+
+	slots, err = Open(path, self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := slots.Ranges()
+	if len(ranges) != 3 || ranges[0] != (SlotRange{0, 2, self}) || ranges[1] != (SlotRange{3, 3, other}) || ranges[2] != (SlotRange{5, 5, self}) {
+		t.Errorf("unexpected ranges after reopening: %v", ranges)
+	}
+	if node, ok := slots.Migrating(5); !ok || node != other {
+		t.Errorf("expected slot 5 to still be migrating to b")
+	}
+
+	// Taking ownership finishes the migration
+	slots.SetOwner(5, other)
+	if _, ok := slots.Migrating(5); ok {
+		t.Errorf("expected setting the owner to end the migration")
+	}
+}
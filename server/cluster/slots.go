@@ -0,0 +1,42 @@
+package cluster
+
+import "strings"
+
+// Same slot count and hash as Redis Cluster, so cluster aware Redis clients can route keys
+const SlotCount = 16384
+
+// CRC16-CCITT (XMODEM) lookup table
+var crc16Table [256]uint16
+
+func init() {
+	for i := 0; i < 256; i++ {
+		crc := uint16(i) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		crc16Table[i] = crc
+	}
+}
+
+func crc16(b string) uint16 {
+	var crc uint16
+	for i := 0; i < len(b); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^b[i]]
+	}
+	return crc
+}
+
+// Returns the slot a key belongs to. If the key has a non-empty {hash tag}, only the tag
+// is hashed, so keys sharing a tag always land on the same node.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % SlotCount
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"OttoDB/server/cluster"
+	"OttoDB/server/resp"
+	"OttoDB/server/store/binTree"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	clusterID    = flag.String("cluster-id", "", "ID of this node in a sharded cluster, sharding is disabled when empty")
+	clusterAddr  = flag.String("cluster-addr", "127.0.0.1:8080", "Address other nodes and clients reach this node on")
+	clusterState = flag.String("cluster-state", "./cluster.state", "File holding the slot map, relative to -dir")
+
+	clusterSlots *cluster.Map
+
+	// Clients that sent ASKING. It only covers the command right after it.
+	askingClients = struct {
+		sync.Mutex
+		clients map[string]bool
+	}{clients: make(map[string]bool)}
+)
+
+// Commands taking a key as their first argument, which are served by the key's slot owner
+var keyedCommands = map[string]bool{
+	"get":             true,
+	"getv":            true,
+	"set":             true,
+	"del":             true,
+	"cas":             true,
+	"json.set":        true,
+	"json.get":        true,
+	"json.del":        true,
+	"history":         true,
+	"restoreversions": true,
+}
+
+// A version of a key as it's copied between nodes
+type migratedVersion struct {
+	Value     string `json:"value"`
+	CreatedBy uint64 `json:"createdBy"`
+	ExpiredBy uint64 `json:"expiredBy"`
+}
+
+func startCluster() error {
+	slots, err := cluster.Open(dataPath(*clusterState), cluster.Node{ID: *clusterID, Addr: *clusterAddr})
+	if err != nil {
+		return err
+	}
+	clusterSlots = slots
+	return nil
+}
+
+// Returns the redirect for commands on keys this node doesn't serve
+func checkClusterSlot(client string, cmd redcon.Command) error {
+	if clusterSlots == nil {
+		return nil
+	}
+	command := strings.ToLower(string(cmd.Args[0]))
+	if command == "asking" {
+		return nil
+	}
+
+	askingClients.Lock()
+	asking := askingClients.clients[client]
+	delete(askingClients.clients, client)
+	askingClients.Unlock()
+
+	if !keyedCommands[command] || len(cmd.Args) < 2 {
+		return nil
+	}
+	key := string(cmd.Args[1])
+	return clusterSlots.Redirect(cluster.KeySlot(key), asking, func() bool { return keyExists(key) })
+}
+
+func setAsking(client string) {
+	askingClients.Lock()
+	defer askingClients.Unlock()
+	askingClients.clients[client] = true
+}
+
+func clearAsking(client string) {
+	askingClients.Lock()
+	defer askingClients.Unlock()
+	delete(askingClients.clients, client)
+}
+
+// Whether key has a committed value right now
+func keyExists(key string) bool {
+	activeTransactions.RLock()
+	activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.RUnlock()
+
+	_, err := tree.Get(key, clock.Now(), activeTxdSnapshot)
+	return err == nil
+}
+
+// Keys in slot with a committed value, in order
+func keysInSlot(slot int) []string {
+	keys := make([]string, 0)
+	for _, key := range tree.Keys() {
+		if cluster.KeySlot(key) == slot && keyExists(key) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Moves key, with all its committed versions, to the node at addr. The key is deleted here
+// in a txn that stays active until the copy is done, so no writes to it can sneak in
+// between. Returns false if there was no key to move.
+func migrateKey(addr string, key string) (bool, error) {
+	activeTransactions.Lock()
+	txID := clock.Now()
+	activeTransactions.ActiveTransactions[txID] = true
+	activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.Unlock()
+	defer removeTxnData(txID, activeTransactions)
+
+	if _, err := tree.Get(key, txID, activeTxdSnapshot); err != nil {
+		return false, nil
+	}
+	transaction := NewTransaction(txID)
+	expiredRecord, err := tree.Expire(key, txID, activeTxdSnapshot)
+	if err != nil {
+		return false, fmt.Errorf("TRYAGAIN %v", err)
+	}
+	transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+
+	history := tree.History(key)
+	versions := make([]migratedVersion, 0, len(history))
+	for i := len(history) - 1; i >= 0; i-- {
+		version := history[i]
+		if version.Status == binTree.Aborted || (activeTxdSnapshot[version.CreatedBy] && version.CreatedBy != txID) {
+			continue
+		}
+		// The delete done by this migration, or any other unfinished one, isn't copied
+		expiredBy := version.ExpiredBy
+		if activeTxdSnapshot[expiredBy] {
+			expiredBy = 0
+		}
+		versions = append(versions, migratedVersion{Value: version.Value, CreatedBy: version.CreatedBy, ExpiredBy: expiredBy})
+	}
+	payload, err := json.Marshal(versions)
+	if err != nil {
+		transaction.Abort()
+		countAbort(err)
+		return false, err
+	}
+
+	client, err := dialPeer(addr)
+	if err != nil {
+		transaction.Abort()
+		countAbort(err)
+		return false, fmt.Errorf("IOERR error connecting to %s: %v", addr, err)
+	}
+	defer client.Close()
+	if _, err := client.Do("ASKING"); err != nil {
+		transaction.Abort()
+		countAbort(err)
+		return false, fmt.Errorf("IOERR %v", err)
+	}
+	if _, err := client.Do("RESTOREVERSIONS", key, string(payload)); err != nil {
+		transaction.Abort()
+		countAbort(err)
+		if _, isReply := err.(resp.Error); isReply {
+			return false, err
+		}
+		return false, fmt.Errorf("IOERR %v", err)
+	}
+
+	if err := writeToLog(&Operation{TxID: txID, Op: "del", Key: key}, txID); err != nil {
+		transaction.Abort()
+		countAbort(err)
+		return false, fmt.Errorf("ERR key was copied to %s but could not be deleted here: %v", addr, err)
+	}
+	if err := writeCommitToLog(txID); err != nil {
+		writeAbortToLog(txID)
+		transaction.Abort()
+		countAbort(err)
+		return false, fmt.Errorf("ERR key was copied to %s but could not be deleted here: %v", addr, err)
+	}
+	return true, nil
+}
+
+// Adds the versions of a key migrated from another node. They keep the source's
+// timestamps, so the clock here is moved past them first, or newer txns wouldn't see them.
+func restoreVersions(key string, payload string) error {
+	versions, err := decodeVersions(payload)
+	if err != nil {
+		return err
+	}
+	if keyExists(key) {
+		return errors.New("BUSYKEY Target key name already exists.")
+	}
+
+	var newest uint64
+	for _, version := range versions {
+		if version.CreatedBy > newest {
+			newest = version.CreatedBy
+		}
+		if version.ExpiredBy > newest {
+			newest = version.ExpiredBy
+		}
+	}
+	if err := clock.Update(newest); err != nil {
+		return fmt.Errorf("ERR invalid versions payload: %v", err)
+	}
+	txID := clock.Now()
+
+	if err := writeToLog(&Operation{TxID: txID, Op: "restore", Key: key, Value: payload}, txID); err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	if err := writeCommitToLog(txID); err != nil {
+		writeAbortToLog(txID)
+		return fmt.Errorf("ERR %v", err)
+	}
+	if err := tree.Restore(key, versions); err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	return nil
+}
+
+func decodeVersions(payload string) ([]binTree.Record, error) {
+	var versions []migratedVersion
+	if err := json.Unmarshal([]byte(payload), &versions); err != nil || len(versions) == 0 {
+		return nil, errors.New("ERR invalid versions payload")
+	}
+	records := make([]binTree.Record, 0, len(versions))
+	for _, version := range versions {
+		records = append(records, binTree.Record{Value: version.Value, CreatedBy: version.CreatedBy, ExpiredBy: version.ExpiredBy})
+	}
+	return records, nil
+}
+
+// Handles CLUSTER subcommands. Every slot map change is only made on this node.
+func clusterCommand(conn redcon.Conn, cmd redcon.Command) {
+	if clusterSlots == nil {
+		conn.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+
+	switch strings.ToLower(string(cmd.Args[1])) {
+	default:
+		conn.WriteError("ERR unknown CLUSTER subcommand '" + string(cmd.Args[1]) + "'")
+
+	case "myid":
+		conn.WriteBulkString(clusterSlots.Self().ID)
+
+	case "keyslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster keyslot' command")
+			return
+		}
+		conn.WriteInt(cluster.KeySlot(string(cmd.Args[2])))
+
+	case "slots":
+		ranges := clusterSlots.Ranges()
+		conn.WriteArray(len(ranges))
+		for _, owned := range ranges {
+			host, port, err := net.SplitHostPort(owned.Node.Addr)
+			if err != nil {
+				host = owned.Node.Addr
+			}
+			portNumber, _ := strconv.Atoi(port)
+
+			conn.WriteArray(3)
+			conn.WriteInt(owned.Start)
+			conn.WriteInt(owned.End)
+			conn.WriteArray(3)
+			conn.WriteBulkString(host)
+			conn.WriteInt(portNumber)
+			conn.WriteBulkString(owned.Node.ID)
+		}
+
+	case "addslots":
+		if len(cmd.Args) < 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster addslots' command")
+			return
+		}
+		slots := make([]int, 0, len(cmd.Args)-2)
+		for _, arg := range cmd.Args[2:] {
+			slot, err := cluster.ParseSlot(string(arg))
+			if err != nil {
+				conn.WriteError("ERR " + err.Error())
+				return
+			}
+			slots = append(slots, slot)
+		}
+		if err := clusterSlots.AddSlots(slots...); err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+
+	case "setslot":
+		// CLUSTER SETSLOT slot NODE|MIGRATING|IMPORTING id host:port, or CLUSTER SETSLOT slot STABLE
+		if len(cmd.Args) < 4 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster setslot' command")
+			return
+		}
+		slot, err := cluster.ParseSlot(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		state := strings.ToLower(string(cmd.Args[3]))
+		if state == "stable" {
+			err = clusterSlots.SetStable(slot)
+		} else {
+			if len(cmd.Args) != 6 {
+				conn.WriteError("ERR wrong number of arguments for 'cluster setslot' command")
+				return
+			}
+			node := cluster.Node{ID: string(cmd.Args[4]), Addr: string(cmd.Args[5])}
+			switch state {
+			case "node":
+				err = clusterSlots.SetOwner(slot, node)
+			case "migrating":
+				err = clusterSlots.SetMigrating(slot, node)
+			case "importing":
+				err = clusterSlots.SetImporting(slot, node)
+			default:
+				conn.WriteError("ERR Invalid CLUSTER SETSLOT action or number of arguments")
+				return
+			}
+		}
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteString("OK")
+
+	case "countkeysinslot":
+		if len(cmd.Args) != 3 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster countkeysinslot' command")
+			return
+		}
+		slot, err := cluster.ParseSlot(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		conn.WriteInt(len(keysInSlot(slot)))
+
+	case "getkeysinslot":
+		if len(cmd.Args) != 4 {
+			conn.WriteError("ERR wrong number of arguments for 'cluster getkeysinslot' command")
+			return
+		}
+		slot, err := cluster.ParseSlot(string(cmd.Args[2]))
+		if err != nil {
+			conn.WriteError("ERR " + err.Error())
+			return
+		}
+		count, err := strconv.Atoi(string(cmd.Args[3]))
+		if err != nil || count < 0 {
+			conn.WriteError("ERR Invalid number of keys")
+			return
+		}
+		keys := keysInSlot(slot)
+		if len(keys) > count {
+			keys = keys[:count]
+		}
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Settings are the flags of a flag set. A setting comes from, in order of precedence,
+// its command line flag, its environment variable (OTTODB_ and the name in upper case
+// with - as _), the config file, or its default.
+type Config struct {
+	sync.RWMutex
+	flags *flag.FlagSet
+	// Settings that can be changed while running, and what applies a new value
+	live map[string]func(value string) error
+}
+
+func New(flags *flag.FlagSet) *Config {
+	return &Config{flags: flags, live: make(map[string]func(value string) error)}
+}
+
+// Environment variable a setting is read from
+func EnvName(name string) string {
+	return "OTTODB_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Parses args, then fills in the settings they don't have from the environment and the
+// config file. The file's path is the value of the setting named fileSetting.
+func (c *Config) Load(args []string, fileSetting string) error {
+	if err := c.flags.Parse(args); err != nil {
+		return err
+	}
+	if !c.explicit()[fileSetting] {
+		if path, ok := os.LookupEnv(EnvName(fileSetting)); ok {
+			c.flags.Set(fileSetting, path)
+		}
+	}
+	return c.fill(c.flags.Lookup(fileSetting).Value.String())
+}
+
+func (c *Config) explicit() map[string]bool {
+	set := make(map[string]bool)
+	c.flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+func (c *Config) fill(path string) error {
+	fileValues := make(map[string]string)
+	if path != "" {
+		var err error
+		if fileValues, err = ReadFile(path); err != nil {
+			return err
+		}
+		for name := range fileValues {
+			if c.flags.Lookup(name) == nil {
+				return fmt.Errorf("unknown setting %s in %s", name, path)
+			}
+		}
+	}
+
+	fromArgs := c.explicit()
+	var err error
+	c.flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || fromArgs[f.Name] {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(f.Name)); ok {
+			if setErr := c.flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %v", value, EnvName(f.Name), setErr)
+			}
+		} else if value, ok := fileValues[f.Name]; ok {
+			if setErr := c.flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s in %s: %v", value, f.Name, path, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// Reads a config file of "name value" lines. Blank lines and lines starting with # are
+// skipped, and the value can be quoted.
+func ReadFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		value := ""
+		if len(fields) == 2 {
+			value = strings.TrimSpace(fields[1])
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			value = value[1 : len(value)-1]
+		}
+		values[fields[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	return values, nil
+}
+
+// Lets the setting be changed while running. apply is called with every new value as
+// it's stored, and rejects it by returning an error. It can't read settings itself.
+func (c *Config) Live(name string, apply func(value string) error) {
+	c.Lock()
+	defer c.Unlock()
+	c.live[name] = apply
+}
+
+func (c *Config) Get(name string) (string, bool) {
+	c.RLock()
+	defer c.RUnlock()
+	f := c.flags.Lookup(name)
+	if f == nil {
+		return "", false
+	}
+	return f.Value.String(), true
+}
+
+func (c *Config) String(name string) string {
+	value, _ := c.Get(name)
+	return value
+}
+
+func (c *Config) Int(name string) int {
+	c.RLock()
+	defer c.RUnlock()
+	if getter, ok := c.flags.Lookup(name).Value.(flag.Getter); ok {
+		if value, ok := getter.Get().(int); ok {
+			return value
+		}
+	}
+	return 0
+}
+
+// Changes a live setting
+func (c *Config) Set(name string, value string) error {
+	c.Lock()
+	defer c.Unlock()
+	f := c.flags.Lookup(name)
+	if f == nil {
+		return fmt.Errorf("unknown setting %s", name)
+	}
+	apply, ok := c.live[name]
+	if !ok {
+		return fmt.Errorf("%s can only be set at startup", name)
+	}
+
+	old := f.Value.String()
+	if err := c.flags.Set(name, value); err != nil {
+		// A value that doesn't parse can still overwrite the old one
+		c.flags.Set(name, old)
+		return fmt.Errorf("invalid value %q for %s", value, name)
+	}
+	if err := apply(f.Value.String()); err != nil {
+		c.flags.Set(name, old)
+		return fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+	}
+	return nil
+}
+
+// Names of every setting, sorted
+func (c *Config) Names() []string {
+	names := make([]string, 0)
+	c.flags.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newFlags() *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("config", "", "")
+	flags.String("bind", "", "")
+	flags.Int("port", 8080, "")
+	flags.String("dir", ".", "")
+	flags.Int("maxclients", 100, "")
+	return flags
+}
+
+func TestPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ottodb.conf")
+	file := "# comment\n\nport 7000\ndir \"/var/lib/ottodb\"\nbind 10.0.0.1\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("OTTODB_CONFIG", path)
+	os.Setenv("OTTODB_PORT", "7001")
+	os.Setenv("OTTODB_BIND", "10.0.0.2")
+	defer os.Unsetenv("OTTODB_CONFIG")
+	defer os.Unsetenv("OTTODB_PORT")
+	defer os.Unsetenv("OTTODB_BIND")
+
+	config := New(newFlags())
+	if err := config.Load([]string{"-bind", "10.0.0.3"}, "config"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"bind":       "10.0.0.3",        // Flag over environment
+		"port":       "7001",            // Environment over file
+		"dir":        "/var/lib/ottodb", // File over default
+		"maxclients": "100",             // Default
+	}
+	for name, value := range expected {
+		if actual := config.String(name); actual != value {
+			t.Errorf("expected %s to be %s, got %s", name, value, actual)
+		}
+	}
+	if port := config.Int("port"); port != 7001 {
+		t.Errorf("expected port 7001, got %d", port)
+	}
+}
+
+func TestUnknownSettingInFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ottodb.conf")
+	if err := ioutil.WriteFile(path, []byte("prot 7000\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(newFlags()).Load([]string{"-config", path}, "config"); err == nil {
+		t.Errorf("expected a misspelled setting to be rejected")
+	}
+}
+
+func TestLiveSettings(t *testing.T) {
+	config := New(newFlags())
+	if err := config.Load(nil, "config"); err != nil {
+		t.Fatal(err)
+	}
+	config.Live("maxclients", func(value string) error {
+		if value == "0" {
+			return errors.New("maxclients must be positive")
+		}
+		return nil
+	})
+
+	if err := config.Set("port", "9000"); err == nil {
+		t.Errorf("expected port to only be settable at startup")
+	}
+	if err := config.Set("maxclients", "many"); err == nil {
+		t.Errorf("expected a value that isn't a number to be rejected")
+	}
+	if err := config.Set("maxclients", "0"); err == nil {
+		t.Errorf("expected the value to be rejected")
+	}
+	if maxClients := config.Int("maxclients"); maxClients != 100 {
+		t.Errorf("expected a rejected value to leave 100, got %d", maxClients)
+	}
+	if err := config.Set("maxclients", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if maxClients := config.Int("maxclients"); maxClients != 5 {
+		t.Errorf("expected 5, got %d", maxClients)
+	}
+}
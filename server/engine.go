@@ -0,0 +1,71 @@
+package main
+
+import (
+	"OttoDB/server/store/lsm"
+	"flag"
+	"fmt"
+	"time"
+)
+
+var (
+	engineName = flag.String("engine", "memory", "Storage engine, memory to keep every key in memory or lsm to keep them on disk")
+	lsmDir     = flag.String("lsm-dir", "./lsm", "Directory the lsm engine keeps its tables in, relative to -dir")
+	_          = flag.Int("memtable-keys", 100000, "Keys the lsm engine holds in memory before flushing them to disk")
+
+	diskEngine *lsm.Tree
+)
+
+// How often the memtable's size is checked
+const flushInterval = time.Second
+
+// Opens the engine picked with -engine, and returns the offset to replay the log from.
+// The log is only replayed from the start for the memory engine.
+func openEngine() (int64, error) {
+	switch *engineName {
+	case "memory":
+		return 0, nil
+	case "lsm":
+		engine, err := lsm.Open(dataPath(*lsmDir), logger)
+		if err != nil {
+			return 0, err
+		}
+		diskEngine = engine
+		tree = engine
+
+		// Txns before the checkpoint aren't replayed, so the clock can't learn about them there
+		checkpoint := engine.Checkpoint()
+		if err := clock.Update(checkpoint.TxID); err != nil {
+			return 0, fmt.Errorf("checkpoint is ahead of the system clock: %v", err)
+		}
+		return checkpoint.Offset, nil
+	default:
+		return 0, fmt.Errorf("unknown engine %s, expected memory or lsm", *engineName)
+	}
+}
+
+// Flushes the memtable to disk whenever it outgrows -memtable-keys
+func flushEngine() {
+	for range time.Tick(flushInterval) {
+		if diskEngine.MemtableSize() < settings.Int("memtable-keys") {
+			continue
+		}
+		if err := checkpointEngine(); err != nil {
+			logger.Error("could not flush memtable", "err", err)
+		}
+	}
+}
+
+func checkpointEngine() error {
+	// Replicas and raft members rebuild from the whole log, so only a primary moves
+	// the checkpoint. The log size is read before the flush snapshots the active txns,
+	// so everything logged before the checkpoint belongs to a txn that has ended.
+	position := lsm.LogPosition{Offset: -1}
+	if !isReplica() && raftNode == nil {
+		position = lsm.LogPosition{Offset: logSize(), TxID: clock.Last()}
+	}
+	return diskEngine.Flush(func() map[uint64]bool {
+		activeTransactions.RLock()
+		defer activeTransactions.RUnlock()
+		return shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	}, position)
+}
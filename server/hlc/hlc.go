@@ -0,0 +1,98 @@
+package hlc
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Timestamps pack the physical time in milliseconds since the Unix epoch into the high
+// 48 bits and a logical counter into the low 16 bits, so they still compare as plain
+// uint64s. Timestamps from before the clock existed (small counters) sort before all
+// of its timestamps.
+const logicalBits = 16
+
+const logicalMask = 1<<logicalBits - 1
+
+// How far ahead of the wall clock a timestamp seen elsewhere can be. Anything further
+// comes from a broken clock or a bad payload, and following it would leave the clock
+// stuck on the counter.
+const MaxOffset = 5 * time.Second
+
+// A hybrid logical clock. Timestamps it hands out are unique, always increase, stay
+// close to wall time, and order after every timestamp the clock has been updated with,
+// which is what makes them comparable across nodes.
+type Clock struct {
+	sync.Mutex
+	last uint64
+	now  func() time.Time
+}
+
+func NewClock() *Clock {
+	return &Clock{now: time.Now}
+}
+
+// Clock reading the time from now, for tests
+func NewClockWithSource(now func() time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Returns a new timestamp, later than any timestamp returned or seen before
+func (clock *Clock) Now() uint64 {
+	clock.Lock()
+	defer clock.Unlock()
+
+	physical := FromTime(clock.now()) &^ logicalMask
+	if physical > clock.last {
+		clock.last = physical
+	} else if clock.last == math.MaxUint64 {
+		// Update never lets the clock get here, wrapping around would break every ordering
+		panic("hlc: clock ran out of timestamps")
+	} else {
+		// The wall clock is behind, or in the same millisecond. The counter keeps order.
+		clock.last++
+	}
+	return clock.last
+}
+
+// Returns the latest timestamp returned or seen, without advancing the clock
+func (clock *Clock) Last() uint64 {
+	clock.Lock()
+	defer clock.Unlock()
+	return clock.last
+}
+
+// Moves the clock past a timestamp seen elsewhere, e.g. from another node or the log.
+// Timestamps more than MaxOffset ahead of the wall clock are refused.
+func (clock *Clock) Update(timestamp uint64) error {
+	clock.Lock()
+	defer clock.Unlock()
+	if limit := FromTime(clock.now().Add(MaxOffset)); timestamp > limit {
+		return fmt.Errorf("timestamp %d is more than %v ahead of the clock", timestamp, MaxOffset)
+	}
+	if timestamp > clock.last {
+		clock.last = timestamp
+	}
+	return nil
+}
+
+// Returns the latest timestamp that could have been handed out at t
+func FromTime(t time.Time) uint64 {
+	millis := t.UnixNano() / int64(time.Millisecond)
+	if millis < 0 {
+		return 0
+	}
+	return uint64(millis)<<logicalBits | logicalMask
+}
+
+// Returns the wall time a timestamp was taken at
+func Time(timestamp uint64) time.Time {
+	millis := int64(timestamp >> logicalBits)
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
+
+// Returns the logical counter of a timestamp
+func Logical(timestamp uint64) uint64 {
+	return timestamp & logicalMask
+}
@@ -0,0 +1,81 @@
+package hlc
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestNowIncreases(t *testing.T) {
+	wall := time.Unix(1700000000, 0)
+	clock := NewClockWithSource(func() time.Time { return wall })
+
+	first := clock.Now()
+	second := clock.Now()
+	if second <= first {
+		t.Errorf("expected %d to come after %d", second, first)
+	}
+	if !Time(first).Equal(wall) || Logical(first) != 0 || Logical(second) != 1 {
+		t.Errorf("expected the same millisecond to bump the counter, got %d and %d", first, second)
+	}
+
+	// A wall clock going backwards never makes timestamps go backwards
+	wall = wall.Add(-time.Second)
+	if third := clock.Now(); third <= second {
+		t.Errorf("expected %d to come after %d", third, second)
+	}
+
+	wall = wall.Add(time.Hour)
+	if fourth := clock.Now(); !Time(fourth).Equal(wall) || Logical(fourth) != 0 {
+		t.Errorf("expected the clock to follow the wall clock again, got %v", Time(fourth))
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	wall := time.Unix(1700000000, 0)
+	clock := NewClockWithSource(func() time.Time { return wall })
+
+	// A timestamp from a node whose clock runs ahead
+	remote := FromTime(wall.Add(time.Second))
+	if err := clock.Update(remote); err != nil {
+		t.Fatal(err)
+	}
+	if now := clock.Now(); now <= remote {
+		t.Errorf("expected %d to come after the remote %d", now, remote)
+	}
+
+	// Older timestamps, like txIDs from before the clock, change nothing
+	last := clock.Last()
+	clock.Update(42)
+	if clock.Last() != last {
+		t.Errorf("expected an older timestamp to be ignored")
+	}
+}
+
+func TestUpdateRefusesFarFuture(t *testing.T) {
+	wall := time.Unix(1700000000, 0)
+	clock := NewClockWithSource(func() time.Time { return wall })
+	last := clock.Now()
+
+	for _, timestamp := range []uint64{FromTime(wall.Add(time.Hour)), math.MaxUint64} {
+		if err := clock.Update(timestamp); err == nil {
+			t.Errorf("expected %d to be refused", timestamp)
+		}
+	}
+	if clock.Last() != last {
+		t.Errorf("expected refused timestamps to leave the clock alone")
+	}
+}
+
+func TestFromTime(t *testing.T) {
+	wall := time.Unix(1700000000, 0)
+	clock := NewClockWithSource(func() time.Time { return wall })
+	timestamp := clock.Now()
+
+	if FromTime(wall) < timestamp {
+		t.Errorf("expected timestamps taken at a time to be at most FromTime of it")
+	}
+	if FromTime(wall.Add(-time.Millisecond)) >= timestamp {
+		t.Errorf("expected timestamps taken later to come after FromTime")
+	}
+}
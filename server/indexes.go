@@ -0,0 +1,421 @@
+package main
+
+import (
+	"OttoDB/server/jsonpath"
+	"OttoDB/server/store/binTree"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Index definitions and entries are kept as ordinary keys under this prefix, so they're
+// versioned, logged and rolled back like any other write. Clients can't use it.
+// A definition is stored at indexPrefix+name, and every indexed key has an entry at
+// indexPrefix+name\x00value\x00key.
+const indexPrefix = "\x00idx:"
+
+// How long CREATE INDEX waits for txns that might have written unindexed values, and
+// keeps retrying a build that ran into a txn writing the same entry
+const indexBuildTimeout = 30 * time.Second
+
+var errIndexConflict = errors.New("an index entry is being written by another transaction")
+
+type indexDef struct {
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"` // Only keys starting with it are indexed
+	Path   string `json:"path"`
+	path   jsonpath.Path
+}
+
+// Indexes writes on this node have to keep up to date. Reloaded from the tree whenever
+// a definition is written by replication, so a replica that's promoted knows them.
+var indexes = struct {
+	sync.RWMutex
+	defs     map[string]*indexDef
+	building map[string]*indexDef // Being created, not committed yet
+	stale    bool
+}{defs: make(map[string]*indexDef), building: make(map[string]*indexDef), stale: true}
+
+func isReservedKey(key string) bool {
+	return strings.HasPrefix(key, indexPrefix)
+}
+
+func isIndexDefKey(key string) bool {
+	return isReservedKey(key) && !strings.Contains(key[len(indexPrefix):], "\x00")
+}
+
+func indexEntryPrefix(name string, indexed string) string {
+	return indexPrefix + name + "\x00" + indexed + "\x00"
+}
+
+func parseIndexDef(name string, prefix string, path string) (*indexDef, error) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return nil, errors.New("ERR invalid index name")
+	}
+	parsed, err := jsonpath.Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("ERR %v", err)
+	}
+	return &indexDef{Name: name, Prefix: prefix, Path: path, path: parsed}, nil
+}
+
+// Returns what value indexes key under, if the value is JSON with something at the path.
+// Strings are indexed as they are, anything else by its JSON encoding.
+func (def *indexDef) valueOf(value string) (string, bool) {
+	if value == "" {
+		return "", false
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return "", false
+	}
+	found, ok := def.path.Get(doc)
+	if !ok {
+		return "", false
+	}
+	if s, isString := found.(string); isString {
+		return s, true
+	}
+	encoded, err := encodeJSON(found)
+	return encoded, err == nil
+}
+
+// The value a write replaced. Expire hands back the key's newest record even when it was
+// already deleted or aborted, in which case nothing was replaced.
+func expiredValue(expiredRecord *binTree.Record) *string {
+	if expiredRecord == nil || expiredRecord.OldExpiredBy != 0 || expiredRecord.Status == binTree.Aborted {
+		return nil
+	}
+	return &expiredRecord.Value
+}
+
+func markIndexesStale() {
+	indexes.Lock()
+	defer indexes.Unlock()
+	indexes.stale = true
+}
+
+// Returns every index key falls under
+func indexesOn(key string) []*indexDef {
+	if isReservedKey(key) {
+		return nil
+	}
+
+	indexes.RLock()
+	stale := indexes.stale
+	indexes.RUnlock()
+	if stale {
+		loadIndexes()
+	}
+
+	indexes.RLock()
+	defer indexes.RUnlock()
+	matching := make([]*indexDef, 0)
+	for _, defs := range []map[string]*indexDef{indexes.defs, indexes.building} {
+		for _, def := range defs {
+			if strings.HasPrefix(key, def.Prefix) {
+				matching = append(matching, def)
+			}
+		}
+	}
+	return matching
+}
+
+// Reads the committed index definitions from the tree
+func loadIndexes() {
+	activeTransactions.RLock()
+	activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.RUnlock()
+	now := clock.Now()
+
+	defs := make(map[string]*indexDef)
+	for _, key := range tree.KeysWithPrefix(indexPrefix) {
+		if !isIndexDefKey(key) {
+			continue
+		}
+		value, err := tree.Get(key, now, activeTxdSnapshot)
+		if err != nil {
+			continue
+		}
+		var stored indexDef
+		if err := json.Unmarshal([]byte(value), &stored); err != nil {
+			logger.Warn("skipping index with a bad definition", "index", key[len(indexPrefix):], "err", err)
+			continue
+		}
+		def, err := parseIndexDef(stored.Name, stored.Prefix, stored.Path)
+		if err != nil {
+			logger.Warn("skipping index with a bad definition", "index", key[len(indexPrefix):], "err", err)
+			continue
+		}
+		defs[def.Name] = def
+	}
+
+	indexes.Lock()
+	defer indexes.Unlock()
+	indexes.defs = defs
+	indexes.stale = false
+}
+
+// Keeps the indexes on key in step with a write that replaced the expired version with
+// value, or deleted it if value is empty. Entry writes are logged and added to the txn,
+// so they commit or roll back with it.
+func updateIndexes(transaction *Transaction, key string, expired *string, value string, activeTxdSnapshot map[uint64]bool) error {
+	for _, def := range indexesOn(key) {
+		oldIndexed, hadOld := "", false
+		if expired != nil {
+			oldIndexed, hadOld = def.valueOf(*expired)
+		}
+		newIndexed, hasNew := def.valueOf(value)
+		if hadOld && hasNew && oldIndexed == newIndexed {
+			continue
+		}
+
+		if hadOld {
+			if err := deleteIndexKey(transaction, indexEntryPrefix(def.Name, oldIndexed)+key, activeTxdSnapshot); err != nil {
+				return err
+			}
+		}
+		if hasNew {
+			if err := setIndexKey(transaction, indexEntryPrefix(def.Name, newIndexed)+key, "1", activeTxdSnapshot); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setIndexKey(transaction *Transaction, key string, value string, activeTxdSnapshot map[uint64]bool) error {
+	txID := transaction.timestamp
+	expiredRecord, err := tree.Expire(key, txID, activeTxdSnapshot)
+	if err != nil {
+		return err
+	}
+	if expiredRecord != nil {
+		transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+	}
+	transaction.keys = append(transaction.keys, key)
+	insertedRecord, err := tree.Set(key, value, txID, activeTxdSnapshot)
+	if err != nil {
+		return err
+	}
+	transaction.insertedRecords = append(transaction.insertedRecords, insertedRecord)
+	return writeToLog(&Operation{TxID: txID, Op: "set", Key: key, Value: value}, txID)
+}
+
+func deleteIndexKey(transaction *Transaction, key string, activeTxdSnapshot map[uint64]bool) error {
+	txID := transaction.timestamp
+	expiredRecord, err := tree.Expire(key, txID, activeTxdSnapshot)
+	if err != nil {
+		return err
+	}
+	if expiredRecord != nil {
+		transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+	}
+	transaction.keys = append(transaction.keys, key)
+	return writeToLog(&Operation{TxID: txID, Op: "del", Key: key}, txID)
+}
+
+// Creates an index and indexes the keys already there, all in one txn of its own.
+// Writes from the moment it starts keep the index up to date themselves, so it waits
+// for txns that may have written before then to end, and indexes what they left.
+// A build that conflicts with one of those writes is aborted and tried again, since
+// the write may still be rolled back.
+func createIndex(def *indexDef) error {
+	indexes.Lock()
+	if indexes.stale {
+		indexes.Unlock()
+		loadIndexes()
+		indexes.Lock()
+	}
+	if indexes.defs[def.Name] != nil || indexes.building[def.Name] != nil {
+		indexes.Unlock()
+		return fmt.Errorf("ERR index %s already exists", def.Name)
+	}
+	indexes.building[def.Name] = def
+	indexes.Unlock()
+	defer func() {
+		indexes.Lock()
+		delete(indexes.building, def.Name)
+		indexes.Unlock()
+	}()
+
+	deadline := time.Now().Add(indexBuildTimeout)
+	if err := waitForActiveTxns(indexBuildTimeout); err != nil {
+		return err
+	}
+	for {
+		err := buildIndex(def)
+		if err != errIndexConflict {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("ERR could not create index: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Writes the definition and an entry for every key already there, in one txn
+func buildIndex(def *indexDef) error {
+	activeTransactions.Lock()
+	txID := clock.Now()
+	activeTransactions.ActiveTransactions[txID] = true
+	activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.Unlock()
+	transaction := NewTransaction(txID)
+	defer removeTxnData(txID, activeTransactions)
+
+	abort := func(err error) error {
+		writeAbortToLog(txID)
+		transaction.Abort()
+		countAbort(err)
+		return fmt.Errorf("ERR could not create index: %v", err)
+	}
+
+	b, err := json.Marshal(def)
+	if err != nil {
+		return abort(err)
+	}
+	if err := setIndexKey(&transaction, indexPrefix+def.Name, string(b), activeTxdSnapshot); err != nil {
+		return abort(err)
+	}
+	for _, key := range tree.KeysWithPrefix(def.Prefix) {
+		if isReservedKey(key) {
+			continue
+		}
+		value, err := tree.Get(key, txID, activeTxdSnapshot)
+		if err != nil {
+			continue
+		}
+		indexed, ok := def.valueOf(value)
+		if !ok {
+			continue
+		}
+		entryKey := indexEntryPrefix(def.Name, indexed) + key
+		if _, err := tree.Get(entryKey, txID, activeTxdSnapshot); err == nil {
+			// Already indexed by a write since the index was registered
+			continue
+		}
+		if err := setIndexKey(&transaction, entryKey, "1", activeTxdSnapshot); err != nil {
+			if abortReason(err) == "error" {
+				return abort(err)
+			}
+			abort(err)
+			return errIndexConflict
+		}
+	}
+
+	if err := writeCommitToLog(txID); err != nil {
+		return abort(err)
+	}
+	indexes.Lock()
+	indexes.defs[def.Name] = def
+	indexes.Unlock()
+	return nil
+}
+
+// Waits until every txn active now has committed or aborted
+func waitForActiveTxns(timeout time.Duration) error {
+	activeTransactions.RLock()
+	waitingOn := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
+	activeTransactions.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		activeTransactions.RLock()
+		stillActive := false
+		for txID := range waitingOn {
+			if activeTransactions.ActiveTransactions[txID] {
+				stillActive = true
+				break
+			}
+		}
+		activeTransactions.RUnlock()
+		if !stillActive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("ERR timed out waiting for active transactions to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Deletes an index's definition and entries in the txn
+func dropIndex(transaction *Transaction, name string, activeTxdSnapshot map[uint64]bool) error {
+	txID := transaction.timestamp
+	if _, err := tree.Get(indexPrefix+name, txID, activeTxdSnapshot); err != nil {
+		return fmt.Errorf("ERR no such index %s", name)
+	}
+	if err := deleteIndexKey(transaction, indexPrefix+name, activeTxdSnapshot); err != nil {
+		return err
+	}
+	entries := indexPrefix + name + "\x00"
+	for _, key := range tree.KeysWithPrefix(entries) {
+		if _, err := tree.Get(key, txID, activeTxdSnapshot); err != nil {
+			continue
+		}
+		if err := deleteIndexKey(transaction, key, activeTxdSnapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the keys whose value has indexed at the index's path, as seen by the txn.
+// Entries are only a hint, every key is checked against its value before it's returned.
+func findIndexed(name string, indexed string, txID uint64, asOf uint64, activeTxdSnapshot map[uint64]bool) ([]string, error) {
+	stored, err := visibleValue(indexPrefix+name, txID, asOf, activeTxdSnapshot)
+	if err != nil {
+		return nil, fmt.Errorf("ERR no such index %s", name)
+	}
+	var def indexDef
+	if err := json.Unmarshal([]byte(stored), &def); err != nil {
+		return nil, fmt.Errorf("ERR index %s has a bad definition", name)
+	}
+	parsed, err := parseIndexDef(def.Name, def.Prefix, def.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := indexEntryPrefix(name, indexed)
+	keys := make([]string, 0)
+	for _, entryKey := range tree.KeysWithPrefix(entries) {
+		if _, err := visibleValue(entryKey, txID, asOf, activeTxdSnapshot); err != nil {
+			continue
+		}
+		key := entryKey[len(entries):]
+		value, err := visibleValue(key, txID, asOf, activeTxdSnapshot)
+		if err != nil {
+			continue
+		}
+		if current, ok := parsed.valueOf(value); ok && current == indexed {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Names of the indexes visible to the txn, with their definitions
+func listIndexes(txID uint64, asOf uint64, activeTxdSnapshot map[uint64]bool) []indexDef {
+	defs := make([]indexDef, 0)
+	for _, key := range tree.KeysWithPrefix(indexPrefix) {
+		if !isIndexDefKey(key) {
+			continue
+		}
+		stored, err := visibleValue(key, txID, asOf, activeTxdSnapshot)
+		if err != nil {
+			continue
+		}
+		var def indexDef
+		if err := json.Unmarshal([]byte(stored), &def); err == nil {
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+var startTime = time.Now()
+
+// What the last replayLog did at startup
+type replayStats struct {
+	offset     int64
+	operations int
+	txns       int // Txns applied to the tree
+	lastTxID   uint64
+	duration   time.Duration
+}
+
+var lastReplay replayStats
+
+// Sections of INFO, in the order they're reported
+var infoSections = []struct {
+	name string
+	info func() string
+}{
+	{"server", serverSectionInfo},
+	{"clients", clientsInfo},
+	{"memory", memoryInfo},
+	{"persistence", persistenceInfo},
+	{"transactions", transactionsInfo},
+	{"replication", replicationInfo},
+	{"raft", func() string {
+		if raftNode == nil {
+			return ""
+		}
+		return raftInfo()
+	}},
+	{"keyspace", keyspaceInfo},
+}
+
+// INFO in Redis' text format. Sections are separated by a blank line, and default, all
+// or everything report every section.
+func serverInfo(section string) string {
+	sections := make([]string, 0)
+	for _, infoSection := range infoSections {
+		if section == "default" || section == "all" || section == "everything" || section == infoSection.name {
+			if info := infoSection.info(); info != "" {
+				sections = append(sections, info)
+			}
+		}
+	}
+	return strings.Join(sections, "\r\n")
+}
+
+func serverSectionInfo() string {
+	uptime := time.Since(startTime)
+	var sb strings.Builder
+	sb.WriteString("# Server\r\n")
+	sb.WriteString(fmt.Sprintf("os:%s %s\r\n", runtime.GOOS, runtime.GOARCH))
+	sb.WriteString(fmt.Sprintf("go_version:%s\r\n", runtime.Version()))
+	sb.WriteString(fmt.Sprintf("process_id:%d\r\n", os.Getpid()))
+	sb.WriteString(fmt.Sprintf("tcp_port:%d\r\n", *port))
+	sb.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", int64(uptime.Seconds())))
+	sb.WriteString(fmt.Sprintf("uptime_in_days:%d\r\n", int64(uptime.Hours()/24)))
+	sb.WriteString(fmt.Sprintf("engine:%s\r\n", *engineName))
+	sb.WriteString(fmt.Sprintf("data_dir:%s\r\n", *dataDir))
+	return sb.String()
+}
+
+func clientsInfo() string {
+	connectedClients.Lock()
+	connected := connectedClients.count
+	connectedClients.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("# Clients\r\n")
+	sb.WriteString(fmt.Sprintf("connected_clients:%d\r\n", connected))
+	sb.WriteString(fmt.Sprintf("maxclients:%d\r\n", settings.Int("maxclients")))
+	return sb.String()
+}
+
+func memoryInfo() string {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	var sb strings.Builder
+	sb.WriteString("# Memory\r\n")
+	sb.WriteString(fmt.Sprintf("used_memory:%d\r\n", stats.HeapAlloc))
+	sb.WriteString(fmt.Sprintf("used_memory_human:%s\r\n", humanBytes(stats.HeapAlloc)))
+	sb.WriteString(fmt.Sprintf("used_memory_sys:%d\r\n", stats.Sys))
+	sb.WriteString(fmt.Sprintf("used_memory_sys_human:%s\r\n", humanBytes(stats.Sys)))
+	sb.WriteString(fmt.Sprintf("heap_objects:%d\r\n", stats.HeapObjects))
+	sb.WriteString(fmt.Sprintf("gc_cycles:%d\r\n", stats.NumGC))
+	if diskEngine != nil {
+		sb.WriteString(fmt.Sprintf("memtable_keys:%d\r\n", diskEngine.MemtableSize()))
+	}
+	return sb.String()
+}
+
+func persistenceInfo() string {
+	var sb strings.Builder
+	sb.WriteString("# Persistence\r\n")
+	sb.WriteString(fmt.Sprintf("wal_path:%s\r\n", walPath))
+	sb.WriteString(fmt.Sprintf("wal_size:%d\r\n", logSize()))
+	sb.WriteString(fmt.Sprintf("wal_sync:%s\r\n", settings.String("wal-sync")))
+	sb.WriteString(fmt.Sprintf("wal_key_id:%d\r\n", walKeyID()))
+	sb.WriteString(fmt.Sprintf("replay_offset:%d\r\n", lastReplay.offset))
+	sb.WriteString(fmt.Sprintf("replay_operations:%d\r\n", lastReplay.operations))
+	sb.WriteString(fmt.Sprintf("replay_txns:%d\r\n", lastReplay.txns))
+	sb.WriteString(fmt.Sprintf("replay_last_txid:%d\r\n", lastReplay.lastTxID))
+	sb.WriteString(fmt.Sprintf("replay_duration_ms:%d\r\n", lastReplay.duration.Milliseconds()))
+	return sb.String()
+}
+
+func transactionsInfo() string {
+	activeTransactions.RLock()
+	active := len(activeTransactions.ActiveTransactions)
+	activeTransactions.RUnlock()
+	transactionManager.RLock()
+	clients := len(transactionManager.Transactions)
+	transactionManager.RUnlock()
+	transactionMap.RLock()
+	open := len(transactionMap.Transactions)
+	transactionMap.RUnlock()
+	preparedTxns.Lock()
+	prepared := len(preparedTxns.txns)
+	preparedTxns.Unlock()
+
+	var sb strings.Builder
+	sb.WriteString("# Transactions\r\n")
+	sb.WriteString(fmt.Sprintf("current_txid:%d\r\n", clock.Last()))
+	sb.WriteString(fmt.Sprintf("active_txns:%d\r\n", active))
+	sb.WriteString(fmt.Sprintf("client_txns:%d\r\n", clients))
+	sb.WriteString(fmt.Sprintf("open_txn_objects:%d\r\n", open))
+	sb.WriteString(fmt.Sprintf("prepared_txns:%d\r\n", prepared))
+	sb.WriteString(fmt.Sprintf("txn_commits:%d\r\n", int64(txnCommits.Value())))
+	return sb.String()
+}
+
+func keyspaceInfo() string {
+	keys, versions := countTree()
+	var sb strings.Builder
+	sb.WriteString("# Keyspace\r\n")
+	if keys > 0 {
+		sb.WriteString(fmt.Sprintf("db0:keys=%d,expires=0,versions=%d\r\n", keys, versions))
+	}
+	return sb.String()
+}
+
+func humanBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T"}
+	value := float64(n)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", value, units[unit])
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"OttoDB/server/jsonpath"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var errJSONPathMissing = errors.New("path does not exist")
+
+// What JSON.SET and JSON.DEL log instead of the whole new value. Replaying it against
+// the version it replaced gives the same value back.
+type jsonPatch struct {
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Decodes a JSON value, keeping numbers as they were written
+func decodeJSON(value string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	return doc, nil
+}
+
+func encodeJSON(doc interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// Applies a json.set or json.del patch to the value it was made against, which is nil
+// when the key had no value. Only the root can be set on a key without a value.
+func applyJSONPatch(op string, base *string, patch jsonPatch) (string, error) {
+	path, err := jsonpath.Parse(patch.Path)
+	if err != nil {
+		return "", err
+	}
+
+	var doc interface{}
+	if base != nil {
+		if doc, err = decodeJSON(*base); err != nil {
+			return "", errors.New("existing value is not JSON")
+		}
+	} else if op == "json.del" || len(path) > 0 {
+		return "", errors.New("new values can only be set at the root, $")
+	}
+
+	switch op {
+	case "json.set":
+		value, err := decodeJSON(string(patch.Value))
+		if err != nil {
+			return "", errors.New("value is not valid JSON")
+		}
+		if doc, err = path.Set(doc, value); err != nil {
+			return "", err
+		}
+	case "json.del":
+		var deleted bool
+		if doc, deleted = path.Delete(doc); !deleted {
+			return "", errJSONPathMissing
+		}
+	default:
+		return "", fmt.Errorf("unknown JSON operation %s", op)
+	}
+	return encodeJSON(doc)
+}
+
+// CDC and keyspace events carry values rather than the patches JSON.SET and JSON.DEL
+// log. Turns a committed txn's patches into sets of the values they resulted in, applying
+// them to the value before the txn just as replaying them does.
+func resolveJSONPatches(txID uint64, operations []Operation) []Operation {
+	resolved := make([]Operation, 0, len(operations))
+	written := make(map[string]*string) // Values written so far in the txn, nil once deleted
+	for _, operation := range operations {
+		switch operation.Op {
+		case "set":
+			value := operation.Value
+			written[operation.Key] = &value
+		case "del":
+			written[operation.Key] = nil
+		case "json.set", "json.del":
+			base, ok := written[operation.Key]
+			if !ok {
+				// Writers of the same key conflict, so the last version before the txn is
+				// the one it patched
+				if value, err := tree.GetAsOf(operation.Key, txID-1, map[uint64]bool{}); err == nil {
+					base = &value
+				}
+			}
+			var patch jsonPatch
+			if err := json.Unmarshal([]byte(operation.Value), &patch); err != nil {
+				logger.Warn("could not decode JSON patch", "txid", txID, "key", operation.Key, "err", err)
+				break
+			}
+			value, err := applyJSONPatch(operation.Op, base, patch)
+			if err != nil {
+				logger.Warn("could not apply JSON patch", "txid", txID, "key", operation.Key, "err", err)
+				break
+			}
+			written[operation.Key] = &value
+			operation = Operation{TxID: operation.TxID, Op: "set", Key: operation.Key, Value: value}
+		}
+		resolved = append(resolved, operation)
+	}
+	return resolved
+}
+
+// Returns the JSON at path in value
+func jsonAt(value string, path string) (string, error) {
+	parsed, err := jsonpath.Parse(path)
+	if err != nil {
+		return "", err
+	}
+	doc, err := decodeJSON(value)
+	if err != nil {
+		return "", errors.New("existing value is not JSON")
+	}
+	found, ok := parsed.Get(doc)
+	if !ok {
+		return "", errJSONPathMissing
+	}
+	return encodeJSON(found)
+}
+
+// Writes the new version of key made by a JSON command, or deletes key if value is
+// empty, and logs operation for it
+func writeJSONValue(transaction *Transaction, key string, value string, operation *Operation, activeTxdSnapshot map[uint64]bool) error {
+	txID := transaction.timestamp
+	expiredRecord, err := tree.Expire(key, txID, activeTxdSnapshot)
+	if err != nil {
+		return err
+	}
+	if expiredRecord != nil {
+		transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+	}
+	transaction.keys = append(transaction.keys, key)
+	if value != "" {
+		insertedRecord, err := tree.Set(key, value, txID, activeTxdSnapshot)
+		if err != nil {
+			return err
+		}
+		transaction.insertedRecords = append(transaction.insertedRecords, insertedRecord)
+	}
+
+	if err := writeToLog(operation, txID); err != nil {
+		return err
+	}
+	return updateIndexes(transaction, key, expiredValue(expiredRecord), value, activeTxdSnapshot)
+}
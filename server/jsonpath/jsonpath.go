@@ -0,0 +1,170 @@
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// One step into a document, either an object member or an array element
+type step struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// A parsed path such as $.user.emails[0] or $['first name']. An empty path is the
+// whole document.
+type Path []step
+
+// Parses a path in the dot and bracket notation of JSONPath. Wildcards, slices and
+// filters aren't supported, so a path always picks at most one value.
+func Parse(expr string) (Path, error) {
+	if !strings.HasPrefix(expr, "$") {
+		return nil, fmt.Errorf("path %q must start with $", expr)
+	}
+	path := make(Path, 0)
+	rest := expr[1:]
+	for len(rest) > 0 {
+		switch rest[0] {
+		case '.':
+			end := 1
+			for end < len(rest) && rest[end] != '.' && rest[end] != '[' {
+				end++
+			}
+			if end == 1 {
+				return nil, fmt.Errorf("empty member name in path %q", expr)
+			}
+			path = append(path, step{key: rest[1:end]})
+			rest = rest[end:]
+
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in path %q", expr)
+			}
+			inner := rest[1:end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, step{key: inner[1 : len(inner)-1]})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid index %q in path %q", inner, expr)
+				}
+				path = append(path, step{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("unexpected %q in path %q", rest[0], expr)
+		}
+	}
+	return path, nil
+}
+
+// Returns the value at path in a document decoded by encoding/json
+func (path Path) Get(doc interface{}) (interface{}, bool) {
+	current := doc
+	for _, next := range path {
+		var ok bool
+		if current, ok = next.get(current); !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func (next step) get(current interface{}) (interface{}, bool) {
+	if next.isIndex {
+		array, ok := current.([]interface{})
+		if !ok || next.index >= len(array) {
+			return nil, false
+		}
+		return array[next.index], true
+	}
+	object, ok := current.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	value, ok := object[next.key]
+	return value, ok
+}
+
+func (path Path) String() string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	for _, next := range path {
+		if next.isIndex {
+			sb.WriteString("[" + strconv.Itoa(next.index) + "]")
+		} else if strings.ContainsAny(next.key, ".[]'") {
+			sb.WriteString("[\"" + next.key + "\"]")
+		} else {
+			sb.WriteString("." + next.key)
+		}
+	}
+	return sb.String()
+}
+
+// Returns doc with the value at path replaced by value. A missing object member is
+// added, but the object or array holding it has to exist. doc is changed in place.
+func (path Path) Set(doc interface{}, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	parent, ok := path[:len(path)-1].Get(doc)
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", path[:len(path)-1])
+	}
+
+	last := path[len(path)-1]
+	if last.isIndex {
+		array, ok := parent.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not an array", path[:len(path)-1])
+		}
+		if last.index >= len(array) {
+			return nil, fmt.Errorf("index %d is out of range", last.index)
+		}
+		array[last.index] = value
+		return doc, nil
+	}
+	object, ok := parent.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s is not an object", path[:len(path)-1])
+	}
+	object[last.key] = value
+	return doc, nil
+}
+
+// Returns doc without the value at path, and whether there was one. Deleting the whole
+// document isn't possible this way. doc is changed in place.
+func (path Path) Delete(doc interface{}) (interface{}, bool) {
+	if len(path) == 0 {
+		return doc, false
+	}
+	parent, ok := path[:len(path)-1].Get(doc)
+	if !ok {
+		return doc, false
+	}
+
+	last := path[len(path)-1]
+	if last.isIndex {
+		array, ok := parent.([]interface{})
+		if !ok || last.index >= len(array) {
+			return doc, false
+		}
+		shortened := append(array[:last.index:last.index], array[last.index+1:]...)
+		// The array is held by its parent, so it has to be swapped there
+		updated, err := path[:len(path)-1].Set(doc, shortened)
+		return updated, err == nil
+	}
+	object, ok := parent.(map[string]interface{})
+	if !ok {
+		return doc, false
+	}
+	if _, ok := object[last.key]; !ok {
+		return doc, false
+	}
+	delete(object, last.key)
+	return doc, true
+}
@@ -0,0 +1,88 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestGet(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"user": {"email": "a@b.c", "tags": ["x", "y"], "first name": "Ann"}}`), &doc)
+
+	cases := map[string]interface{}{
+		"$.user.email":            "a@b.c",
+		"$.user.tags[1]":          "y",
+		"$['user']['first name']": "Ann",
+		`$.user["email"]`:         "a@b.c",
+	}
+	for expr, expected := range cases {
+		path, err := Parse(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := path.Get(doc); !ok || value != expected {
+			t.Errorf("expected %s to be %v, got %v", expr, expected, value)
+		}
+	}
+
+	for _, expr := range []string{"$.missing", "$.user.tags[2]", "$.user.email.domain"} {
+		path, _ := Parse(expr)
+		if value, ok := path.Get(doc); ok {
+			t.Errorf("expected nothing at %s, got %v", expr, value)
+		}
+	}
+}
+
+func TestParseRejectsBadPaths(t *testing.T) {
+	for _, expr := range []string{"user.email", "$.", "$[-1]", "$[abc]", "$[0", "$x"} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestSetAndDelete(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"a": {"b": 1}, "list": [1, 2, 3]}`), &doc)
+
+	set := func(expr string, value interface{}) error {
+		path, _ := Parse(expr)
+		updated, err := path.Set(doc, value)
+		if err == nil {
+			doc = updated
+		}
+		return err
+	}
+	del := func(expr string) bool {
+		path, _ := Parse(expr)
+		updated, ok := path.Delete(doc)
+		doc = updated
+		return ok
+	}
+
+	if err := set("$.a.c", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("$.list[1]", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if err := set("$.missing.c", 1); err == nil {
+		t.Errorf("expected setting under a missing member to fail")
+	}
+	if err := set("$.list[5]", 1); err == nil {
+		t.Errorf("expected setting past the end of an array to fail")
+	}
+	if !del("$.a.b") || !del("$.list[0]") || del("$.a.missing") {
+		t.Errorf("expected only existing values to be deleted")
+	}
+
+	b, _ := json.Marshal(doc)
+	if expected := `{"a":{"c":"new"},"list":["two",3]}`; string(b) != expected {
+		t.Errorf("expected %s, got %s", expected, b)
+	}
+
+	// Setting the root replaces the document
+	if err := set("$", "replaced"); err != nil || doc != "replaced" {
+		t.Errorf("expected the document to be replaced, got %v", doc)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// Returns the keys matching pattern that have a value visible to the txn, in order
+func visibleKeys(pattern string, txID uint64, asOf uint64, activeTxdSnapshot map[uint64]bool) []string {
+	keys := make([]string, 0)
+	for _, key := range tree.Keys() {
+		if isReservedKey(key) || !matchPattern(pattern, key) {
+			continue
+		}
+		if _, err := visibleValue(key, txID, asOf, activeTxdSnapshot); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Reads key as the txn sees it, as of asOf when it's non-zero
+func visibleValue(key string, txID uint64, asOf uint64, activeTxdSnapshot map[uint64]bool) (string, error) {
+	if asOf != 0 {
+		return tree.GetAsOf(key, asOf, activeTxdSnapshot)
+	}
+	return tree.Get(key, txID, activeTxdSnapshot)
+}
+
+// Matches a key against a Redis style glob: * matches anything, ? any one byte, [abc],
+// [^abc] and [a-z] match sets of bytes, and \ escapes the next byte
+func matchPattern(pattern string, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchPattern(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(key) == 0 {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+
+		case '[':
+			if len(key) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			negate := len(pattern) > 0 && pattern[0] == '^'
+			if negate {
+				pattern = pattern[1:]
+			}
+			matched := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				if pattern[0] == '\\' && len(pattern) > 1 {
+					pattern = pattern[1:]
+				}
+				if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+					low, high := pattern[0], pattern[2]
+					if low > high {
+						low, high = high, low
+					}
+					if key[0] >= low && key[0] <= high {
+						matched = true
+					}
+					pattern = pattern[3:]
+				} else {
+					if pattern[0] == key[0] {
+						matched = true
+					}
+					pattern = pattern[1:]
+				}
+			}
+			if len(pattern) > 0 {
+				// Skip the closing ]
+				pattern = pattern[1:]
+			}
+			if matched == negate {
+				return false
+			}
+			key = key[1:]
+
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+			key = key[1:]
+			pattern = pattern[1:]
+		}
+	}
+	return len(key) == 0
+}
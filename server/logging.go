@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// Messages at or above the loglevel setting are logged as text to stderr. Messages
+// about a request or txn carry its client or txid.
+var (
+	logLevel = new(slog.LevelVar)
+	logger   = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel}))
+)
+
+// Checks and applies the loglevel setting, so debug tracing can be turned on and off
+// while running
+func setLogLevel(value string) error {
+	if err := oneOf("debug", "info", "warn", "error")(value); err != nil {
+		return err
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func fatal(msg string, err error) {
+	logger.Error(msg, "err", err)
+	os.Exit(1)
+}
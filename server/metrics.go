@@ -0,0 +1,127 @@
+package main
+
+import (
+	"OttoDB/server/metrics"
+	"OttoDB/server/store/binTree"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	metricsAddr = flag.String("metrics-addr", "", "Address to serve Prometheus metrics from at /metrics, disabled when empty")
+
+	registry        = metrics.NewRegistry()
+	commandsTotal   = registry.Counter("ottodb_commands_total", "Commands run, by command", "command")
+	commandDuration = registry.Histogram("ottodb_command_duration_seconds", "Time taken to run a command, by command", metrics.DefaultBuckets, "command")
+	txnCommits      = registry.Counter("ottodb_txn_commits_total", "Txns committed")
+	txnAborts       = registry.Counter("ottodb_txn_aborts_total", "Txns aborted, by reason", "reason")
+	walBytes        = registry.Counter("ottodb_wal_bytes_written_total", "Bytes appended to the log")
+	walSyncDuration = registry.Histogram("ottodb_wal_fsync_duration_seconds", "Time taken to sync the log to disk", metrics.DefaultBuckets)
+
+	// Counting keys walks the whole tree, so a count is reused for a second
+	treeStats = struct {
+		sync.Mutex
+		read     time.Time
+		keys     int
+		versions int
+	}{}
+)
+
+// Commands counted under their own name, anything else is counted as unknown
+var metricCommands = map[string]bool{
+	"ping": true, "quit": true, "set": true, "get": true, "getv": true, "cas": true, "del": true,
+	"json.set": true, "json.get": true, "json.del": true, "begin": true, "commit": true,
+	"prepare": true, "rollback": true, "prepared": true, "keys": true, "create": true,
+	"drop": true, "find": true, "backup": true, "print": true, "history": true,
+	"txnprint": true, "abort": true, "cdc": true, "publish": true, "subscribe": true,
+	"psubscribe": true, "replicaof": true, "replsync": true, "info": true, "raft": true,
+	"auth": true, "acl": true, "slowlog": true, "txn": true, "client": true, "config": true, "cluster": true, "asking": true, "migrate": true, "restoreversions": true,
+	"printw": true,
+}
+
+func commandLabel(command string) string {
+	if metricCommands[command] {
+		return command
+	}
+	return "unknown"
+}
+
+func countCommand(command string, start time.Time) {
+	commandsTotal.Inc(command)
+	commandDuration.Observe(time.Since(start).Seconds(), command)
+}
+
+func countAbort(err error) {
+	txnAborts.Inc(abortReason(err))
+}
+
+// Write conflicts are told apart by the error isConcurrentEdited returned
+func abortReason(err error) string {
+	switch {
+	case errors.Is(err, binTree.ErrLaterWrite):
+		return "later_write"
+	case errors.Is(err, binTree.ErrActiveWrite):
+		return "active_write"
+	case errors.Is(err, binTree.ErrLaterDelete):
+		return "later_delete"
+	case errors.Is(err, binTree.ErrActiveDelete):
+		return "active_delete"
+	case errors.Is(err, binTree.ErrVersionMismatch):
+		return "version_mismatch"
+	default:
+		return "error"
+	}
+}
+
+// Serves /metrics from -metrics-addr, if it's set
+func startMetrics() error {
+	if *metricsAddr == "" {
+		return nil
+	}
+
+	registry.Gauge("ottodb_active_txns", "Txns in progress", func() float64 {
+		activeTransactions.RLock()
+		defer activeTransactions.RUnlock()
+		return float64(len(activeTransactions.ActiveTransactions))
+	})
+	registry.Gauge("ottodb_connected_clients", "Clients connected", func() float64 {
+		connectedClients.Lock()
+		defer connectedClients.Unlock()
+		return float64(connectedClients.count)
+	})
+	registry.Gauge("ottodb_tree_keys", "Keys in the tree", func() float64 {
+		keys, _ := countTree()
+		return float64(keys)
+	})
+	registry.Gauge("ottodb_tree_versions", "Versions of every key in the tree", func() float64 {
+		_, versions := countTree()
+		return float64(versions)
+	})
+
+	listener, err := net.Listen("tcp", *metricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", registry)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			logger.Error("stopped serving metrics", "err", err)
+		}
+	}()
+	return nil
+}
+
+func countTree() (int, int) {
+	treeStats.Lock()
+	defer treeStats.Unlock()
+	if time.Since(treeStats.read) > time.Second {
+		treeStats.keys, treeStats.versions = tree.Stats()
+		treeStats.read = time.Now()
+	}
+	return treeStats.keys, treeStats.versions
+}
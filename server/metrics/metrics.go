@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics served in the Prometheus text format. Counters and histograms are split by
+// the values of their labels, gauges are read when the metrics are served.
+type Registry struct {
+	sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{metrics: make([]metric, 0)}
+}
+
+// Latency buckets in seconds, from 50µs to 10s
+var DefaultBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func (registry *Registry) Counter(name string, help string, labels ...string) *CounterVec {
+	counter := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	registry.add(counter)
+	return counter
+}
+
+// Adds one to the counter with these label values
+func (counter *CounterVec) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *CounterVec) Add(n float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	counter.Lock()
+	defer counter.Unlock()
+	value, ok := counter.values[key]
+	if !ok {
+		value = &counterValue{labels: labelValues}
+		counter.values[key] = value
+	}
+	value.value += n
+}
+
+// Value of the counter with these label values, for tests
+func (counter *CounterVec) Value(labelValues ...string) float64 {
+	counter.Lock()
+	defer counter.Unlock()
+	if value, ok := counter.values[strings.Join(labelValues, "\x00")]; ok {
+		return value.value
+	}
+	return 0
+}
+
+func (counter *CounterVec) write(w io.Writer) {
+	counter.Lock()
+	defer counter.Unlock()
+	writeHeader(w, counter.name, counter.help, "counter")
+	if len(counter.labels) == 0 && len(counter.values) == 0 {
+		fmt.Fprintf(w, "%s 0\n", counter.name)
+		return
+	}
+	keys := make([]string, 0, len(counter.values))
+	for key := range counter.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := counter.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", counter.name, formatLabels(counter.labels, value.labels, "", ""), formatFloat(value.value))
+	}
+}
+
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (registry *Registry) Histogram(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	histogram := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	registry.add(histogram)
+	return histogram
+}
+
+func (histogram *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+	bucket := sort.SearchFloat64s(histogram.buckets, value)
+	histogram.Lock()
+	defer histogram.Unlock()
+	observed, ok := histogram.values[key]
+	if !ok {
+		observed = &histogramValue{labels: labelValues, counts: make([]uint64, len(histogram.buckets))}
+		histogram.values[key] = observed
+	}
+	if bucket < len(histogram.buckets) {
+		observed.counts[bucket]++
+	}
+	observed.count++
+	observed.sum += value
+}
+
+func (histogram *HistogramVec) write(w io.Writer) {
+	histogram.Lock()
+	defer histogram.Unlock()
+	writeHeader(w, histogram.name, histogram.help, "histogram")
+	keys := make([]string, 0, len(histogram.values))
+	for key := range histogram.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		observed := histogram.values[key]
+		var cumulative uint64
+		for i, bound := range histogram.buckets {
+			cumulative += observed.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labels, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labels, "le", "+Inf"), observed.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", histogram.name, formatLabels(histogram.labels, observed.labels, "", ""), formatFloat(observed.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", histogram.name, formatLabels(histogram.labels, observed.labels, "", ""), observed.count)
+	}
+}
+
+type gauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// Adds a gauge whose value is read from value every time the metrics are served
+func (registry *Registry) Gauge(name string, help string, value func() float64) {
+	registry.add(&gauge{name: name, help: help, value: value})
+}
+
+func (g *gauge) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+func (registry *Registry) add(m metric) {
+	registry.Lock()
+	defer registry.Unlock()
+	registry.metrics = append(registry.metrics, m)
+}
+
+func (registry *Registry) Export(w io.Writer) {
+	registry.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.Unlock()
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func (registry *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	registry.Export(w)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+// Formats label pairs, with an extra pair at the end when extraName isn't empty
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		pairs = append(pairs, name+"="+quote(value))
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+quote(extraValue))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	commands := registry.Counter("test_commands_total", "Commands run", "command")
+	latency := registry.Histogram("test_latency_seconds", "Command latency", []float64{0.1, 1}, "command")
+	registry.Gauge("test_clients", "Connected clients", func() float64 { return 3 })
+
+	commands.Inc("set")
+	commands.Inc("set")
+	commands.Add(5, `g"et`)
+	latency.Observe(0.05, "set")
+	latency.Observe(0.5, "set")
+	latency.Observe(2, "set")
+
+	var out bytes.Buffer
+	registry.Export(&out)
+	expected := []string{
+		"# TYPE test_commands_total counter",
+		`test_commands_total{command="g\"et"} 5`,
+		`test_commands_total{command="set"} 2`,
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{command="set",le="0.1"} 1`,
+		`test_latency_seconds_bucket{command="set",le="1"} 2`,
+		`test_latency_seconds_bucket{command="set",le="+Inf"} 3`,
+		`test_latency_seconds_sum{command="set"} 2.55`,
+		`test_latency_seconds_count{command="set"} 3`,
+		"# TYPE test_clients gauge",
+		"test_clients 3",
+	}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, out.String())
+		}
+	}
+	if commands.Value("set") != 2 {
+		t.Errorf("expected 2 sets, got %v", commands.Value("set"))
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Txns prepared for a two-phase commit, by the global txn ID their coordinator gave them.
+// A prepared txn stays active until it's committed or rolled back, so its writes stay
+// hidden and conflicting writers are turned away, even across restarts.
+var preparedTxns = struct {
+	sync.Mutex
+	txns map[string]uint64
+}{txns: make(map[string]uint64)}
+
+var errUnknownPrepared = errors.New("ERR no prepared transaction with that identifier")
+
+// Logs txID as prepared under gid. The record is synced whatever -wal-sync says, so once
+// this returns the txn can be committed no matter what happens to this node. When only
+// the sync fails the txn stays prepared, so the coordinator can still roll it back.
+func prepareTxn(gid string, txID uint64) error {
+	preparedTxns.Lock()
+	defer preparedTxns.Unlock()
+
+	if _, exists := preparedTxns.txns[gid]; exists {
+		return fmt.Errorf("ERR transaction identifier %s is already in use", gid)
+	}
+	if err := writeToLog(&Operation{TxID: txID, Op: "prepare", Key: gid}, txID); err != nil {
+		return err
+	}
+	preparedTxns.txns[gid] = txID
+	return forceSyncLog()
+}
+
+func commitPrepared(gid string) error {
+	preparedTxns.Lock()
+	defer preparedTxns.Unlock()
+
+	txID, exists := preparedTxns.txns[gid]
+	if !exists {
+		return errUnknownPrepared
+	}
+	if err := writeCommitToLog(txID); err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	delete(preparedTxns.txns, gid)
+
+	removeTxnData(txID, activeTransactions)
+	transactionMap.Lock()
+	delete(transactionMap.Transactions, txID)
+	transactionMap.Unlock()
+	return forceSyncLog()
+}
+
+func rollbackPrepared(gid string) error {
+	preparedTxns.Lock()
+	defer preparedTxns.Unlock()
+
+	txID, exists := preparedTxns.txns[gid]
+	if !exists {
+		return errUnknownPrepared
+	}
+	if err := writeAbortToLog(txID); err != nil {
+		return fmt.Errorf("ERR %v", err)
+	}
+	delete(preparedTxns.txns, gid)
+
+	transactionMap.Lock()
+	transaction := transactionMap.Transactions[txID]
+	delete(transactionMap.Transactions, txID)
+	transactionMap.Unlock()
+	transaction.Abort()
+	txnAborts.Inc("client")
+	removeTxnData(txID, activeTransactions)
+	return forceSyncLog()
+}
+
+// Puts a prepared txn found while replaying the log back in the prepared state
+func restorePreparedTxn(gid string, transaction Transaction) {
+	preparedTxns.Lock()
+	preparedTxns.txns[gid] = transaction.timestamp
+	preparedTxns.Unlock()
+
+	activeTransactions.Lock()
+	activeTransactions.ActiveTransactions[transaction.timestamp] = true
+	activeTransactions.Unlock()
+
+	transactionMap.Lock()
+	transactionMap.Transactions[transaction.timestamp] = transaction
+	transactionMap.Unlock()
+}
+
+// Global txn IDs of the prepared txns, in order
+func listPrepared() ([]string, map[string]uint64) {
+	preparedTxns.Lock()
+	defer preparedTxns.Unlock()
+
+	gids := make([]string, 0, len(preparedTxns.txns))
+	txIDs := make(map[string]uint64, len(preparedTxns.txns))
+	for gid, txID := range preparedTxns.txns {
+		gids = append(gids, gid)
+		txIDs[gid] = txID
+	}
+	sort.Strings(gids)
+	return gids, txIDs
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/tidwall/redcon"
+)
+
+var pubsub redcon.PubSub
+
+const (
+	keyspaceChannel = "__keyspace@0__:"
+	keyeventChannel = "__keyevent@0__:"
+)
+
+// Publishes keyspace notifications for every committed write, following the same
+// channel naming as Redis:
+//
+//	__keyspace@0__:<key> receives the operation (set / del)
+//	__keyevent@0__:<operation> receives the key
+func publishKeyspaceEvents() {
+	for {
+		follower := tailLog()
+		tracker := newCommitTracker()
+		for entry := range follower {
+			committedOps, isCommit := tracker.track(entry.operation)
+			if !isCommit {
+				continue
+			}
+			for _, committedOp := range resolveJSONPatches(entry.operation.TxID, committedOps) {
+				if isReservedKey(committedOp.Key) {
+					continue
+				}
+				pubsub.Publish(keyspaceChannel+committedOp.Key, committedOp.Op)
+				pubsub.Publish(keyeventChannel+committedOp.Op, committedOp.Key)
+			}
+		}
+		// Publishing fell behind the log. Transactions that were in flight lose their events.
+		logger.Warn("keyspace notifications fell behind the log, resubscribing")
+	}
+}
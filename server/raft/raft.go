@@ -0,0 +1,847 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader               = errors.New("raft: not the leader")
+	ErrStopped                 = errors.New("raft: node is stopped")
+	ErrTimeout                 = errors.New("raft: timed out waiting for the entry to commit")
+	ErrLeadershipLost          = errors.New("raft: leadership lost before the entry committed")
+	ErrMembershipChangePending = errors.New("raft: a membership change is already in progress")
+)
+
+type EntryType int
+
+const (
+	EntryCommand EntryType = iota
+	EntryNoop
+	EntryMembership
+)
+
+type Entry struct {
+	Index uint64
+	Term  uint64
+	Type  EntryType
+	Data  []byte
+}
+
+type Member struct {
+	ID   string
+	Addr string
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case follower:
+		return "follower"
+	case candidate:
+		return "candidate"
+	default:
+		return "leader"
+	}
+}
+
+type Config struct {
+	ID string
+	// Members the cluster starts out with. Only used when the log is empty, a node
+	// joining an existing cluster leaves it empty and learns them from the leader.
+	Members   []Member
+	Storage   Storage
+	Transport Transport
+	// Called once for every committed command entry, in log order
+	Apply             func(entry Entry)
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// How long Propose, ReadIndex and membership changes wait before giving up
+	CommitTimeout time.Duration
+}
+
+type Status struct {
+	ID          string
+	State       string
+	Term        uint64
+	Leader      string
+	CommitIndex uint64
+	LastApplied uint64
+	LastIndex   uint64
+	Members     []Member
+}
+
+// A pending ReadIndex, confirmed once a quorum acknowledged a heartbeat sent after it
+type readRequest struct {
+	index uint64
+	seq   uint64
+	acks  map[string]bool
+}
+
+type Node struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	config Config
+
+	state       role
+	term        uint64
+	votedFor    string
+	leaderID    string
+	commitIndex uint64
+	lastApplied uint64
+	members     map[string]Member
+	// Index of the membership entry members came from
+	membersIndex uint64
+
+	votes      map[string]bool
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	inflight   map[string]bool
+
+	electionDeadline  time.Time
+	heartbeatDue      time.Time
+	lastLeaderContact time.Time
+
+	// Sequence number stamped on every AppendEntries, used to confirm reads
+	sendSeq uint64
+	reads   []*readRequest
+
+	stopped bool
+	stopCh  chan bool
+}
+
+func NewNode(config Config) (*Node, error) {
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 300 * time.Millisecond
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = config.ElectionTimeout / 5
+	}
+	if config.CommitTimeout == 0 {
+		config.CommitTimeout = 5 * time.Second
+	}
+
+	state, err := config.Storage.HardState()
+	if err != nil {
+		return nil, err
+	}
+	node := &Node{
+		config:      config,
+		term:        state.Term,
+		votedFor:    state.VotedFor,
+		commitIndex: state.Applied,
+		lastApplied: state.Applied,
+		votes:       make(map[string]bool),
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		inflight:    make(map[string]bool),
+		stopCh:      make(chan bool),
+	}
+	node.cond = sync.NewCond(&node.mu)
+
+	// A new cluster's members are the first entry of every initial member's log
+	lastIndex, err := config.Storage.LastIndex()
+	if err != nil {
+		return nil, err
+	}
+	if lastIndex == 0 && len(config.Members) > 0 {
+		data, err := encodeMembers(config.Members)
+		if err != nil {
+			return nil, err
+		}
+		if err := config.Storage.Append([]Entry{{Index: 1, Term: 0, Type: EntryMembership, Data: data}}); err != nil {
+			return nil, err
+		}
+	}
+	if err := node.refreshMembersLocked(); err != nil {
+		return nil, err
+	}
+
+	node.resetElectionDeadlineLocked()
+	go node.run()
+	go node.applier()
+	return node, nil
+}
+
+func (node *Node) Stop() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.stopped {
+		return
+	}
+	node.stopped = true
+	close(node.stopCh)
+	node.cond.Broadcast()
+}
+
+func (node *Node) ID() string {
+	return node.config.ID
+}
+
+func (node *Node) IsLeader() bool {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.state == leader
+}
+
+// ID of the leader as far as this node knows, empty if it doesn't know one
+func (node *Node) Leader() string {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	return node.leaderID
+}
+
+func (node *Node) Status() Status {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	lastIndex, _ := node.config.Storage.LastIndex()
+	members := make([]Member, 0, len(node.members))
+	for _, member := range node.members {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return Status{
+		ID:          node.config.ID,
+		State:       node.state.String(),
+		Term:        node.term,
+		Leader:      node.leaderID,
+		CommitIndex: node.commitIndex,
+		LastApplied: node.lastApplied,
+		LastIndex:   lastIndex,
+		Members:     members,
+	}
+}
+
+// Appends data to the log and waits until it has been committed and applied locally.
+func (node *Node) Propose(data []byte) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	index, term, err := node.appendLocked(EntryCommand, data)
+	if err != nil {
+		return err
+	}
+	return node.waitAppliedLocked(index, term)
+}
+
+// Adds a member to the cluster. Only one membership change can be in progress.
+func (node *Node) AddMember(member Member) error {
+	return node.changeMembers(func(members map[string]Member) {
+		members[member.ID] = member
+	})
+}
+
+func (node *Node) RemoveMember(id string) error {
+	return node.changeMembers(func(members map[string]Member) {
+		delete(members, id)
+	})
+}
+
+func (node *Node) changeMembers(change func(members map[string]Member)) error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != leader {
+		return ErrNotLeader
+	}
+	if node.membersIndex > node.commitIndex {
+		return ErrMembershipChangePending
+	}
+
+	members := make(map[string]Member)
+	for id, member := range node.members {
+		members[id] = member
+	}
+	change(members)
+	memberList := make([]Member, 0, len(members))
+	for _, member := range members {
+		memberList = append(memberList, member)
+	}
+	data, err := encodeMembers(memberList)
+	if err != nil {
+		return err
+	}
+
+	index, term, err := node.appendLocked(EntryMembership, data)
+	if err != nil {
+		return err
+	}
+	return node.waitAppliedLocked(index, term)
+}
+
+// Returns once it's safe to serve a linearizable read from the local state machine:
+// this node is confirmed as leader, and everything committed when the read started
+// has been applied.
+func (node *Node) ReadIndex() error {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	if node.state != leader {
+		return ErrNotLeader
+	}
+	deadline := time.Now().Add(node.config.CommitTimeout)
+	timer := time.AfterFunc(node.config.CommitTimeout, node.wake)
+	defer timer.Stop()
+
+	// The commit index is only known to be current once an entry of this term committed
+	term := node.term
+	for node.termAtLocked(node.commitIndex) != term {
+		if err := node.checkWaitLocked(term, deadline); err != nil {
+			return err
+		}
+		node.cond.Wait()
+	}
+
+	node.sendSeq++
+	read := &readRequest{index: node.commitIndex, seq: node.sendSeq, acks: map[string]bool{node.config.ID: true}}
+	node.reads = append(node.reads, read)
+	defer node.removeReadLocked(read)
+	node.broadcastLocked()
+
+	for !node.hasQuorumLocked(read.acks) || node.lastApplied < read.index {
+		if err := node.checkWaitLocked(term, deadline); err != nil {
+			return err
+		}
+		node.cond.Wait()
+	}
+	return nil
+}
+
+func (node *Node) checkWaitLocked(term uint64, deadline time.Time) error {
+	if node.stopped {
+		return ErrStopped
+	}
+	if node.state != leader || node.term != term {
+		return ErrNotLeader
+	}
+	if time.Now().After(deadline) {
+		return ErrTimeout
+	}
+	return nil
+}
+
+func (node *Node) removeReadLocked(read *readRequest) {
+	for i, pending := range node.reads {
+		if pending == read {
+			node.reads = append(node.reads[:i], node.reads[i+1:]...)
+			return
+		}
+	}
+}
+
+func (node *Node) wake() {
+	node.mu.Lock()
+	node.cond.Broadcast()
+	node.mu.Unlock()
+}
+
+func (node *Node) appendLocked(entryType EntryType, data []byte) (uint64, uint64, error) {
+	if node.stopped {
+		return 0, 0, ErrStopped
+	}
+	if node.state != leader {
+		return 0, 0, ErrNotLeader
+	}
+
+	lastIndex, err := node.config.Storage.LastIndex()
+	if err != nil {
+		return 0, 0, err
+	}
+	entry := Entry{Index: lastIndex + 1, Term: node.term, Type: entryType, Data: data}
+	if err := node.config.Storage.Append([]Entry{entry}); err != nil {
+		return 0, 0, err
+	}
+	if entryType == EntryMembership {
+		if err := node.refreshMembersLocked(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	node.matchIndex[node.config.ID] = entry.Index
+	node.advanceCommitLocked()
+	node.broadcastLocked()
+	return entry.Index, entry.Term, nil
+}
+
+// Waits until the entry at index has been applied, and checks it's still the entry
+// that was appended in term
+func (node *Node) waitAppliedLocked(index uint64, term uint64) error {
+	deadline := time.Now().Add(node.config.CommitTimeout)
+	timer := time.AfterFunc(node.config.CommitTimeout, node.wake)
+	defer timer.Stop()
+
+	for node.lastApplied < index {
+		if node.stopped {
+			return ErrStopped
+		}
+		if node.termAtLocked(index) != term {
+			return ErrLeadershipLost
+		}
+		if time.Now().After(deadline) {
+			return ErrTimeout
+		}
+		node.cond.Wait()
+	}
+	if node.termAtLocked(index) != term {
+		return ErrLeadershipLost
+	}
+	return nil
+}
+
+func (node *Node) run() {
+	ticker := time.NewTicker(node.config.HeartbeatInterval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-node.stopCh:
+			return
+		case <-ticker.C:
+			node.tick()
+		}
+	}
+}
+
+func (node *Node) tick() {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	now := time.Now()
+	if node.state == leader {
+		if now.After(node.heartbeatDue) {
+			node.broadcastLocked()
+		}
+	} else if now.After(node.electionDeadline) {
+		if _, isMember := node.members[node.config.ID]; isMember {
+			node.startElectionLocked()
+		} else {
+			node.resetElectionDeadlineLocked()
+		}
+	}
+}
+
+func (node *Node) resetElectionDeadlineLocked() {
+	timeout := node.config.ElectionTimeout + time.Duration(rand.Int63n(int64(node.config.ElectionTimeout)))
+	node.electionDeadline = time.Now().Add(timeout)
+}
+
+func (node *Node) startElectionLocked() {
+	node.state = candidate
+	node.term++
+	node.votedFor = node.config.ID
+	node.leaderID = ""
+	if err := node.persistLocked(); err != nil {
+		node.becomeFollowerLocked(node.term - 1)
+		return
+	}
+	node.resetElectionDeadlineLocked()
+
+	node.votes = map[string]bool{node.config.ID: true}
+	if node.hasQuorumLocked(node.votes) {
+		node.becomeLeaderLocked()
+		return
+	}
+
+	lastIndex, _ := node.config.Storage.LastIndex()
+	request := RequestVoteRequest{
+		Term:         node.term,
+		CandidateID:  node.config.ID,
+		LastLogIndex: lastIndex,
+		LastLogTerm:  node.termAtLocked(lastIndex),
+	}
+	for id, member := range node.members {
+		if id != node.config.ID {
+			go node.requestVote(member, request)
+		}
+	}
+}
+
+func (node *Node) requestVote(member Member, request RequestVoteRequest) {
+	response, err := node.config.Transport.RequestVote(member, request)
+	if err != nil {
+		return
+	}
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if response.Term > node.term {
+		node.becomeFollowerLocked(response.Term)
+		return
+	}
+	if node.state != candidate || node.term != request.Term || !response.VoteGranted {
+		return
+	}
+	node.votes[member.ID] = true
+	if node.hasQuorumLocked(node.votes) {
+		node.becomeLeaderLocked()
+	}
+}
+
+func (node *Node) becomeFollowerLocked(term uint64) {
+	if term > node.term {
+		node.term = term
+		node.votedFor = ""
+		node.persistLocked()
+	}
+	node.state = follower
+	node.resetElectionDeadlineLocked()
+	node.cond.Broadcast()
+}
+
+func (node *Node) becomeLeaderLocked() {
+	node.state = leader
+	node.leaderID = node.config.ID
+
+	lastIndex, _ := node.config.Storage.LastIndex()
+	node.nextIndex = make(map[string]uint64)
+	node.matchIndex = make(map[string]uint64)
+	for id := range node.members {
+		node.nextIndex[id] = lastIndex + 1
+		node.matchIndex[id] = 0
+	}
+
+	// Committing an entry of our own term also commits everything before it
+	if _, _, err := node.appendLocked(EntryNoop, nil); err != nil {
+		node.becomeFollowerLocked(node.term)
+	}
+}
+
+// Sends AppendEntries to every member that doesn't already have one in flight
+func (node *Node) broadcastLocked() {
+	node.heartbeatDue = time.Now().Add(node.config.HeartbeatInterval)
+	for id, member := range node.members {
+		if id != node.config.ID && !node.inflight[id] {
+			node.inflight[id] = true
+			go node.replicateTo(member)
+		}
+	}
+}
+
+// Largest batch of entries sent in a single AppendEntries
+const maxEntriesPerRequest = 256
+
+func (node *Node) replicateTo(member Member) {
+	node.mu.Lock()
+	if node.state != leader || node.stopped {
+		node.inflight[member.ID] = false
+		node.mu.Unlock()
+		return
+	}
+
+	lastIndex, _ := node.config.Storage.LastIndex()
+	nextIndex := node.nextIndex[member.ID]
+	if nextIndex == 0 || nextIndex > lastIndex+1 {
+		nextIndex = lastIndex + 1
+	}
+	hi := lastIndex + 1
+	if hi-nextIndex > maxEntriesPerRequest {
+		hi = nextIndex + maxEntriesPerRequest
+	}
+	entries, err := node.config.Storage.Entries(nextIndex, hi)
+	if err != nil {
+		node.inflight[member.ID] = false
+		node.mu.Unlock()
+		return
+	}
+	request := AppendEntriesRequest{
+		Term:         node.term,
+		LeaderID:     node.config.ID,
+		PrevLogIndex: nextIndex - 1,
+		PrevLogTerm:  node.termAtLocked(nextIndex - 1),
+		Entries:      entries,
+		LeaderCommit: node.commitIndex,
+	}
+	seq := node.sendSeq
+	node.mu.Unlock()
+
+	response, err := node.config.Transport.AppendEntries(member, request)
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	node.inflight[member.ID] = false
+	if err != nil {
+		return
+	}
+	if response.Term > node.term {
+		node.becomeFollowerLocked(response.Term)
+		return
+	}
+	if node.state != leader || node.term != request.Term {
+		return
+	}
+
+	// Any answer in our term confirms we were still leader when it was sent
+	for _, read := range node.reads {
+		if read.seq <= seq {
+			read.acks[member.ID] = true
+		}
+	}
+	node.cond.Broadcast()
+
+	if !response.Success {
+		retry := response.ConflictIndex
+		if retry == 0 || retry >= nextIndex {
+			retry = nextIndex - 1
+		}
+		if retry < 1 {
+			retry = 1
+		}
+		node.nextIndex[member.ID] = retry
+		node.inflight[member.ID] = true
+		go node.replicateTo(member)
+		return
+	}
+
+	matchIndex := request.PrevLogIndex + uint64(len(entries))
+	if matchIndex > node.matchIndex[member.ID] {
+		node.matchIndex[member.ID] = matchIndex
+	}
+	node.nextIndex[member.ID] = matchIndex + 1
+	node.advanceCommitLocked()
+
+	// Keep going while the member is behind, including entries appended meanwhile
+	if currentLastIndex, _ := node.config.Storage.LastIndex(); matchIndex < currentLastIndex {
+		node.inflight[member.ID] = true
+		go node.replicateTo(member)
+	}
+}
+
+// Commits the highest entry of the current term stored on a quorum
+func (node *Node) advanceCommitLocked() {
+	lastIndex, _ := node.config.Storage.LastIndex()
+	for index := lastIndex; index > node.commitIndex; index-- {
+		if node.termAtLocked(index) != node.term {
+			break
+		}
+		stored := make(map[string]bool)
+		for id := range node.members {
+			if node.matchIndex[id] >= index {
+				stored[id] = true
+			}
+		}
+		if node.hasQuorumLocked(stored) {
+			node.commitIndex = index
+			node.cond.Broadcast()
+			return
+		}
+	}
+}
+
+func (node *Node) hasQuorumLocked(ids map[string]bool) bool {
+	count := 0
+	for id := range node.members {
+		if ids[id] {
+			count++
+		}
+	}
+	return count > len(node.members)/2
+}
+
+// Applies committed entries outside of the lock, so Apply can be slow
+func (node *Node) applier() {
+	for {
+		node.mu.Lock()
+		for node.lastApplied >= node.commitIndex && !node.stopped {
+			node.cond.Wait()
+		}
+		if node.stopped {
+			node.mu.Unlock()
+			return
+		}
+		entries, err := node.config.Storage.Entries(node.lastApplied+1, node.commitIndex+1)
+		node.mu.Unlock()
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.Type == EntryCommand && node.config.Apply != nil {
+				node.config.Apply(entry)
+			}
+		}
+
+		node.mu.Lock()
+		node.lastApplied = entries[len(entries)-1].Index
+		node.persistLocked()
+		// A leader that was removed steps down once the removal has committed
+		if _, isMember := node.members[node.config.ID]; !isMember && node.state == leader && node.membersIndex <= node.commitIndex {
+			node.becomeFollowerLocked(node.term)
+			node.leaderID = ""
+		}
+		node.cond.Broadcast()
+		node.mu.Unlock()
+	}
+}
+
+func (node *Node) persistLocked() error {
+	return node.config.Storage.SetHardState(HardState{Term: node.term, VotedFor: node.votedFor, Applied: node.lastApplied})
+}
+
+func (node *Node) termAtLocked(index uint64) uint64 {
+	if index == 0 {
+		return 0
+	}
+	entries, err := node.config.Storage.Entries(index, index+1)
+	if err != nil {
+		return 0
+	}
+	return entries[0].Term
+}
+
+// Members come from the latest membership entry in the log, committed or not
+func (node *Node) refreshMembersLocked() error {
+	lastIndex, err := node.config.Storage.LastIndex()
+	if err != nil {
+		return err
+	}
+	node.members = make(map[string]Member)
+	node.membersIndex = 0
+	for index := lastIndex; index > 0; index-- {
+		entries, err := node.config.Storage.Entries(index, index+1)
+		if err != nil {
+			return err
+		}
+		if entries[0].Type != EntryMembership {
+			continue
+		}
+		members, err := decodeMembers(entries[0].Data)
+		if err != nil {
+			return err
+		}
+		for _, member := range members {
+			node.members[member.ID] = member
+		}
+		node.membersIndex = index
+		break
+	}
+
+	if node.state == leader {
+		for id := range node.members {
+			if _, known := node.nextIndex[id]; !known {
+				node.nextIndex[id] = lastIndex + 1
+				node.matchIndex[id] = 0
+			}
+		}
+	}
+	return nil
+}
+
+func (node *Node) HandleRequestVote(request RequestVoteRequest) (RequestVoteResponse, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.stopped {
+		return RequestVoteResponse{}, ErrStopped
+	}
+
+	// Ignore candidates while a leader is around, so removed members can't disrupt it
+	if node.leaderID != "" && time.Since(node.lastLeaderContact) < node.config.ElectionTimeout {
+		return RequestVoteResponse{Term: node.term}, nil
+	}
+	if request.Term < node.term {
+		return RequestVoteResponse{Term: node.term}, nil
+	}
+	if request.Term > node.term {
+		node.becomeFollowerLocked(request.Term)
+		node.leaderID = ""
+	}
+
+	lastIndex, _ := node.config.Storage.LastIndex()
+	lastTerm := node.termAtLocked(lastIndex)
+	upToDate := request.LastLogTerm > lastTerm || (request.LastLogTerm == lastTerm && request.LastLogIndex >= lastIndex)
+	if (node.votedFor == "" || node.votedFor == request.CandidateID) && upToDate {
+		node.votedFor = request.CandidateID
+		if err := node.persistLocked(); err != nil {
+			return RequestVoteResponse{}, err
+		}
+		node.resetElectionDeadlineLocked()
+		return RequestVoteResponse{Term: node.term, VoteGranted: true}, nil
+	}
+	return RequestVoteResponse{Term: node.term}, nil
+}
+
+func (node *Node) HandleAppendEntries(request AppendEntriesRequest) (AppendEntriesResponse, error) {
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.stopped {
+		return AppendEntriesResponse{}, ErrStopped
+	}
+
+	if request.Term < node.term {
+		return AppendEntriesResponse{Term: node.term}, nil
+	}
+	if request.Term > node.term || node.state != follower {
+		node.becomeFollowerLocked(request.Term)
+	}
+	node.leaderID = request.LeaderID
+	node.lastLeaderContact = time.Now()
+	node.resetElectionDeadlineLocked()
+
+	lastIndex, err := node.config.Storage.LastIndex()
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	if request.PrevLogIndex > lastIndex {
+		return AppendEntriesResponse{Term: node.term, ConflictIndex: lastIndex + 1}, nil
+	}
+	if prevTerm := node.termAtLocked(request.PrevLogIndex); prevTerm != request.PrevLogTerm {
+		// Skip back over the whole conflicting term instead of one entry at a time
+		conflictIndex := request.PrevLogIndex
+		for conflictIndex > 1 && node.termAtLocked(conflictIndex-1) == prevTerm {
+			conflictIndex--
+		}
+		return AppendEntriesResponse{Term: node.term, ConflictIndex: conflictIndex}, nil
+	}
+
+	for i, entry := range request.Entries {
+		if entry.Index <= lastIndex && node.termAtLocked(entry.Index) == entry.Term {
+			continue
+		}
+		if entry.Index <= node.commitIndex {
+			return AppendEntriesResponse{}, fmt.Errorf("raft: leader %s tried to overwrite committed entry %d", request.LeaderID, entry.Index)
+		}
+		if err := node.config.Storage.Append(request.Entries[i:]); err != nil {
+			return AppendEntriesResponse{}, err
+		}
+		if err := node.refreshMembersLocked(); err != nil {
+			return AppendEntriesResponse{}, err
+		}
+		break
+	}
+
+	matchIndex := request.PrevLogIndex + uint64(len(request.Entries))
+	if request.LeaderCommit > node.commitIndex {
+		commitIndex := request.LeaderCommit
+		if commitIndex > matchIndex {
+			commitIndex = matchIndex
+		}
+		if commitIndex > node.commitIndex {
+			node.commitIndex = commitIndex
+			node.cond.Broadcast()
+		}
+	}
+	return AppendEntriesResponse{Term: node.term, Success: true}, nil
+}
+
+func encodeMembers(members []Member) ([]byte, error) {
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return json.Marshal(members)
+}
+
+func decodeMembers(data []byte) ([]Member, error) {
+	var members []Member
+	if err := json.Unmarshal(data, &members); err != nil {
+		return nil, fmt.Errorf("raft: could not decode members: %v", err)
+	}
+	return members, nil
+}
@@ -0,0 +1,273 @@
+package raft
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testCluster struct {
+	t       *testing.T
+	network *MemoryNetwork
+	nodes   map[string]*Node
+	applied map[string]*appliedLog
+}
+
+// Records what a node applied, in order
+type appliedLog struct {
+	sync.Mutex
+	entries []string
+}
+
+func (applied *appliedLog) get() []string {
+	applied.Lock()
+	defer applied.Unlock()
+	return append([]string{}, applied.entries...)
+}
+
+func newTestCluster(t *testing.T, ids ...string) *testCluster {
+	cluster := &testCluster{
+		t:       t,
+		network: NewMemoryNetwork(),
+		nodes:   make(map[string]*Node),
+		applied: make(map[string]*appliedLog),
+	}
+	members := make([]Member, 0)
+	for _, id := range ids {
+		members = append(members, Member{ID: id})
+	}
+	for _, id := range ids {
+		cluster.start(id, members)
+	}
+	return cluster
+}
+
+func (cluster *testCluster) start(id string, members []Member) *Node {
+	applied := &appliedLog{}
+	node, err := NewNode(Config{
+		ID:        id,
+		Members:   members,
+		Storage:   NewMemoryStorage(),
+		Transport: cluster.network.Transport(id),
+		Apply: func(entry Entry) {
+			applied.Lock()
+			applied.entries = append(applied.entries, string(entry.Data))
+			applied.Unlock()
+		},
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		CommitTimeout:     time.Second,
+	})
+	if err != nil {
+		cluster.t.Fatal(err)
+	}
+	cluster.network.Register(node)
+	cluster.nodes[id] = node
+	cluster.applied[id] = applied
+	return node
+}
+
+func (cluster *testCluster) stop() {
+	for _, node := range cluster.nodes {
+		node.Stop()
+	}
+}
+
+// Waits until exactly one of the connected nodes is leader
+func (cluster *testCluster) waitForLeader(excluded ...string) *Node {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := make([]*Node, 0)
+		for id, node := range cluster.nodes {
+			if !contains(excluded, id) && node.IsLeader() {
+				leaders = append(leaders, node)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cluster.t.Fatal("no single leader was elected")
+	return nil
+}
+
+func (cluster *testCluster) waitForApplied(id string, expected []string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(cluster.applied[id].get()) == fmt.Sprint(expected) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cluster.t.Fatalf("node %s applied %v, expected %v", id, cluster.applied[id].get(), expected)
+}
+
+func contains(ids []string, id string) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestElectsLeader(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	leader := cluster.waitForLeader()
+	for _, node := range cluster.nodes {
+		if node.Leader() != "" && node.Leader() != leader.ID() {
+			t.Errorf("node %s follows %s, expected %s", node.ID(), node.Leader(), leader.ID())
+		}
+	}
+}
+
+func TestReplicatesProposals(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	leader := cluster.waitForLeader()
+	for i := 0; i < 5; i++ {
+		if err := leader.Propose([]byte(fmt.Sprintf("op%d", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []string{"op0", "op1", "op2", "op3", "op4"}
+	// The leader has applied a proposal by the time Propose returns
+	if fmt.Sprint(cluster.applied[leader.ID()].get()) != fmt.Sprint(expected) {
+		t.Errorf("leader applied %v, expected %v", cluster.applied[leader.ID()].get(), expected)
+	}
+	for id := range cluster.nodes {
+		cluster.waitForApplied(id, expected)
+	}
+}
+
+func TestFollowerRejectsProposals(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	leader := cluster.waitForLeader()
+	for _, node := range cluster.nodes {
+		if node != leader {
+			if err := node.Propose([]byte("op")); err != ErrNotLeader {
+				t.Errorf("expected ErrNotLeader from follower, got %v", err)
+			}
+			if err := node.ReadIndex(); err != ErrNotLeader {
+				t.Errorf("expected ErrNotLeader from follower read, got %v", err)
+			}
+		}
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	oldLeader := cluster.waitForLeader()
+	if err := oldLeader.Propose([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	cluster.network.Disconnect(oldLeader.ID())
+	newLeader := cluster.waitForLeader(oldLeader.ID())
+	if err := newLeader.Propose([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader can't commit anything on its own
+	if err := oldLeader.Propose([]byte("lost")); err == nil {
+		t.Errorf("expected a partitioned leader's proposal to fail")
+	}
+
+	cluster.network.Reconnect(oldLeader.ID())
+	for id := range cluster.nodes {
+		cluster.waitForApplied(id, []string{"before", "after"})
+	}
+}
+
+func TestReadIndex(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	leader := cluster.waitForLeader()
+	if err := leader.Propose([]byte("op")); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.ReadIndex(); err != nil {
+		t.Errorf("expected read index to succeed on the leader: %v", err)
+	}
+
+	// A leader cut off from the quorum can't confirm it's still leader
+	cluster.network.Disconnect(leader.ID())
+	if err := leader.ReadIndex(); err == nil {
+		t.Errorf("expected read index to fail on a partitioned leader")
+	}
+}
+
+func TestMembershipChanges(t *testing.T) {
+	cluster := newTestCluster(t, "a", "b", "c")
+	defer cluster.stop()
+
+	leader := cluster.waitForLeader()
+	if err := leader.Propose([]byte("op0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new node starts with an empty log and catches up from the leader
+	cluster.start("d", nil)
+	if err := leader.AddMember(Member{ID: "d"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Propose([]byte("op1")); err != nil {
+		t.Fatal(err)
+	}
+	cluster.waitForApplied("d", []string{"op0", "op1"})
+	if members := leader.Status().Members; len(members) != 4 {
+		t.Errorf("expected 4 members, got %v", members)
+	}
+
+	// Removing the leader makes it step down, and the rest elect a new one
+	if err := leader.RemoveMember(leader.ID()); err != nil {
+		t.Fatal(err)
+	}
+	newLeader := cluster.waitForLeader(leader.ID())
+	if err := newLeader.Propose([]byte("op2")); err != nil {
+		t.Fatal(err)
+	}
+	if members := newLeader.Status().Members; len(members) != 3 {
+		t.Errorf("expected 3 members, got %v", members)
+	}
+}
+
+func TestFileStorageRestart(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.Append([]Entry{{Index: 1, Term: 1, Data: []byte("a")}, {Index: 2, Term: 1, Data: []byte("b")}})
+	// Overwrites entry 2, as a follower does when its log conflicts with the leader's
+	storage.Append([]Entry{{Index: 2, Term: 2, Data: []byte("c")}})
+	storage.SetHardState(HardState{Term: 2, VotedFor: "a", Applied: 1})
+	storage.Close()
+
+	storage, err = OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if lastIndex, _ := storage.LastIndex(); lastIndex != 2 {
+		t.Fatalf("expected last index 2, got %d", lastIndex)
+	}
+	entries, _ := storage.Entries(1, 3)
+	if string(entries[0].Data) != "a" || string(entries[1].Data) != "c" || entries[1].Term != 2 {
+		t.Errorf("unexpected entries after restart: %v", entries)
+	}
+	if state, _ := storage.HardState(); state.Term != 2 || state.VotedFor != "a" || state.Applied != 1 {
+		t.Errorf("unexpected hard state after restart: %v", state)
+	}
+}
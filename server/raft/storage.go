@@ -0,0 +1,251 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Durable state of a node. Term and VotedFor have to be persisted before a node
+// answers any RPC, Applied lets a restarted node skip entries it already applied.
+type HardState struct {
+	Term     uint64
+	VotedFor string
+	Applied  uint64
+}
+
+// Where a node keeps its hard state and log. Indexes start at 1.
+type Storage interface {
+	HardState() (HardState, error)
+	SetHardState(state HardState) error
+	LastIndex() (uint64, error)
+	// Entries in [lo, hi)
+	Entries(lo uint64, hi uint64) ([]Entry, error)
+	// Appends entries, dropping any existing entries from entries[0].Index on.
+	// entries[0].Index can be at most LastIndex() + 1.
+	Append(entries []Entry) error
+}
+
+// Storage that keeps everything in memory, for tests
+type MemoryStorage struct {
+	sync.Mutex
+	state   HardState
+	entries []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{entries: make([]Entry, 0)}
+}
+
+func (storage *MemoryStorage) HardState() (HardState, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return storage.state, nil
+}
+
+func (storage *MemoryStorage) SetHardState(state HardState) error {
+	storage.Lock()
+	defer storage.Unlock()
+	storage.state = state
+	return nil
+}
+
+func (storage *MemoryStorage) LastIndex() (uint64, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return uint64(len(storage.entries)), nil
+}
+
+func (storage *MemoryStorage) Entries(lo uint64, hi uint64) ([]Entry, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return sliceEntries(storage.entries, lo, hi)
+}
+
+func (storage *MemoryStorage) Append(entries []Entry) error {
+	storage.Lock()
+	defer storage.Unlock()
+
+	truncated, err := appendEntries(storage.entries, entries)
+	if err != nil {
+		return err
+	}
+	storage.entries = truncated
+	return nil
+}
+
+func sliceEntries(entries []Entry, lo uint64, hi uint64) ([]Entry, error) {
+	if lo < 1 || lo > hi || hi > uint64(len(entries))+1 {
+		return nil, fmt.Errorf("entries [%d, %d) out of range, last index is %d", lo, hi, len(entries))
+	}
+	result := make([]Entry, hi-lo)
+	copy(result, entries[lo-1:hi-1])
+	return result, nil
+}
+
+func appendEntries(existing []Entry, entries []Entry) ([]Entry, error) {
+	if len(entries) == 0 {
+		return existing, nil
+	}
+	first := entries[0].Index
+	if first < 1 || first > uint64(len(existing))+1 {
+		return nil, fmt.Errorf("entry %d would leave a gap after last index %d", first, len(existing))
+	}
+	return append(existing[:first-1], entries...), nil
+}
+
+// Storage backed by a directory holding the hard state and the log. Entries are
+// also kept in memory, the log file is only read when the storage is opened.
+type FileStorage struct {
+	sync.Mutex
+	dir     string
+	state   HardState
+	entries []Entry
+	log     *os.File
+}
+
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create %s: %v", dir, err)
+	}
+	storage := &FileStorage{dir: dir, entries: make([]Entry, 0)}
+
+	b, err := ioutil.ReadFile(storage.statePath())
+	if err == nil {
+		if err := json.Unmarshal(b, &storage.state); err != nil {
+			return nil, fmt.Errorf("could not decode %s: %v", storage.statePath(), err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read %s: %v", storage.statePath(), err)
+	}
+
+	if err := storage.readLog(); err != nil {
+		return nil, err
+	}
+	storage.log, err = os.OpenFile(storage.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", storage.logPath(), err)
+	}
+	return storage, nil
+}
+
+func (storage *FileStorage) statePath() string {
+	return filepath.Join(storage.dir, "state.json")
+}
+
+func (storage *FileStorage) logPath() string {
+	return filepath.Join(storage.dir, "log")
+}
+
+// The log is a stream of JSON encoded entries. Later entries replace earlier ones with
+// the same index, which is how truncations are written without rewriting the file.
+func (storage *FileStorage) readLog() error {
+	f, err := os.Open(storage.logPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open %s: %v", storage.logPath(), err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var entry Entry
+		if err := decoder.Decode(&entry); err == io.EOF || err == io.ErrUnexpectedEOF {
+			// A torn write at the end never got acknowledged, so it's safe to drop
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not decode %s: %v", storage.logPath(), err)
+		}
+		storage.entries, err = appendEntries(storage.entries, []Entry{entry})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (storage *FileStorage) Close() error {
+	storage.Lock()
+	defer storage.Unlock()
+	return storage.log.Close()
+}
+
+func (storage *FileStorage) HardState() (HardState, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return storage.state, nil
+}
+
+func (storage *FileStorage) SetHardState(state HardState) error {
+	storage.Lock()
+	defer storage.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := storage.statePath() + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", tmpPath, err)
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %v", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync %s: %v", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, storage.statePath()); err != nil {
+		return fmt.Errorf("could not replace %s: %v", storage.statePath(), err)
+	}
+	storage.state = state
+	return nil
+}
+
+func (storage *FileStorage) LastIndex() (uint64, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return uint64(len(storage.entries)), nil
+}
+
+func (storage *FileStorage) Entries(lo uint64, hi uint64) ([]Entry, error) {
+	storage.Lock()
+	defer storage.Unlock()
+	return sliceEntries(storage.entries, lo, hi)
+}
+
+func (storage *FileStorage) Append(entries []Entry) error {
+	storage.Lock()
+	defer storage.Unlock()
+
+	truncated, err := appendEntries(storage.entries, entries)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(storage.log)
+	encoder := json.NewEncoder(writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("could not encode entry %d: %v", entry.Index, err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("could not write %s: %v", storage.logPath(), err)
+	}
+	if err := storage.log.Sync(); err != nil {
+		return fmt.Errorf("could not sync %s: %v", storage.logPath(), err)
+	}
+	storage.entries = truncated
+	return nil
+}
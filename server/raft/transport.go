@@ -0,0 +1,210 @@
+package raft
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// First index the leader should retry from when Success is false
+	ConflictIndex uint64
+}
+
+// Carries RPCs from a node to the other members
+type Transport interface {
+	RequestVote(to Member, request RequestVoteRequest) (RequestVoteResponse, error)
+	AppendEntries(to Member, request AppendEntriesRequest) (AppendEntriesResponse, error)
+}
+
+var ErrUnreachable = errors.New("raft: member is unreachable")
+
+// Connects nodes in the same process, for tests. Members are addressed by ID, and
+// can be cut off from the rest to simulate crashes and partitions.
+type MemoryNetwork struct {
+	sync.RWMutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{nodes: make(map[string]*Node), disconnected: make(map[string]bool)}
+}
+
+func (network *MemoryNetwork) Register(node *Node) {
+	network.Lock()
+	defer network.Unlock()
+	network.nodes[node.ID()] = node
+}
+
+func (network *MemoryNetwork) Disconnect(id string) {
+	network.Lock()
+	defer network.Unlock()
+	network.disconnected[id] = true
+}
+
+func (network *MemoryNetwork) Reconnect(id string) {
+	network.Lock()
+	defer network.Unlock()
+	delete(network.disconnected, id)
+}
+
+// Transport for the node with the given ID
+func (network *MemoryNetwork) Transport(id string) Transport {
+	return &memoryTransport{network: network, from: id}
+}
+
+func (network *MemoryNetwork) route(from string, to string) (*Node, error) {
+	network.RLock()
+	defer network.RUnlock()
+	node, found := network.nodes[to]
+	if !found || network.disconnected[from] || network.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return node, nil
+}
+
+type memoryTransport struct {
+	network *MemoryNetwork
+	from    string
+}
+
+func (transport *memoryTransport) RequestVote(to Member, request RequestVoteRequest) (RequestVoteResponse, error) {
+	node, err := transport.network.route(transport.from, to.ID)
+	if err != nil {
+		return RequestVoteResponse{}, err
+	}
+	return node.HandleRequestVote(request)
+}
+
+func (transport *memoryTransport) AppendEntries(to Member, request AppendEntriesRequest) (AppendEntriesResponse, error) {
+	node, err := transport.network.route(transport.from, to.ID)
+	if err != nil {
+		return AppendEntriesResponse{}, err
+	}
+	return node.HandleAppendEntries(request)
+}
+
+// How long an RPC to another member can take before it counts as lost
+const rpcTimeout = time.Second
+
+// Transport over TCP using net/rpc. Members are addressed by their Addr, which has
+// to be where Serve is listening.
+type RPCTransport struct {
+	sync.Mutex
+	clients map[string]*rpc.Client
+}
+
+func NewRPCTransport() *RPCTransport {
+	return &RPCTransport{clients: make(map[string]*rpc.Client)}
+}
+
+func (transport *RPCTransport) RequestVote(to Member, request RequestVoteRequest) (RequestVoteResponse, error) {
+	var response RequestVoteResponse
+	err := transport.call(to.Addr, "Raft.RequestVote", request, &response)
+	return response, err
+}
+
+func (transport *RPCTransport) AppendEntries(to Member, request AppendEntriesRequest) (AppendEntriesResponse, error) {
+	var response AppendEntriesResponse
+	err := transport.call(to.Addr, "Raft.AppendEntries", request, &response)
+	return response, err
+}
+
+func (transport *RPCTransport) call(addr string, method string, request interface{}, response interface{}) error {
+	client, err := transport.client(addr)
+	if err != nil {
+		return err
+	}
+
+	call := client.Go(method, request, response, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		err = call.Error
+	case <-time.After(rpcTimeout):
+		err = ErrUnreachable
+	}
+
+	// Drop broken connections, the next call redials
+	if err == rpc.ErrShutdown || err == ErrUnreachable {
+		transport.Lock()
+		if transport.clients[addr] == client {
+			delete(transport.clients, addr)
+			client.Close()
+		}
+		transport.Unlock()
+	}
+	return err
+}
+
+func (transport *RPCTransport) client(addr string) (*rpc.Client, error) {
+	transport.Lock()
+	defer transport.Unlock()
+
+	if client, found := transport.clients[addr]; found {
+		return client, nil
+	}
+	conn, err := net.DialTimeout("tcp", addr, rpcTimeout)
+	if err != nil {
+		return nil, err
+	}
+	client := rpc.NewClient(conn)
+	transport.clients[addr] = client
+	return client, nil
+}
+
+// Answers RPCs from the other members on listener until it's closed
+func Serve(listener net.Listener, node *Node) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Raft", &rpcService{node: node}); err != nil {
+		return err
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go server.ServeConn(conn)
+	}
+}
+
+type rpcService struct {
+	node *Node
+}
+
+func (service *rpcService) RequestVote(request RequestVoteRequest, response *RequestVoteResponse) error {
+	result, err := service.node.HandleRequestVote(request)
+	*response = result
+	return err
+}
+
+func (service *rpcService) AppendEntries(request AppendEntriesRequest, response *AppendEntriesResponse) error {
+	result, err := service.node.HandleAppendEntries(request)
+	*response = result
+	return err
+}
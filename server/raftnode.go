@@ -0,0 +1,164 @@
+package main
+
+import (
+	"OttoDB/server/raft"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	raftID    = flag.String("raft-id", "", "ID of this node in the raft cluster, raft is disabled when empty")
+	raftAddr  = flag.String("raft-addr", ":9080", "Address to serve raft RPCs from the other members on")
+	raftPeers = flag.String("raft-peers", "", "Initial members of a new cluster as id=host:port,..., including this node. Empty when joining an existing cluster")
+	raftDir   = flag.String("raft-dir", "./raft", "Directory holding the raft log and state, relative to -dir")
+
+	raftNode *raft.Node
+	// Tags entries proposed by this process, which applied them to the tree already
+	raftOrigin  string
+	raftTracker = struct {
+		sync.Mutex
+		*commitTracker
+	}{commitTracker: newCommitTracker()}
+)
+
+// Commands served only by the leader. Reads go through a read index, so they're
+// linearizable with respect to writes committed anywhere in the cluster.
+var raftReadCommands = map[string]bool{
+	"get":      true,
+	"getv":     true,
+	"history":  true,
+	"keys":     true,
+	"find":     true,
+	"json.get": true,
+}
+
+func startRaft() error {
+	members := make([]raft.Member, 0)
+	if *raftPeers != "" {
+		for _, peer := range strings.Split(*raftPeers, ",") {
+			parts := strings.SplitN(peer, "=", 2)
+			if len(parts) != 2 {
+				return fmt.Errorf("raft peer %q is not of the form id=host:port", peer)
+			}
+			members = append(members, raft.Member{ID: parts[0], Addr: parts[1]})
+		}
+	}
+
+	storage, err := raft.OpenFileStorage(dataPath(*raftDir))
+	if err != nil {
+		return err
+	}
+	raftOrigin = *raftID + "/" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	node, err := raft.NewNode(raft.Config{
+		ID:        *raftID,
+		Members:   members,
+		Storage:   storage,
+		Transport: raft.NewRPCTransport(),
+		Apply:     applyRaftEntry,
+	})
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", *raftAddr)
+	if err != nil {
+		node.Stop()
+		return err
+	}
+	go raft.Serve(listener, node)
+
+	raftNode = node
+	return nil
+}
+
+// Entries are the origin, a newline, then the log entry exactly as written to the log
+func proposeToRaft(frame []byte) error {
+	data := make([]byte, 0, len(raftOrigin)+1+len(frame))
+	data = append(data, raftOrigin...)
+	data = append(data, '\n')
+	data = append(data, frame...)
+	return raftNode.Propose(data)
+}
+
+// Writes a committed entry to the log. Entries from other members (or from before a
+// restart) are also applied to the tree, once their txn's commit comes through.
+func applyRaftEntry(entry raft.Entry) {
+	separator := strings.IndexByte(string(entry.Data), '\n')
+	if separator < 0 {
+		logger.Warn("skipping malformed raft entry", "index", entry.Index)
+		return
+	}
+	origin := string(entry.Data[:separator])
+	logged, err := new(logChain).decode(entry.Data[separator+1:])
+	if err != nil {
+		logger.Warn("skipping malformed raft entry", "index", entry.Index, "err", err)
+		return
+	}
+
+	if err := startLog(); err != nil {
+		logger.Error("could not start log", "err", err)
+	}
+	if err := appendToLog(&logged.operation); err != nil {
+		logger.Error("could not write raft entry to log", "index", entry.Index, "txid", logged.operation.TxID, "err", err)
+	}
+	// Txns started here from now on have to come after every txn in the cluster's log
+	if err := clock.Update(logged.operation.TxID); err != nil {
+		logger.Error("raft entry is too far ahead of the clock", "index", entry.Index, "err", err)
+	}
+	if origin == raftOrigin {
+		return
+	}
+
+	raftTracker.Lock()
+	committedOps, isCommit := raftTracker.track(logged.operation)
+	raftTracker.Unlock()
+	if isCommit && len(committedOps) > 0 {
+		if err := applyReplicatedTxn(logged.operation.TxID, committedOps); err != nil {
+			logger.Error("could not apply raft entry", "index", entry.Index, "txid", logged.operation.TxID, "err", err)
+		}
+	}
+}
+
+// Returns an error for commands this node can't serve because it isn't the leader.
+// Reads on the leader wait for the read index first.
+func checkRaftLeader(command string) error {
+	if raftNode == nil || (!writeCommands[command] && !raftReadCommands[command]) {
+		return nil
+	}
+	if !raftNode.IsLeader() {
+		if leader := raftNode.Leader(); leader != "" {
+			return fmt.Errorf("NOTLEADER the raft leader is %s", leader)
+		}
+		return errors.New("NOTLEADER no raft leader is elected")
+	}
+	if raftReadCommands[command] {
+		if err := raftNode.ReadIndex(); err != nil {
+			return fmt.Errorf("NOTLEADER %v", err)
+		}
+	}
+	return nil
+}
+
+func raftInfo() string {
+	status := raftNode.Status()
+
+	var sb strings.Builder
+	sb.WriteString("# Raft\r\n")
+	sb.WriteString(fmt.Sprintf("raft_id:%s\r\n", status.ID))
+	sb.WriteString(fmt.Sprintf("raft_state:%s\r\n", status.State))
+	sb.WriteString(fmt.Sprintf("raft_term:%d\r\n", status.Term))
+	sb.WriteString(fmt.Sprintf("raft_leader:%s\r\n", status.Leader))
+	sb.WriteString(fmt.Sprintf("raft_commit_index:%d\r\n", status.CommitIndex))
+	sb.WriteString(fmt.Sprintf("raft_last_applied:%d\r\n", status.LastApplied))
+	sb.WriteString(fmt.Sprintf("raft_last_index:%d\r\n", status.LastIndex))
+	for index, member := range status.Members {
+		sb.WriteString(fmt.Sprintf("raft_member%d:id=%s,addr=%s\r\n", index, member.ID, member.Addr))
+	}
+	return sb.String()
+}
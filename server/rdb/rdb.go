@@ -0,0 +1,437 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A string key read from the dump
+type Entry struct {
+	DB       int
+	Key      string
+	Value    string
+	ExpireAt time.Time // Zero if the key doesn't expire
+}
+
+// What was left out of the import
+type Stats struct {
+	Expired   int // Keys that had already expired
+	NonString int // Lists, sets, hashes and sorted sets, which OttoDB has no type for
+}
+
+// Value types
+const (
+	typeString         = 0
+	typeList           = 1
+	typeSet            = 2
+	typeZSet           = 3
+	typeHash           = 4
+	typeZSet2          = 5
+	typeHashZipmap     = 9
+	typeListZiplist    = 10
+	typeSetIntset      = 11
+	typeZSetZiplist    = 12
+	typeHashZiplist    = 13
+	typeListQuicklist  = 14
+	typeHashListpack   = 16
+	typeZSetListpack   = 17
+	typeListQuicklist2 = 18
+	typeSetListpack    = 20
+)
+
+// Longest string read, the most Redis itself accepts in a bulk string. Lengths come from
+// the file, so they can't be trusted with an allocation.
+const maxStringLength = 512 << 20
+
+// A three byte LZF back reference expands to at most 264 bytes
+const lzfMaxExpansion = 88
+
+// Opcodes that aren't value types
+const (
+	opFunction     = 0xf5
+	opModuleAux    = 0xf7
+	opIdle         = 0xf8
+	opFreq         = 0xf9
+	opAux          = 0xfa
+	opResizeDB     = 0xfb
+	opExpireTimeMs = 0xfc
+	opExpireTime   = 0xfd
+	opSelectDB     = 0xfe
+	opEOF          = 0xff
+)
+
+// Special string encodings
+const (
+	encodingInt8  = 0
+	encodingInt16 = 1
+	encodingInt32 = 2
+	encodingLZF   = 3
+)
+
+const (
+	length32 = 0x80
+	length64 = 0x81
+
+	minVersion = 1
+	maxVersion = 12
+)
+
+// Reads a Redis RDB dump, calling handle with every string key in it. Keys of other
+// types, and keys that already expired, are skipped and counted in the returned Stats.
+func Parse(r io.Reader, handle func(Entry) error) (Stats, error) {
+	parser := &parser{reader: bufio.NewReader(r), now: time.Now()}
+	return parser.parse(handle)
+}
+
+type parser struct {
+	reader *bufio.Reader
+	now    time.Time
+	stats  Stats
+}
+
+func (parser *parser) parse(handle func(Entry) error) (Stats, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(parser.reader, header); err != nil {
+		return parser.stats, fmt.Errorf("could not read header: %v", err)
+	}
+	if string(header[:5]) != "REDIS" {
+		return parser.stats, errors.New("not an RDB file")
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < minVersion || version > maxVersion {
+		return parser.stats, fmt.Errorf("unsupported RDB version %q", header[5:])
+	}
+
+	db := 0
+	var expireAt time.Time
+	for {
+		opcode, err := parser.reader.ReadByte()
+		if err != nil {
+			return parser.stats, fmt.Errorf("unexpected end of file: %v", err)
+		}
+
+		switch opcode {
+		case opEOF:
+			// Versions 5 and up end with a checksum, which isn't checked
+			return parser.stats, nil
+
+		case opSelectDB:
+			selected, err := parser.readLength()
+			if err != nil {
+				return parser.stats, err
+			}
+			db = int(selected)
+
+		case opResizeDB:
+			if _, err := parser.readLength(); err != nil {
+				return parser.stats, err
+			}
+			if _, err := parser.readLength(); err != nil {
+				return parser.stats, err
+			}
+
+		case opAux:
+			if _, err := parser.readString(); err != nil {
+				return parser.stats, err
+			}
+			if _, err := parser.readString(); err != nil {
+				return parser.stats, err
+			}
+
+		case opExpireTime:
+			var seconds uint32
+			if err := binary.Read(parser.reader, binary.LittleEndian, &seconds); err != nil {
+				return parser.stats, err
+			}
+			expireAt = time.Unix(int64(seconds), 0)
+
+		case opExpireTimeMs:
+			var millis uint64
+			if err := binary.Read(parser.reader, binary.LittleEndian, &millis); err != nil {
+				return parser.stats, err
+			}
+			expireAt = time.Unix(0, int64(millis)*int64(time.Millisecond))
+
+		case opIdle:
+			if _, err := parser.readLength(); err != nil {
+				return parser.stats, err
+			}
+
+		case opFreq:
+			if _, err := parser.reader.ReadByte(); err != nil {
+				return parser.stats, err
+			}
+
+		case opModuleAux, opFunction:
+			return parser.stats, fmt.Errorf("RDB files with modules or functions are not supported")
+
+		default:
+			key, err := parser.readString()
+			if err != nil {
+				return parser.stats, err
+			}
+			if opcode != typeString {
+				if err := parser.skipValue(opcode); err != nil {
+					return parser.stats, fmt.Errorf("could not skip key %q: %v", key, err)
+				}
+				parser.stats.NonString++
+				expireAt = time.Time{}
+				continue
+			}
+
+			value, err := parser.readString()
+			if err != nil {
+				return parser.stats, err
+			}
+			entry := Entry{DB: db, Key: key, Value: value, ExpireAt: expireAt}
+			expireAt = time.Time{}
+			if !entry.ExpireAt.IsZero() && !entry.ExpireAt.After(parser.now) {
+				parser.stats.Expired++
+				continue
+			}
+			if err := handle(entry); err != nil {
+				return parser.stats, err
+			}
+		}
+	}
+}
+
+// Reads a length. Special encodings, used for strings stored as integers or
+// compressed, are returned with special set.
+func (parser *parser) readLengthOrEncoding() (length uint64, special bool, err error) {
+	first, err := parser.reader.ReadByte()
+	if err != nil {
+		return 0, false, err
+	}
+
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3f), false, nil
+	case 1:
+		second, err := parser.reader.ReadByte()
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3f)<<8 | uint64(second), false, nil
+	case 2:
+		switch first {
+		case length32:
+			var length uint32
+			err := binary.Read(parser.reader, binary.BigEndian, &length)
+			return uint64(length), false, err
+		case length64:
+			var length uint64
+			err := binary.Read(parser.reader, binary.BigEndian, &length)
+			return length, false, err
+		default:
+			return 0, false, fmt.Errorf("invalid length encoding %#x", first)
+		}
+	default:
+		return uint64(first & 0x3f), true, nil
+	}
+}
+
+func (parser *parser) readLength() (uint64, error) {
+	length, special, err := parser.readLengthOrEncoding()
+	if err == nil && special {
+		return 0, errors.New("expected a length, got a string encoding")
+	}
+	return length, err
+}
+
+func (parser *parser) readString() (string, error) {
+	length, special, err := parser.readLengthOrEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !special {
+		return parser.readBytes(length)
+	}
+
+	switch length {
+	case encodingInt8:
+		b, err := parser.reader.ReadByte()
+		return strconv.Itoa(int(int8(b))), err
+	case encodingInt16:
+		var number int16
+		err := binary.Read(parser.reader, binary.LittleEndian, &number)
+		return strconv.Itoa(int(number)), err
+	case encodingInt32:
+		var number int32
+		err := binary.Read(parser.reader, binary.LittleEndian, &number)
+		return strconv.Itoa(int(number)), err
+	case encodingLZF:
+		compressedLength, err := parser.readLength()
+		if err != nil {
+			return "", err
+		}
+		length, err := parser.readLength()
+		if err != nil {
+			return "", err
+		}
+		if length > maxStringLength || length > compressedLength*lzfMaxExpansion {
+			return "", fmt.Errorf("LZF string of %d bytes can't decompress to %d bytes", compressedLength, length)
+		}
+		compressed, err := parser.readBytes(compressedLength)
+		if err != nil {
+			return "", err
+		}
+		b, err := decompressLZF([]byte(compressed), int(length))
+		return string(b), err
+	default:
+		return "", fmt.Errorf("invalid string encoding %d", length)
+	}
+}
+
+// Reads length bytes. The buffer grows as they're read, so a length the file doesn't
+// hold can't make it allocate more than the file does.
+func (parser *parser) readBytes(length uint64) (string, error) {
+	if length > maxStringLength {
+		return "", fmt.Errorf("string of %d bytes is too long", length)
+	}
+	var b strings.Builder
+	if _, err := io.CopyN(&b, parser.reader, int64(length)); err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	} else if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// Reads past a value of a type that isn't imported
+func (parser *parser) skipValue(valueType byte) error {
+	switch valueType {
+	case typeList, typeSet, typeListQuicklist:
+		return parser.skipStrings(1)
+	case typeHash:
+		return parser.skipStrings(2)
+	case typeZSet:
+		count, err := parser.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := parser.readString(); err != nil {
+				return err
+			}
+			// Scores are stored as a string with a one byte length, where 253-255
+			// stand for NaN and the infinities
+			scoreLength, err := parser.reader.ReadByte()
+			if err != nil {
+				return err
+			}
+			if scoreLength < 253 {
+				if _, err := parser.readBytes(uint64(scoreLength)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	case typeZSet2:
+		count, err := parser.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			if _, err := parser.readString(); err != nil {
+				return err
+			}
+			if _, err := parser.readBytes(8); err != nil {
+				return err
+			}
+		}
+		return nil
+	case typeListQuicklist2:
+		count, err := parser.readLength()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < count; i++ {
+			// Each node is a container type followed by its listpack
+			if _, err := parser.readLength(); err != nil {
+				return err
+			}
+			if _, err := parser.readString(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case typeHashZipmap, typeListZiplist, typeSetIntset, typeZSetZiplist, typeHashZiplist,
+		typeHashListpack, typeZSetListpack, typeSetListpack:
+		// Stored as a single encoded blob
+		_, err := parser.readString()
+		return err
+	default:
+		return fmt.Errorf("unsupported value type %d", valueType)
+	}
+}
+
+// Reads past count strings per element of a collection
+func (parser *parser) skipStrings(perElement uint64) error {
+	count, err := parser.readLength()
+	if err != nil {
+		return err
+	}
+	for i := uint64(0); i < count*perElement; i++ {
+		if _, err := parser.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decompresses LZF data, as used by Redis for long strings
+func decompressLZF(in []byte, length int) ([]byte, error) {
+	if length < 0 || length > len(in)*lzfMaxExpansion {
+		return nil, fmt.Errorf("%d bytes of LZF data can't decompress to %d bytes", len(in), length)
+	}
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes
+			end := i + ctrl + 1
+			if end > len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			out = append(out, in[i:end]...)
+			i = end
+			continue
+		}
+
+		// A back reference into the output written so far
+		runLength := ctrl >> 5
+		if runLength == 7 {
+			if i >= len(in) {
+				return nil, errors.New("corrupt LZF data")
+			}
+			runLength += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, errors.New("corrupt LZF data")
+		}
+		back := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if back < 0 {
+			return nil, errors.New("corrupt LZF data")
+		}
+		// Byte by byte, since the reference can overlap what it's copying
+		for j := 0; j < runLength+2; j++ {
+			out = append(out, out[back+j])
+		}
+	}
+
+	if len(out) != length {
+		return nil, fmt.Errorf("LZF data decompressed to %d bytes, expected %d", len(out), length)
+	}
+	return out, nil
+}
@@ -0,0 +1,133 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+// Builds a dump the way Redis writes one
+type dumpBuilder struct {
+	bytes.Buffer
+}
+
+func (dump *dumpBuilder) str(s string) {
+	dump.WriteByte(byte(len(s)))
+	dump.WriteString(s)
+}
+
+func (dump *dumpBuilder) expireMs(t time.Time) {
+	dump.WriteByte(opExpireTimeMs)
+	binary.Write(dump, binary.LittleEndian, uint64(t.UnixNano()/int64(time.Millisecond)))
+}
+
+func TestParse(t *testing.T) {
+	dump := &dumpBuilder{}
+	dump.WriteString("REDIS0009")
+	dump.WriteByte(opAux)
+	dump.str("redis-ver")
+	dump.str("5.0.7")
+	dump.WriteByte(opSelectDB)
+	dump.WriteByte(0)
+	dump.WriteByte(opResizeDB)
+	dump.WriteByte(5)
+	dump.WriteByte(1)
+
+	// Plain string
+	dump.WriteByte(typeString)
+	dump.str("plain")
+	dump.str("value")
+	// Strings stored as integers
+	dump.WriteByte(typeString)
+	dump.str("int8")
+	dump.Write([]byte{0xc0, 0xfe})
+	dump.WriteByte(typeString)
+	dump.str("int32")
+	dump.WriteByte(0xc2)
+	binary.Write(dump, binary.LittleEndian, int32(100000))
+	// LZF compressed "aaaaaaaaaa": one literal a, then a back reference copying 9 bytes
+	dump.WriteByte(typeString)
+	dump.str("compressed")
+	dump.Write([]byte{0xc3, 5, 10, 0x00, 'a', 0xe0, 0x00, 0x00})
+	// Expired, and still to expire
+	dump.expireMs(time.Now().Add(-time.Hour))
+	dump.WriteByte(typeString)
+	dump.str("expired")
+	dump.str("gone")
+	dump.expireMs(time.Now().Add(time.Hour))
+	dump.WriteByte(typeString)
+	dump.str("expiring")
+	dump.str("soon")
+	// A list, which can't be imported
+	dump.WriteByte(typeList)
+	dump.str("list")
+	dump.WriteByte(2)
+	dump.str("a")
+	dump.str("b")
+
+	dump.WriteByte(opEOF)
+	dump.Write(make([]byte, 8))
+
+	entries := make(map[string]Entry)
+	stats, err := Parse(dump, func(entry Entry) error {
+		entries[entry.Key] = entry
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"plain":      "value",
+		"int8":       "-2",
+		"int32":      "100000",
+		"compressed": "aaaaaaaaaa",
+		"expiring":   "soon",
+	}
+	if len(entries) != len(expected) {
+		t.Errorf("expected %d entries, got %v", len(expected), entries)
+	}
+	for key, value := range expected {
+		if entries[key].Value != value {
+			t.Errorf("expected %s to be %q, got %q", key, value, entries[key].Value)
+		}
+	}
+	if entries["expiring"].ExpireAt.IsZero() || !entries["plain"].ExpireAt.IsZero() {
+		t.Errorf("expected only the expiring key to have an expiry")
+	}
+	if stats.Expired != 1 || stats.NonString != 1 {
+		t.Errorf("expected 1 expired and 1 non string key, got %+v", stats)
+	}
+}
+
+func TestParseRejectsOtherFiles(t *testing.T) {
+	if _, err := Parse(bytes.NewBufferString("NOTREDIS0"), func(Entry) error { return nil }); err == nil {
+		t.Errorf("expected a file without the RDB header to be rejected")
+	}
+}
+
+func TestHugeLengthsAreRejected(t *testing.T) {
+	if _, err := decompressLZF([]byte{0x00, 'a'}, 1<<62); err == nil {
+		t.Errorf("expected a length LZF data can't decompress to to be rejected")
+	}
+
+	// A string claiming 2 GiB, with nothing after it
+	p := &parser{reader: bufio.NewReader(bytes.NewReader([]byte{0x80, 0x80, 0x00, 0x00, 0x00}))}
+	if _, err := p.readString(); err == nil {
+		t.Errorf("expected a string longer than the limit to be rejected")
+	}
+	// One that's within the limit but longer than the file
+	p = &parser{reader: bufio.NewReader(bytes.NewReader([]byte{0x80, 0x01, 0x00, 0x00, 0x00, 'a'}))}
+	if _, err := p.readString(); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecompressLZFRejectsBadReferences(t *testing.T) {
+	if _, err := decompressLZF([]byte{0xe0, 0x00, 0x05}, 9); err == nil {
+		t.Errorf("expected a back reference before the start to be rejected")
+	}
+}
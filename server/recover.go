@@ -0,0 +1,50 @@
+package main
+
+import (
+	"OttoDB/server/twopc"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// ottodb recover [-log path] [-user name -pass password] host:port ...
+// Finishes the two-phase commits left in doubt on the given nodes, using the
+// coordinator's decision log. Run it while the coordinator isn't committing anything.
+func runRecover(args []string) int {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	logPath := flags.String("log", "./coordinator.log", "Decision log of the coordinator")
+	user := flags.String("user", "default", "User to authenticate as on the nodes")
+	pass := flags.String("pass", "", "Password to authenticate with, none when empty")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: ottodb recover [-log path] [-user name -pass password] host:port ...")
+		return 2
+	}
+
+	coordinator, err := twopc.Open(*logPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer coordinator.Close()
+	coordinator.SetAuth(*user, *pass)
+
+	resolutions, err := coordinator.Recover(flags.Args())
+	failed := false
+	for _, resolution := range resolutions {
+		if resolution.Err != nil {
+			failed = true
+			fmt.Printf("%s\t%s\t%s failed: %v\n", resolution.Addr, resolution.GID, resolution.Decision, resolution.Err)
+		} else {
+			fmt.Printf("%s\t%s\t%s\n", resolution.Addr, resolution.GID, resolution.Decision)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
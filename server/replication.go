@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Name of the file in the data directory that records the primary a replica copies its
+// log from, so replication resumes after a restart. The path is set once settings load.
+const replicaStateName = "replica.state"
+
+var replicaStatePath = replicaStateName
+
+// Commands a replica refuses, since its data only comes from the primary
+var writeCommands = map[string]bool{
+	"set": true,
+	"del": true,
+	"cas": true,
+
+	"json.set": true,
+	"json.del": true,
+
+	"create": true,
+	"drop":   true,
+
+	"migrate":         true,
+	"restoreversions": true,
+
+	// PREPARE and ROLLBACK PREPARED log too. COMMIT PREPARED is refused where it's handled.
+	"prepare":  true,
+	"rollback": true,
+}
+
+type replicationState struct {
+	sync.RWMutex
+	primaryAddr string // Primary this node replicates from, empty if it is a primary
+	linkUp      bool
+	offset      int64 // Bytes of the primary's log copied so far
+	tracker     *commitTracker
+	stop        chan bool
+	replicas    map[string]int64 // Replicas streaming from this node, and the offset sent to each
+}
+
+var replication = &replicationState{replicas: make(map[string]int64)}
+
+func isReplica() bool {
+	replication.RLock()
+	defer replication.RUnlock()
+	return replication.primaryAddr != ""
+}
+
+// Picks replication back up if this node was a replica before it restarted
+func resumeReplication() error {
+	state, err := ioutil.ReadFile(replicaStatePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not read %s: %v", replicaStatePath, err)
+	}
+	return startReplication(strings.TrimSpace(string(state)))
+}
+
+// Makes this node a replica of the primary at primaryAddr. The local log becomes a copy
+// of the primary's, so it has to be empty or already copied from the same primary.
+func startReplication(primaryAddr string) error {
+	replication.Lock()
+	defer replication.Unlock()
+
+	if replication.primaryAddr == primaryAddr {
+		return nil
+	}
+	state, _ := ioutil.ReadFile(replicaStatePath)
+	if logSize() != 0 && strings.TrimSpace(string(state)) != primaryAddr {
+		return errors.New("REPLICAOF needs an empty log, or one already copied from this primary")
+	}
+	if err := ioutil.WriteFile(replicaStatePath, []byte(primaryAddr+"\n"), 0666); err != nil {
+		return fmt.Errorf("could not write %s: %v", replicaStatePath, err)
+	}
+
+	// Txns the primary hadn't finished when we last copied its log
+	tracker := newCommitTracker()
+	if logSize() != 0 {
+		operations, err := readLog(walPath)
+		if err != nil {
+			return err
+		}
+		for _, operation := range operations {
+			tracker.track(operation)
+		}
+	}
+
+	if replication.stop != nil {
+		close(replication.stop)
+	}
+	replication.primaryAddr = primaryAddr
+	replication.linkUp = false
+	replication.offset = logSize()
+	replication.tracker = tracker
+	replication.stop = make(chan bool)
+	go replicate(primaryAddr, replication.stop)
+	return nil
+}
+
+// Turns a replica back into a primary, keeping the data it has copied so far
+func stopReplication() error {
+	replication.Lock()
+	defer replication.Unlock()
+
+	if replication.primaryAddr == "" {
+		return nil
+	}
+	close(replication.stop)
+	replication.stop = nil
+	replication.primaryAddr = ""
+	replication.linkUp = false
+	replication.tracker = nil
+
+	if err := os.Remove(replicaStatePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove %s: %v", replicaStatePath, err)
+	}
+	return nil
+}
+
+// Keeps copying the primary's log until replication is stopped
+func replicate(primaryAddr string, stop chan bool) {
+	for {
+		err := syncFromPrimary(primaryAddr, stop)
+
+		replication.Lock()
+		if replication.stop == stop {
+			replication.linkUp = false
+		}
+		replication.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Second):
+			logger.Warn("replication interrupted, reconnecting", "primary", primaryAddr, "err", err)
+		}
+	}
+}
+
+func syncFromPrimary(primaryAddr string, stop chan bool) error {
+	client, err := dialPeer(primaryAddr)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Closing the connection is what interrupts a Receive when replication is stopped
+	done := make(chan bool)
+	defer close(done)
+	go func() {
+		select {
+		case <-stop:
+			client.Close()
+		case <-done:
+		}
+	}()
+
+	replication.RLock()
+	offset := replication.offset
+	replication.RUnlock()
+	if _, err := client.Do("REPLSYNC", strconv.FormatInt(offset, 10)); err != nil {
+		return err
+	}
+
+	replication.Lock()
+	replication.linkUp = true
+	replication.Unlock()
+
+	for {
+		reply, err := client.Receive()
+		if err != nil {
+			return err
+		}
+		frame, ok := reply.([]byte)
+		if !ok {
+			return fmt.Errorf("unexpected reply from primary: %v", reply)
+		}
+		operation, err := copyToLog(frame)
+		if err != nil {
+			return err
+		}
+
+		replication.Lock()
+		if replication.stop != stop {
+			replication.Unlock()
+			return errors.New("replication stopped")
+		}
+		replication.offset += int64(len(frame))
+		committedOps, isCommit := replication.tracker.track(operation)
+		replication.Unlock()
+
+		if isCommit && len(committedOps) > 0 {
+			if err := applyReplicatedTxn(operation.TxID, committedOps); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Applies a txn the primary committed. It's kept active while applying, so readers
+// never see half of it.
+func applyReplicatedTxn(txID uint64, operations []Operation) error {
+	// Local reads need timestamps past the primary's, or they wouldn't see its writes
+	if err := clock.Update(txID); err != nil {
+		return fmt.Errorf("could not apply txn: %v", err)
+	}
+
+	activeTransactions.Lock()
+	activeTransactions.ActiveTransactions[txID] = true
+	activeTransactions.Unlock()
+	defer removeTxnData(txID, activeTransactions)
+
+	transaction := NewTransaction(txID)
+	transaction.replayOps = operations
+	return transaction.BatchExecute(tree)
+}
+
+// Streams this node's log to a replica, starting at offset. Entries are sent as
+// bulk strings holding the length prefixed operation, exactly as written to the log.
+func serveReplica(conn redcon.DetachedConn, offset int64) {
+	defer conn.Close()
+
+	entries, follower, err := followLog(offset)
+	if err != nil {
+		conn.WriteError("ERR " + err.Error())
+		conn.Flush()
+		return
+	}
+	defer unfollowLog(follower)
+
+	replicaAddr := conn.RemoteAddr()
+	replication.Lock()
+	replication.replicas[replicaAddr] = offset
+	replication.Unlock()
+	defer func() {
+		replication.Lock()
+		delete(replication.replicas, replicaAddr)
+		replication.Unlock()
+	}()
+
+	conn.WriteString("CONTINUE")
+	for _, entry := range entries {
+		conn.WriteBulk(entry.frame)
+		offset += int64(len(entry.frame))
+	}
+	if err := conn.Flush(); err != nil {
+		return
+	}
+
+	for entry := range follower {
+		conn.WriteBulk(entry.frame)
+		if err := conn.Flush(); err != nil {
+			return
+		}
+		offset += int64(len(entry.frame))
+
+		replication.Lock()
+		replication.replicas[replicaAddr] = offset
+		replication.Unlock()
+	}
+	// Fell behind the log, the replica reconnects from the offset it got to
+}
+
+// Replication section of INFO
+func replicationInfo() string {
+	replication.RLock()
+	defer replication.RUnlock()
+
+	var sb strings.Builder
+	sb.WriteString("# Replication\r\n")
+	if replication.primaryAddr == "" {
+		sb.WriteString("role:master\r\n")
+		sb.WriteString(fmt.Sprintf("connected_slaves:%d\r\n", len(replication.replicas)))
+		index := 0
+		for replicaAddr, offset := range replication.replicas {
+			sb.WriteString(fmt.Sprintf("slave%d:addr=%s,offset=%d\r\n", index, replicaAddr, offset))
+			index++
+		}
+		sb.WriteString(fmt.Sprintf("master_repl_offset:%d\r\n", logSize()))
+	} else {
+		linkStatus := "down"
+		if replication.linkUp {
+			linkStatus = "up"
+		}
+		sb.WriteString("role:slave\r\n")
+		sb.WriteString(fmt.Sprintf("master_addr:%s\r\n", replication.primaryAddr))
+		sb.WriteString(fmt.Sprintf("master_link_status:%s\r\n", linkStatus))
+		sb.WriteString(fmt.Sprintf("slave_repl_offset:%d\r\n", replication.offset))
+	}
+	return sb.String()
+}
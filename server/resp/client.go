@@ -0,0 +1,167 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error reply sent back by the server
+type Error string
+
+func (err Error) Error() string {
+	return string(err)
+}
+
+// Minimal RESP client, used by OttoDB to talk to other OttoDB servers.
+// Replies are decoded into string (simple strings), []byte (bulk strings),
+// int64, nil, and []interface{} (arrays). Error replies are returned as Error.
+type Client struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+func Dial(addr string) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}
+}
+
+// Dials addr and authenticates as user, unless password is empty
+func DialAuth(addr string, user string, password string) (*Client, error) {
+	client, err := Dial(addr)
+	if err != nil || password == "" {
+		return client, err
+	}
+	if err := client.Auth(user, password); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (client *Client) Auth(user string, password string) error {
+	_, err := client.Do("AUTH", user, password)
+	return err
+}
+
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+// Sends a command and waits for its reply
+func (client *Client) Do(args ...string) (interface{}, error) {
+	if err := client.Send(args...); err != nil {
+		return nil, err
+	}
+	return client.Receive()
+}
+
+// Sends a command without waiting for a reply
+func (client *Client) Send(args ...string) error {
+	fmt.Fprintf(client.writer, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(client.writer, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return client.writer.Flush()
+}
+
+// Reads the next reply from the server
+func (client *Client) Receive() (interface{}, error) {
+	line, err := client.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid bulk length: %v", err)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		bulk := make([]byte, size+2)
+		if _, err := io.ReadFull(client.reader, bulk); err != nil {
+			return nil, err
+		}
+		return bulk[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid array length: %v", err)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, count)
+		for i := range array {
+			array[i], err = client.Receive()
+			// Errors nested in an array are values, not a failed reply
+			if _, isError := err.(Error); err != nil && !isError {
+				return nil, err
+			} else if isError {
+				array[i] = err
+			}
+		}
+		return array, nil
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", line[0])
+	}
+}
+
+func (client *Client) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errors.New("reply line is not terminated by CRLF")
+	}
+	return line[:len(line)-2], nil
+}
+
+// Converts a simple or bulk string reply to a string
+func String(reply interface{}) (string, error) {
+	switch value := reply.(type) {
+	case string:
+		return value, nil
+	case []byte:
+		return string(value), nil
+	default:
+		return "", fmt.Errorf("unexpected reply %v, expected a string", reply)
+	}
+}
+
+// Converts an integer reply to an int64
+func Int64(reply interface{}) (int64, error) {
+	switch value := reply.(type) {
+	case int64:
+		return value, nil
+	case []byte:
+		return strconv.ParseInt(string(value), 10, 64)
+	default:
+		return 0, fmt.Errorf("unexpected reply %v, expected an integer", reply)
+	}
+}
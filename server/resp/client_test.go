@@ -0,0 +1,92 @@
+package resp
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestDoDecodesReplies(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		// Skip the request: *1 $4 PING
+		for i := 0; i < 3; i++ {
+			reader.ReadString('\n')
+		}
+		serverConn.Write([]byte("*4\r\n$5\r\nvalue\r\n:42\r\n$-1\r\n-ERR nested\r\n"))
+	}()
+
+	reply, err := client.Do("PING")
+	if err != nil {
+		t.Fatal(err)
+	}
+	array, ok := reply.([]interface{})
+	if !ok || len(array) != 4 {
+		t.Fatalf("expected an array of 4 replies, got %v", reply)
+	}
+	if value, _ := String(array[0]); value != "value" {
+		t.Errorf("expected bulk string value, got %v", array[0])
+	}
+	if number, _ := Int64(array[1]); number != 42 {
+		t.Errorf("expected integer 42, got %v", array[1])
+	}
+	if array[2] != nil {
+		t.Errorf("expected null bulk string, got %v", array[2])
+	}
+	if err, isError := array[3].(Error); !isError || err.Error() != "ERR nested" {
+		t.Errorf("expected nested error, got %v", array[3])
+	}
+}
+
+func TestErrorReply(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		for i := 0; i < 3; i++ {
+			reader.ReadString('\n')
+		}
+		serverConn.Write([]byte("-READONLY replica\r\n"))
+	}()
+
+	if _, err := client.Do("SET"); err == nil || err.Error() != "READONLY replica" {
+		t.Errorf("expected READONLY error, got %v", err)
+	}
+}
+
+func TestAuthSendsUserAndPassword(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	client := NewClient(clientConn)
+	defer client.Close()
+
+	received := make(chan []string, 1)
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		// *3 then a length and a value per argument
+		lines := make([]string, 0)
+		for i := 0; i < 7; i++ {
+			line, _ := reader.ReadString('\n')
+			lines = append(lines, line)
+		}
+		received <- lines
+		serverConn.Write([]byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n"))
+	}()
+
+	err := client.Auth("alice", "secret")
+	if _, isError := err.(Error); !isError {
+		t.Errorf("expected the WRONGPASS error reply, got %v", err)
+	}
+	lines := <-received
+	if lines[2] != "AUTH\r\n" || lines[4] != "alice\r\n" || lines[6] != "secret\r\n" {
+		t.Errorf("expected AUTH alice secret, got %q", lines)
+	}
+}
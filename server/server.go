@@ -1,20 +1,21 @@
 package main
 
 import (
+	"OttoDB/server/hlc"
+	"OttoDB/server/raft"
+	"OttoDB/server/store"
 	"OttoDB/server/store/binTree"
 	"OttoDB/server/transactionManagers"
-	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"net"
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
 	"strings"
-	"sync/atomic"
-
-	"github.com/golang/protobuf/proto"
+	"time"
 
 	"github.com/tidwall/redcon"
 )
@@ -25,41 +26,125 @@ type operation struct {
 	value string
 }
 
-type store interface {
-	Get() string
-	Set() string
-	Del() string
-}
-
 type length int64
 
 var (
-	tree               = binTree.NewTree()
-	transactionID      = uint64(1)
-	transactionManager = transactionManagers.NewClientMap()
-	activeTransactions = transactionManagers.NewActiveTxnMap()
-	transactionMap     = NewTransactionMap()
-	endianness         = binary.LittleEndian
+	tree               store.Engine = binTree.NewTreeWithLogger(logger)
+	clock                           = hlc.NewClock() // Hands out the txIDs, which are the MVCC timestamps
+	transactionManager              = transactionManagers.NewClientMap()
+	activeTransactions              = transactionManagers.NewActiveTxnMap()
+	transactionMap                  = NewTransactionMap()
+	endianness                      = binary.LittleEndian
 )
 
-const walPath = "./store.pb"
+// Name of the log in the data directory, and its path once settings are loaded
+const walName = "store.pb"
+
+var walPath = walName
+
 const sizeOfLength = 8
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "recover":
+			os.Exit(runRecover(os.Args[2:]))
+		case "restore":
+			os.Exit(runRestore(os.Args[2:]))
+		case "export":
+			os.Exit(runExport(os.Args[2:]))
+		case "import":
+			os.Exit(runImport(os.Args[2:]))
+		}
+	}
+	if err := loadSettings(os.Args[1:]); err != nil {
+		fatal("could not load settings", err)
+	}
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	addr := ":8080"
 
-	lastTxn, err := replayLog(tree)
+	replayFrom, err := openEngine()
 	if err != nil {
-		fmt.Printf("Error while replaying log: %v", err)
+		fatal("could not open engine", err)
+	}
+	// Starting without the log's data, and then appending to a log it couldn't read,
+	// would lose it for good
+	lastTxn, err := replayLog(tree, replayFrom)
+	if err != nil {
+		fatal("could not replay log", err)
+	}
+	if err := clock.Update(lastTxn); err != nil {
+		fatal("log is ahead of the system clock", err)
+	}
+	if diskEngine != nil {
+		go flushEngine()
+	}
+
+	go syncLogEverySecond()
+	go publishKeyspaceEvents()
+
+	if err := resumeReplication(); err != nil {
+		logger.Error("could not resume replication", "err", err)
+	}
+
+	if *raftID != "" {
+		if err := startRaft(); err != nil {
+			fatal("could not start raft", err)
+		}
+	}
+
+	if *clusterID != "" {
+		if err := startCluster(); err != nil {
+			fatal("could not start cluster", err)
+		}
+	}
+
+	if err := startMetrics(); err != nil {
+		fatal("could not serve metrics", err)
 	}
-	transactionID = lastTxn + 1
 
-	err = redcon.ListenAndServe(addr,
+	err = serveClients(
 		func(conn redcon.Conn, cmd redcon.Command) {
+			extendClientTimeout(conn)
+			touchClient(conn, strings.ToLower(string(cmd.Args[0])))
+			start := time.Now()
+			defer countCommand(commandLabel(strings.ToLower(string(cmd.Args[0]))), start)
 
 			client := conn.NetConn().RemoteAddr().String()
 
+			if err := checkACL(conn, cmd); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			if writeCommands[strings.ToLower(string(cmd.Args[0]))] && isReplica() {
+				conn.WriteError("READONLY You can't write against a read only replica.")
+				return
+			}
+			if err := checkRaftLeader(strings.ToLower(string(cmd.Args[0]))); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			if err := checkClusterSlot(client, cmd); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			if keyedCommands[strings.ToLower(string(cmd.Args[0]))] && len(cmd.Args) > 1 && isReservedKey(string(cmd.Args[1])) {
+				conn.WriteError("ERR keys starting with \\x00idx: are reserved for indexes")
+				return
+			}
+
+			// TXN and CLIENT can abort other clients' txns, so they don't hold their own
+			if command := strings.ToLower(string(cmd.Args[0])); command != "txn" && command != "client" {
+				defer lockClientTxn(conn)()
+				if abortedTxID := takeAbortedTxn(conn, command); abortedTxID != 0 {
+					if command == "abort" {
+						conn.WriteString("OK")
+						return
+					}
+					conn.WriteError(fmt.Sprintf("Txn Aborted: txn %d was aborted by another client", abortedTxID))
+					return
+				}
+			}
+
 			// Start Transaction, get txID
 			transactionManager.RLock()
 			txID, inTransaction := transactionManager.Transactions[client]
@@ -68,20 +153,24 @@ func main() {
 			var transaction Transaction
 			var singleRunTxn bool
 			if !inTransaction {
-				// Give new transaction a new transaction id
-				txID = atomic.AddUint64(&transactionID, 1)
-				fmt.Printf("Got a request from a non-transactioned client: %d\n", txID)
+				// Give new transaction a new transaction id. It's active as soon as it has
+				// one, so ASOF reads can't miss it.
+				activeTransactions.Lock()
+				txID = clock.Now()
+				activeTransactions.ActiveTransactions[txID] = true
+				activeTransactions.Unlock()
 				singleRunTxn = true
 				// Create a transaction obj for single run txn
 				transaction = NewTransaction(txID)
 			} else {
-				fmt.Printf("Got a request from a transactioned client: %d\n", txID)
 				singleRunTxn = false
 				// Grab the current txn obj for the txn
 				transactionMap.RLock()
 				transaction = transactionMap.Transactions[txID]
 				transactionMap.RUnlock()
 			}
+			logger.Debug("request", "client", client, "txid", txID, "command", strings.ToLower(string(cmd.Args[0])), "in_txn", !singleRunTxn)
+			defer observeCommand(conn, cmd, txID, start)
 			activeTransactions.Lock()
 			activeTransactions.ActiveTransactions[txID] = true
 			activeTransactions.Unlock()
@@ -89,10 +178,20 @@ func main() {
 			activeTransactions.RLock()
 			activeTxdSnapshot := shapshotActiveTransactions(activeTransactions.ActiveTransactions)
 			activeTransactions.RUnlock()
+			if transaction.activeSnapshot != nil {
+				activeTxdSnapshot = transaction.activeSnapshot
+			}
 
 			operation, err := turnToOp(cmd, txID)
-			if err == nil {
-				writeToLog(operation, txID)
+			if err == nil && !transaction.readOnly {
+				if err := writeToLog(operation, txID); err != nil {
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
 			}
 
 			switch strings.ToLower(string(cmd.Args[0])) {
@@ -114,11 +213,16 @@ func main() {
 					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 					return
 				}
+				if transaction.readOnly {
+					conn.WriteError("ERR cannot write in a read only transaction")
+					return
+				}
 
 				expiredRecord, err := tree.Expire(string(cmd.Args[1]), txID, activeTxdSnapshot)
 				if err != nil {
 					writeAbortToLog(txID)
 					transaction.Abort()
+					countAbort(err)
 					removeTxnData(txID, activeTransactions)
 					removeClientData(client, transactionManager)
 					conn.WriteError("Txn Aborted: " + err.Error())
@@ -132,14 +236,34 @@ func main() {
 				if err != nil {
 					writeAbortToLog(txID)
 					transaction.Abort()
+					countAbort(err)
 					removeTxnData(txID, activeTransactions)
 					removeClientData(client, transactionManager)
 					conn.WriteError("Txn Aborted: " + err.Error())
 					return
 				}
 				transaction.insertedRecords = append(transaction.insertedRecords, insertedRecord)
+				transaction.keys = append(transaction.keys, string(cmd.Args[1]))
+
+				if err := updateIndexes(&transaction, string(cmd.Args[1]), expiredValue(expiredRecord), string(cmd.Args[2]), activeTxdSnapshot); err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
 
 				if singleRunTxn {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
 					activeTransactions.Lock()
 					delete(activeTransactions.ActiveTransactions, txID)
 					activeTransactions.Unlock()
@@ -151,13 +275,37 @@ func main() {
 				conn.WriteString("OK")
 
 			case "get":
-				if len(cmd.Args) != 2 {
+				if len(cmd.Args) != 2 && len(cmd.Args) != 4 {
 					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 					return
 				}
-				keyVal, err := tree.Get(string(cmd.Args[1]), txID, activeTxdSnapshot)
+
+				var keyVal string
+				if len(cmd.Args) == 4 || transaction.asOf != 0 {
+					asOf := transaction.asOf
+					if len(cmd.Args) == 4 {
+						if strings.ToLower(string(cmd.Args[2])) != "asof" {
+							if singleRunTxn {
+								removeTxnData(txID, activeTransactions)
+							}
+							conn.WriteError("ERR syntax error")
+							return
+						}
+						asOf, err = parseAsOf(string(cmd.Args[3]), txID)
+						if err != nil {
+							if singleRunTxn {
+								removeTxnData(txID, activeTransactions)
+							}
+							conn.WriteError(err.Error())
+							return
+						}
+					}
+					keyVal, err = tree.GetAsOf(string(cmd.Args[1]), asOf, activeTxdSnapshot)
+				} else {
+					keyVal, err = tree.Get(string(cmd.Args[1]), txID, activeTxdSnapshot)
+				}
 				if err != nil {
-					fmt.Print(err)
+					logger.Debug("no value to read", "client", client, "txid", txID, "key", string(cmd.Args[1]), "err", err)
 					conn.WriteNull()
 					return
 				} else if singleRunTxn {
@@ -167,23 +315,149 @@ func main() {
 				}
 				conn.WriteString(keyVal)
 
+			case "getv":
+				if len(cmd.Args) != 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				var keyVal string
+				var version uint64
+				if transaction.asOf != 0 {
+					keyVal, version, err = tree.GetVersionAsOf(string(cmd.Args[1]), transaction.asOf, activeTxdSnapshot)
+				} else {
+					keyVal, version, err = tree.GetVersion(string(cmd.Args[1]), txID, activeTxdSnapshot)
+				}
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if err != nil {
+					logger.Debug("no value to read", "client", client, "txid", txID, "key", string(cmd.Args[1]), "err", err)
+					conn.WriteNull()
+					return
+				}
+				conn.WriteArray(2)
+				conn.WriteBulkString(keyVal)
+				conn.WriteInt64(int64(version))
+
+			case "cas":
+				if len(cmd.Args) != 4 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if transaction.readOnly {
+					conn.WriteError("ERR cannot write in a read only transaction")
+					return
+				}
+				expectedVersion, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+				if err != nil {
+					conn.WriteError("ERR version is not an integer or out of range")
+					return
+				}
+
+				expiredRecord, insertedRecord, err := tree.CompareAndSet(string(cmd.Args[1]), expectedVersion, string(cmd.Args[3]), txID, activeTxdSnapshot)
+				if err == binTree.ErrVersionMismatch {
+					// Nothing was written, so the transaction stays usable
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("VERSIONMISMATCH " + err.Error())
+					return
+				} else if err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+
+				if expiredRecord != nil {
+					transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+				}
+				transaction.insertedRecords = append(transaction.insertedRecords, insertedRecord)
+				transaction.keys = append(transaction.keys, string(cmd.Args[1]))
+
+				// Only log the write once the version check has passed
+				err = writeToLog(&Operation{
+					TxID:  txID,
+					Op:    "set",
+					Key:   string(cmd.Args[1]),
+					Value: string(cmd.Args[3]),
+				}, txID)
+				if err == nil {
+					err = updateIndexes(&transaction, string(cmd.Args[1]), expiredValue(expiredRecord), string(cmd.Args[3]), activeTxdSnapshot)
+				}
+				if err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+
+				if singleRunTxn {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
+					removeTxnData(txID, activeTransactions)
+				}
+
+				transactionMap.Lock()
+				transactionMap.Transactions[transaction.timestamp] = transaction
+				transactionMap.Unlock()
+				conn.WriteString("OK")
+
 			case "del":
 				if len(cmd.Args) != 2 {
 					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 					return
 				}
+				if transaction.readOnly {
+					conn.WriteError("ERR cannot write in a read only transaction")
+					return
+				}
 				expiredRecord, err := tree.Expire(string(cmd.Args[1]), txID, activeTxdSnapshot)
 				if err != nil {
 					writeAbortToLog(txID)
 					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+				if expiredRecord != nil {
+					transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
+				}
+				transaction.keys = append(transaction.keys, string(cmd.Args[1]))
+
+				if err := updateIndexes(&transaction, string(cmd.Args[1]), expiredValue(expiredRecord), "", activeTxdSnapshot); err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
 					removeTxnData(txID, activeTransactions)
 					removeClientData(client, transactionManager)
 					conn.WriteError("Txn Aborted: " + err.Error())
 					return
 				}
-				transaction.deletedRecords = append(transaction.deletedRecords, expiredRecord)
 
 				if singleRunTxn {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
 					activeTransactions.Lock()
 					defer activeTransactions.Unlock()
 					delete(activeTransactions.ActiveTransactions, txID)
@@ -194,7 +468,206 @@ func main() {
 				transactionMap.Unlock()
 				conn.WriteString("OK")
 
+			case "json.set":
+				// JSON.SET key path value
+				if len(cmd.Args) != 4 {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if transaction.readOnly {
+					conn.WriteError("ERR cannot write in a read only transaction")
+					return
+				}
+
+				var current *string
+				if keyVal, err := tree.Get(string(cmd.Args[1]), txID, activeTxdSnapshot); err == nil {
+					current = &keyVal
+				}
+				patch := jsonPatch{Path: string(cmd.Args[2]), Value: json.RawMessage(cmd.Args[3])}
+				newValue, err := applyJSONPatch("json.set", current, patch)
+				if err != nil {
+					// Nothing was written, so the transaction stays usable
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("ERR " + err.Error())
+					return
+				}
+				loggedPatch, err := json.Marshal(patch)
+				if err == nil {
+					err = writeJSONValue(&transaction, string(cmd.Args[1]), newValue, &Operation{TxID: txID, Op: "json.set", Key: string(cmd.Args[1]), Value: string(loggedPatch)}, activeTxdSnapshot)
+				}
+				if err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+
+				if singleRunTxn {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
+					removeTxnData(txID, activeTransactions)
+				}
+
+				transactionMap.Lock()
+				transactionMap.Transactions[transaction.timestamp] = transaction
+				transactionMap.Unlock()
+				conn.WriteString("OK")
+
+			case "json.get":
+				// JSON.GET key [path]
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				keyVal, err := visibleValue(string(cmd.Args[1]), txID, transaction.asOf, activeTxdSnapshot)
+				if err != nil {
+					conn.WriteNull()
+					return
+				}
+				path := "$"
+				if len(cmd.Args) == 3 {
+					path = string(cmd.Args[2])
+				}
+				found, err := jsonAt(keyVal, path)
+				if err == errJSONPathMissing {
+					conn.WriteNull()
+					return
+				} else if err != nil {
+					conn.WriteError("ERR " + err.Error())
+					return
+				}
+				conn.WriteBulkString(found)
+
+			case "json.del":
+				// JSON.DEL key [path], replies with the number of values deleted
+				if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if transaction.readOnly {
+					conn.WriteError("ERR cannot write in a read only transaction")
+					return
+				}
+
+				keyVal, err := tree.Get(string(cmd.Args[1]), txID, activeTxdSnapshot)
+				if err != nil {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteInt(0)
+					return
+				}
+				// Deleting the root deletes the key
+				operation := &Operation{TxID: txID, Op: "del", Key: string(cmd.Args[1])}
+				newValue := ""
+				if len(cmd.Args) == 3 && string(cmd.Args[2]) != "$" {
+					patch := jsonPatch{Path: string(cmd.Args[2])}
+					newValue, err = applyJSONPatch("json.del", &keyVal, patch)
+					if err != nil {
+						if singleRunTxn {
+							removeTxnData(txID, activeTransactions)
+						}
+						if err == errJSONPathMissing {
+							conn.WriteInt(0)
+						} else {
+							conn.WriteError("ERR " + err.Error())
+						}
+						return
+					}
+					loggedPatch, _ := json.Marshal(patch)
+					operation = &Operation{TxID: txID, Op: "json.del", Key: string(cmd.Args[1]), Value: string(loggedPatch)}
+				}
+				if err := writeJSONValue(&transaction, string(cmd.Args[1]), newValue, operation, activeTxdSnapshot); err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					removeClientData(client, transactionManager)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+
+				if singleRunTxn {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
+					removeTxnData(txID, activeTransactions)
+				}
+
+				transactionMap.Lock()
+				transactionMap.Transactions[transaction.timestamp] = transaction
+				transactionMap.Unlock()
+				conn.WriteInt(1)
+
 			case "begin":
+				// BEGIN [READ ONLY [ASOF txid|time]]
+				if len(cmd.Args) != 1 && len(cmd.Args) != 3 && len(cmd.Args) != 5 {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if len(cmd.Args) >= 3 {
+					if strings.ToLower(string(cmd.Args[1])) != "read" || strings.ToLower(string(cmd.Args[2])) != "only" {
+						if singleRunTxn {
+							removeTxnData(txID, activeTransactions)
+						}
+						conn.WriteError("ERR syntax error")
+						return
+					}
+					transaction.readOnly = true
+				}
+				if len(cmd.Args) == 5 {
+					if strings.ToLower(string(cmd.Args[3])) != "asof" {
+						if singleRunTxn {
+							removeTxnData(txID, activeTransactions)
+						}
+						conn.WriteError("ERR syntax error")
+						return
+					}
+					transaction.asOf, err = parseAsOf(string(cmd.Args[4]), txID)
+					if err != nil {
+						if singleRunTxn {
+							removeTxnData(txID, activeTransactions)
+						}
+						conn.WriteError(err.Error())
+						return
+					}
+				}
+				if transaction.readOnly {
+					// Every read sees the same snapshot, so nothing committed later shows up
+					if transaction.asOf == 0 {
+						transaction.asOf = txID
+					}
+					transaction.activeSnapshot = activeTxdSnapshot
+				}
+
 				transactionManager.Lock()
 				defer transactionManager.Unlock()
 				transactionManager.Transactions[client] = txID
@@ -206,6 +679,42 @@ func main() {
 				conn.WriteString("OK")
 
 			case "commit":
+				// COMMIT PREPARED gid, second phase of a two-phase commit
+				if len(cmd.Args) > 1 {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					if len(cmd.Args) != 3 || strings.ToLower(string(cmd.Args[1])) != "prepared" {
+						conn.WriteError("ERR syntax error")
+						return
+					}
+					if !singleRunTxn {
+						conn.WriteError("ERR COMMIT PREPARED cannot run inside a transaction")
+						return
+					}
+					if isReplica() {
+						conn.WriteError("READONLY You can't write against a read only replica.")
+						return
+					}
+					if err := commitPrepared(string(cmd.Args[2])); err != nil {
+						conn.WriteError(err.Error())
+						return
+					}
+					conn.WriteString("OK")
+					return
+				}
+				if !singleRunTxn && !transaction.readOnly {
+					if err := writeCommitToLog(txID); err != nil {
+						writeAbortToLog(txID)
+						transaction.Abort()
+						countAbort(err)
+						removeTxnData(txID, activeTransactions)
+						removeClientData(client, transactionManager)
+						conn.WriteError("Txn Aborted: " + err.Error())
+						return
+					}
+				}
+
 				activeTransactions.Lock()
 				defer activeTransactions.Unlock()
 				delete(activeTransactions.ActiveTransactions, txID)
@@ -213,46 +722,657 @@ func main() {
 				transactionManager.Lock()
 				defer transactionManager.Unlock()
 				delete(transactionManager.Transactions, client)
+				if !singleRunTxn {
+					observeTxn(client, clientName(conn), txID, "COMMIT")
+				}
 				conn.WriteString("OK")
 
-			case "print":
-				nodeTimeStamps := tree.RecordListPrint(string(cmd.Args[1]))
-				conn.WriteString(nodeTimeStamps)
-
-			case "txnprint":
-				conn.WriteString(transaction.String())
-
-			case "abort":
-				writeAbortToLog(txID)
-				// Abort the txn
-				transaction.Abort()
-
-				// Remove txn from active txns and client mapping txns
-				removeTxnData(txID, activeTransactions)
+			case "prepare":
+				// PREPARE gid, first phase of a two-phase commit. The txn is handed off from
+				// this client, to be finished by COMMIT PREPARED or ROLLBACK PREPARED.
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if singleRunTxn || transaction.readOnly {
+					conn.WriteError("ERR PREPARE can only be used in a read write transaction")
+					return
+				}
+				if err := prepareTxn(string(cmd.Args[1]), txID); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
 				removeClientData(client, transactionManager)
+				conn.WriteString("OK")
 
-				conn.WriteError("Aborted txn from manual client call")
-
-			case "printw":
-				if err := printWal(); err != nil {
-					fmt.Printf(err.Error())
+			case "rollback":
+				// ROLLBACK PREPARED gid. Unprepared txns are rolled back with ABORT.
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
 				}
-			}
-		},
-		func(conn redcon.Conn) bool {
-			// use this function to accept or deny the connection.
-			log.Printf("accept: %s", conn.RemoteAddr())
-			return true
-		},
-		func(conn redcon.Conn, err error) {
-			// this is called when the connection has been closed
-			log.Printf("closed: %s, err: %v", conn.RemoteAddr(), err)
-		},
-	)
-	if err != nil {
-		log.Fatal(err)
-	}
-}
+				if len(cmd.Args) != 3 || strings.ToLower(string(cmd.Args[1])) != "prepared" {
+					conn.WriteError("ERR syntax error")
+					return
+				}
+				if !singleRunTxn {
+					conn.WriteError("ERR ROLLBACK PREPARED cannot run inside a transaction")
+					return
+				}
+				if err := rollbackPrepared(string(cmd.Args[2])); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "prepared":
+				// Lists the prepared txns waiting for their coordinator as [gid, txid] pairs
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				gids, txIDs := listPrepared()
+				conn.WriteArray(len(gids))
+				for _, gid := range gids {
+					conn.WriteArray(2)
+					conn.WriteBulkString(gid)
+					conn.WriteInt64(int64(txIDs[gid]))
+				}
+
+			case "keys":
+				if len(cmd.Args) != 2 {
+					if singleRunTxn {
+						removeTxnData(txID, activeTransactions)
+					}
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				keys := accessibleKeys(conn, visibleKeys(string(cmd.Args[1]), txID, transaction.asOf, activeTxdSnapshot))
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				conn.WriteArray(len(keys))
+				for _, key := range keys {
+					conn.WriteBulkString(key)
+				}
+
+			case "create":
+				// CREATE INDEX name ON prefix USING JSONPATH path
+				if inTransaction {
+					conn.WriteError("ERR CREATE INDEX is not allowed inside a transaction")
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+				if len(cmd.Args) != 8 || strings.ToLower(string(cmd.Args[1])) != "index" || strings.ToLower(string(cmd.Args[3])) != "on" ||
+					strings.ToLower(string(cmd.Args[5])) != "using" || strings.ToLower(string(cmd.Args[6])) != "jsonpath" {
+					conn.WriteError("ERR syntax error, expected CREATE INDEX name ON prefix USING JSONPATH path")
+					return
+				}
+				if *clusterID != "" {
+					conn.WriteError("ERR indexes are not supported in cluster mode")
+					return
+				}
+				def, err := parseIndexDef(string(cmd.Args[2]), string(cmd.Args[4]), string(cmd.Args[7]))
+				if err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				if err := createIndex(def); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "drop":
+				// DROP INDEX name
+				if inTransaction {
+					conn.WriteError("ERR DROP INDEX is not allowed inside a transaction")
+					return
+				}
+				if len(cmd.Args) != 3 || strings.ToLower(string(cmd.Args[1])) != "index" {
+					removeTxnData(txID, activeTransactions)
+					conn.WriteError("ERR syntax error, expected DROP INDEX name")
+					return
+				}
+				if err := dropIndex(&transaction, string(cmd.Args[2]), activeTxdSnapshot); err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					conn.WriteError(err.Error())
+					return
+				}
+				if err := writeCommitToLog(txID); err != nil {
+					writeAbortToLog(txID)
+					transaction.Abort()
+					countAbort(err)
+					removeTxnData(txID, activeTransactions)
+					conn.WriteError("Txn Aborted: " + err.Error())
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+				markIndexesStale()
+				conn.WriteString("OK")
+
+			case "find":
+				// FIND index value
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				keys, err := findIndexed(string(cmd.Args[1]), string(cmd.Args[2]), txID, transaction.asOf, activeTxdSnapshot)
+				if err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				keys = accessibleKeys(conn, keys)
+				conn.WriteArray(len(keys))
+				for _, key := range keys {
+					conn.WriteBulkString(key)
+				}
+
+			case "backup":
+				// BACKUP path, replies with the txid the backup is consistent at
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				snapshotTxID, err := backupTo(string(cmd.Args[1]))
+				if err != nil {
+					conn.WriteError("ERR " + err.Error())
+					return
+				}
+				conn.WriteInt64(int64(snapshotTxID))
+
+			case "print":
+				nodeTimeStamps := tree.RecordListPrint(string(cmd.Args[1]))
+				conn.WriteString(nodeTimeStamps)
+
+			case "history":
+				// HISTORY key [LIMIT n] [WITHABORTED]
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				// Only reads from the snapshot, so a single run txn is already done
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+
+				limit := -1
+				withAborted := false
+				for i := 2; i < len(cmd.Args); i++ {
+					switch strings.ToLower(string(cmd.Args[i])) {
+					case "limit":
+						if i+1 == len(cmd.Args) {
+							conn.WriteError("ERR syntax error")
+							return
+						}
+						limit, err = strconv.Atoi(string(cmd.Args[i+1]))
+						if err != nil || limit < 0 {
+							conn.WriteError("ERR LIMIT is not a non-negative integer")
+							return
+						}
+						i++
+					case "withaborted":
+						withAborted = true
+					default:
+						conn.WriteError("ERR syntax error")
+						return
+					}
+				}
+				history := make([]binTree.Record, 0)
+				for _, record := range tree.History(string(cmd.Args[1])) {
+					if limit >= 0 && len(history) == limit {
+						break
+					}
+					if record.Status == binTree.Aborted && !withAborted {
+						continue
+					}
+					history = append(history, record)
+				}
+
+				conn.WriteArray(len(history))
+				for _, record := range history {
+					conn.WriteArray(10)
+					conn.WriteBulkString("value")
+					conn.WriteBulkString(record.Value)
+					conn.WriteBulkString("created-by")
+					conn.WriteInt64(int64(record.CreatedBy))
+					conn.WriteBulkString("created-at")
+					conn.WriteBulkString(hlc.Time(record.CreatedBy).UTC().Format(time.RFC3339Nano))
+					conn.WriteBulkString("expired-by")
+					conn.WriteInt64(int64(record.ExpiredBy))
+					conn.WriteBulkString("status")
+					conn.WriteBulkString(record.CreatorStatus(activeTxdSnapshot).String())
+				}
+
+			case "txnprint":
+				conn.WriteString(transaction.String())
+
+			case "abort":
+				writeAbortToLog(txID)
+				// Abort the txn
+				transaction.Abort()
+				txnAborts.Inc("client")
+
+				// Remove txn from active txns and client mapping txns
+				removeTxnData(txID, activeTransactions)
+				removeClientData(client, transactionManager)
+				if !singleRunTxn {
+					observeTxn(client, clientName(conn), txID, "ABORT")
+				}
+
+				conn.WriteError("Aborted txn from manual client call")
+
+			case "cdc":
+				// CDC FROM txid
+				if len(cmd.Args) != 3 || strings.ToLower(string(cmd.Args[1])) != "from" {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				fromTxID, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+				if err != nil {
+					conn.WriteError("ERR txid is not an integer or out of range")
+					return
+				}
+				if !singleRunTxn {
+					conn.WriteError("ERR CDC is not allowed inside a transaction")
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+				clearClientTimeout(conn)
+				go streamChanges(conn.Detach(), fromTxID)
+
+			case "publish":
+				if len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				conn.WriteInt(pubsub.Publish(string(cmd.Args[1]), string(cmd.Args[2])))
+
+			case "subscribe", "psubscribe":
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if !singleRunTxn {
+					conn.WriteError("ERR " + string(cmd.Args[0]) + " is not allowed inside a transaction")
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+				command := strings.ToLower(string(cmd.Args[0]))
+				for _, channel := range cmd.Args[1:] {
+					if err := checkChannelACL(conn, string(channel), command == "psubscribe"); err != nil {
+						conn.WriteError(err.Error())
+						return
+					}
+				}
+
+				// The connection is detached into subscriber mode after the first channel
+				clearClientTimeout(conn)
+				for _, channel := range cmd.Args[1:] {
+					if command == "subscribe" {
+						pubsub.Subscribe(conn, string(channel))
+					} else {
+						pubsub.Psubscribe(conn, string(channel))
+					}
+				}
+
+			case "replicaof":
+				// REPLICAOF host port, or REPLICAOF NO ONE
+				if len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if !singleRunTxn {
+					conn.WriteError("ERR REPLICAOF is not allowed inside a transaction")
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+
+				if raftNode != nil {
+					conn.WriteError("ERR REPLICAOF is not available when running with raft")
+					return
+				}
+				if strings.ToLower(string(cmd.Args[1])) == "no" && strings.ToLower(string(cmd.Args[2])) == "one" {
+					err = stopReplication()
+				} else {
+					err = startReplication(net.JoinHostPort(string(cmd.Args[1]), string(cmd.Args[2])))
+				}
+				if err != nil {
+					conn.WriteError("ERR " + err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "replsync":
+				// Sent by a replica to stream this node's log from an offset
+				if len(cmd.Args) != 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				offset, err := strconv.ParseInt(string(cmd.Args[1]), 10, 64)
+				if err != nil || offset < 0 {
+					conn.WriteError("ERR offset is not a valid log offset")
+					return
+				}
+				if !singleRunTxn {
+					conn.WriteError("ERR REPLSYNC is not allowed inside a transaction")
+					return
+				}
+				removeTxnData(txID, activeTransactions)
+				clearClientTimeout(conn)
+				go serveReplica(conn.Detach(), offset)
+
+			case "info":
+				if len(cmd.Args) > 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				section := "default"
+				if len(cmd.Args) == 2 {
+					section = strings.ToLower(string(cmd.Args[1]))
+				}
+				conn.WriteBulkString(serverInfo(section))
+
+			case "raft":
+				// RAFT STATUS | RAFT ADD id addr | RAFT REMOVE id
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if raftNode == nil {
+					conn.WriteError("ERR raft is not enabled")
+					return
+				}
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				switch strings.ToLower(string(cmd.Args[1])) {
+				case "status":
+					conn.WriteBulkString(raftInfo())
+				case "add":
+					if len(cmd.Args) != 4 {
+						conn.WriteError("ERR wrong number of arguments for 'raft add' command")
+						return
+					}
+					if err := raftNode.AddMember(raft.Member{ID: string(cmd.Args[2]), Addr: string(cmd.Args[3])}); err != nil {
+						conn.WriteError("ERR " + err.Error())
+						return
+					}
+					conn.WriteString("OK")
+				case "remove":
+					if len(cmd.Args) != 3 {
+						conn.WriteError("ERR wrong number of arguments for 'raft remove' command")
+						return
+					}
+					if err := raftNode.RemoveMember(string(cmd.Args[2])); err != nil {
+						conn.WriteError("ERR " + err.Error())
+						return
+					}
+					conn.WriteString("OK")
+				default:
+					conn.WriteError("ERR unknown RAFT subcommand '" + string(cmd.Args[1]) + "'")
+				}
+
+			case "auth":
+				// AUTH [username] password
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 2 && len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				user := "default"
+				if len(cmd.Args) == 3 {
+					user = string(cmd.Args[1])
+				}
+				if err := authenticate(conn, user, string(cmd.Args[len(cmd.Args)-1])); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "acl":
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				aclCommand(conn, cmd)
+
+			case "slowlog":
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				slowlogCommand(conn, cmd)
+
+			case "txn":
+				// TXN LIST | TXN SHOW txid | TXN ABORT txid
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				subcommand := strings.ToLower(string(cmd.Args[1]))
+				if subcommand == "list" {
+					conn.WriteBulkString(listTxns())
+					return
+				}
+				if subcommand != "show" && subcommand != "abort" {
+					conn.WriteError("ERR unknown TXN subcommand '" + string(cmd.Args[1]) + "'")
+					return
+				}
+				if len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for 'txn " + subcommand + "' command")
+					return
+				}
+				targetTxID, err := strconv.ParseUint(string(cmd.Args[2]), 10, 64)
+				if err != nil {
+					conn.WriteError("ERR txid is not an integer or out of range")
+					return
+				}
+				if subcommand == "show" {
+					keys, err := txnKeys(targetTxID)
+					if err != nil {
+						conn.WriteError(err.Error())
+						return
+					}
+					conn.WriteArray(len(keys))
+					for _, key := range keys {
+						conn.WriteBulkString(key)
+					}
+					return
+				}
+				if err := abortTxn(targetTxID); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "client":
+				// CLIENT LIST | CLIENT KILL addr | CLIENT KILL ID id | CLIENT KILL ADDR addr |
+				// CLIENT SETNAME name | CLIENT GETNAME | CLIENT ID
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				switch strings.ToLower(string(cmd.Args[1])) {
+				case "list":
+					conn.WriteBulkString(listClients())
+				case "kill":
+					var err error
+					if len(cmd.Args) == 3 {
+						err = killClient("addr", string(cmd.Args[2]))
+					} else if len(cmd.Args) == 4 && (strings.ToLower(string(cmd.Args[2])) == "id" || strings.ToLower(string(cmd.Args[2])) == "addr") {
+						err = killClient(strings.ToLower(string(cmd.Args[2])), string(cmd.Args[3]))
+					} else {
+						conn.WriteError("ERR syntax error")
+						return
+					}
+					if err != nil {
+						conn.WriteError(err.Error())
+						return
+					}
+					if len(cmd.Args) == 3 {
+						conn.WriteString("OK")
+					} else {
+						conn.WriteInt(1)
+					}
+				case "setname":
+					if len(cmd.Args) != 3 {
+						conn.WriteError("ERR wrong number of arguments for 'client setname' command")
+						return
+					}
+					if err := setClientName(conn, string(cmd.Args[2])); err != nil {
+						conn.WriteError(err.Error())
+						return
+					}
+					conn.WriteString("OK")
+				case "getname":
+					if name := clientName(conn); name != "" {
+						conn.WriteBulkString(name)
+					} else {
+						conn.WriteNull()
+					}
+				case "id":
+					conn.WriteInt64(int64(clientID(conn)))
+				default:
+					conn.WriteError("ERR unknown CLIENT subcommand '" + string(cmd.Args[1]) + "'")
+				}
+
+			case "config":
+				// CONFIG GET pattern | CONFIG SET name value
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) < 2 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				switch strings.ToLower(string(cmd.Args[1])) {
+				case "get":
+					if len(cmd.Args) != 3 {
+						conn.WriteError("ERR wrong number of arguments for 'config get' command")
+						return
+					}
+					matched := make([]string, 0)
+					for _, name := range settings.Names() {
+						if matchPattern(strings.ToLower(string(cmd.Args[2])), name) {
+							matched = append(matched, name)
+						}
+					}
+					conn.WriteArray(len(matched) * 2)
+					for _, name := range matched {
+						conn.WriteBulkString(name)
+						conn.WriteBulkString(shownSetting(name))
+					}
+				case "set":
+					if len(cmd.Args) != 4 {
+						conn.WriteError("ERR wrong number of arguments for 'config set' command")
+						return
+					}
+					if err := settings.Set(strings.ToLower(string(cmd.Args[2])), string(cmd.Args[3])); err != nil {
+						conn.WriteError("ERR " + err.Error())
+						return
+					}
+					conn.WriteString("OK")
+				default:
+					conn.WriteError("ERR unknown CONFIG subcommand '" + string(cmd.Args[1]) + "'")
+				}
+
+			case "cluster":
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				clusterCommand(conn, cmd)
+
+			case "asking":
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if clusterSlots == nil {
+					conn.WriteError("ERR This instance has cluster support disabled")
+					return
+				}
+				setAsking(client)
+				conn.WriteString("OK")
+
+			case "migrate":
+				// MIGRATE host port key, moves the key to the node a slot is migrating to
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 4 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				moved, err := migrateKey(net.JoinHostPort(string(cmd.Args[1]), string(cmd.Args[2])), string(cmd.Args[3]))
+				if err != nil {
+					conn.WriteError(err.Error())
+					return
+				} else if !moved {
+					conn.WriteString("NOKEY")
+					return
+				}
+				conn.WriteString("OK")
+
+			case "restoreversions":
+				// Sent by MIGRATE on the node a key is moved from
+				if singleRunTxn {
+					removeTxnData(txID, activeTransactions)
+				}
+				if len(cmd.Args) != 3 {
+					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+					return
+				}
+				if err := restoreVersions(string(cmd.Args[1]), string(cmd.Args[2])); err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				conn.WriteString("OK")
+
+			case "printw":
+				if err := printWal(); err != nil {
+					logger.Error("could not print log", "client", client, "err", err)
+				}
+			}
+		},
+		func(conn redcon.Conn) bool {
+			// use this function to accept or deny the connection.
+			logger.Info("client connected", "client", conn.RemoteAddr())
+			return acceptClient(conn)
+		},
+		func(conn redcon.Conn, err error) {
+			// this is called when the connection has been closed
+			logger.Info("client disconnected", "client", conn.RemoteAddr(), "err", err)
+			clearAsking(conn.RemoteAddr())
+			unregisterClient(conn)
+			clientClosed()
+		},
+	)
+	if err != nil {
+		fatal("could not serve clients", err)
+	}
+}
 
 func shapshotActiveTransactions(supermap map[uint64]bool) map[uint64]bool {
 	resultMap := make(map[uint64]bool)
@@ -262,6 +1382,41 @@ func shapshotActiveTransactions(supermap map[uint64]bool) map[uint64]bool {
 	return resultMap
 }
 
+// Parses the point in time of an ASOF read by txID, either a txID or an RFC 3339 time.
+// Versions are only visible by the txID that wrote them, not by when it committed, so a
+// point before a txn that hasn't finished is refused: the txn could still commit and
+// change what the point shows. Refused points can be read once it finishes, and from
+// then on always read the same. A replica doesn't know which of its primary's txns are
+// in flight, so there reads of recent points can still change.
+// Nothing vacuums old versions yet, so every point back to the start of the log can be
+// read. Vacuuming will have to refuse points older than the versions it keeps.
+func parseAsOf(arg string, txID uint64) (uint64, error) {
+	asOf, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		asOfTime, timeErr := time.Parse(time.RFC3339Nano, arg)
+		if timeErr != nil {
+			return 0, fmt.Errorf("ERR ASOF is not a valid txid or time")
+		}
+		asOf = hlc.FromTime(asOfTime)
+	}
+	if asOf == 0 {
+		return 0, fmt.Errorf("ERR ASOF is not a valid txid or time")
+	}
+	// Last, rather than Now, so checking doesn't advance the clock
+	if asOf > clock.Last() {
+		return 0, fmt.Errorf("ERR ASOF %s is in the future", arg)
+	}
+	for _, active := range activeTxIDs() {
+		if active > asOf {
+			break
+		}
+		if active != txID {
+			return 0, fmt.Errorf("ERR ASOF %s is after txn %d, which hasn't finished yet", arg, active)
+		}
+	}
+	return asOf, nil
+}
+
 func removeClientData(client string, transactionManager *transactionManagers.ClientTxdMap) {
 	transactionManager.Lock()
 	defer transactionManager.Unlock()
@@ -275,23 +1430,24 @@ func removeTxnData(txID uint64, activeTransactions *transactionManagers.ActiveTx
 }
 
 func turnToOp(cmd redcon.Command, txID uint64) (*Operation, error) {
+	// Only writes are logged up front, commits and aborts are logged by their handlers
+	op := strings.ToLower(string(cmd.Args[0]))
+	if op != "set" && op != "del" {
+		return nil, fmt.Errorf("Command is not logged")
+	}
+
 	commandSize := len(cmd.Args)
 	switch commandSize {
-	case 1:
-		return &Operation{
-			TxID: txID,
-			Op:   string(cmd.Args[0]),
-		}, nil
 	case 2:
 		return &Operation{
 			TxID: txID,
-			Op:   string(cmd.Args[0]),
+			Op:   op,
 			Key:  string(cmd.Args[1]),
 		}, nil
 	case 3:
 		return &Operation{
 			TxID:  txID,
-			Op:    string(cmd.Args[0]),
+			Op:    op,
 			Key:   string(cmd.Args[1]),
 			Value: string(cmd.Args[2]),
 		}, nil
@@ -301,31 +1457,25 @@ func turnToOp(cmd redcon.Command, txID uint64) (*Operation, error) {
 }
 
 func writeToLog(operation *Operation, txID uint64) error {
-	b, err := proto.Marshal(operation)
-	if err != nil {
-		return fmt.Errorf("could not encode operation: %v", err)
-	}
-
-	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
-	if err != nil {
-		return fmt.Errorf("could not open %s: %v", walPath, err)
-	}
-
-	if err := binary.Write(f, endianness, length(len(b))); err != nil {
-		return fmt.Errorf("could not enocde length of message: %v", err)
-	}
-	_, err = f.Write(b)
-	if err != nil {
-		return fmt.Errorf("could not write task to file: %v", err)
+	if raftNode != nil {
+		// Raft entries stand on their own, every member chains them into its log as
+		// they're applied
+		frame, err := new(logChain).encode(operation)
+		if err != nil {
+			return err
+		}
+		return proposeToRaft(frame)
 	}
-
-	if err := f.Close(); err != nil {
-		return fmt.Errorf("could not close file %s: %v", walPath, err)
+	if err := startLog(); err != nil {
+		return err
 	}
-	return nil
+	return appendToLog(operation)
 }
 
 func writeAbortToLog(txID uint64) error {
+	if isReplica() {
+		return nil
+	}
 	operation := &Operation{
 		TxID: txID,
 		Op:   "abort",
@@ -339,70 +1489,57 @@ func writeAbortToLog(txID uint64) error {
 }
 
 func printWal() error {
-	b, err := ioutil.ReadFile(walPath)
+	operations, err := readLog(walPath)
 	if err != nil {
-		return fmt.Errorf("could not read %s: %v", walPath, err)
+		return err
 	}
 
-	for {
-		if len(b) == 0 {
-			return nil
-		} else if len(b) < sizeOfLength {
-			return fmt.Errorf("bytes not correct size")
-		}
-
-		var l length
-		if err := binary.Read(bytes.NewReader(b[:sizeOfLength]), endianness, &l); err != nil {
-			return fmt.Errorf("could not decode message length: %v", err)
-		}
-		b = b[sizeOfLength:]
-
-		var operation Operation
-		if err := proto.Unmarshal(b[:l], &operation); err != nil {
-			return fmt.Errorf("Could not read operation: %v", err)
-		}
-		b = b[l:]
-
+	for _, operation := range operations {
 		fmt.Printf("Txn: %d,\tOp: %s\tKey: %s\tVal: %s\n", operation.TxID, operation.Op, operation.Key, operation.Value)
 	}
+	return nil
 }
 
-func replayLog(tree *binTree.BinTree) (uint64, error) {
+// Replays the log from offset, which is where the engine's checkpoint left it
+func replayLog(tree store.Engine, offset int64) (uint64, error) {
+	start := time.Now()
 
 	if _, err := os.Stat(walPath); os.IsNotExist(err) {
 		return 0, nil
 	}
 
-	b, err := ioutil.ReadFile(walPath)
+	if err := truncateTornEntry(walPath); err != nil {
+		return 0, err
+	}
+	entries, err := readLogEntries(walPath, offset)
 	if err != nil {
-		return 0, fmt.Errorf("could not read %s: %v", walPath, err)
+		return 0, err
+	}
+	operations := make([]Operation, 0, len(entries))
+	for _, entry := range entries {
+		operations = append(operations, entry.operation)
 	}
 
 	transactionMap := NewTransactionMap()
 	var lastTxn uint64
+	committed := make(map[uint64]bool)
+	prepared := make(map[uint64]string)
+	lastOpIndex := make(map[uint64]int)
+	firstCommit := len(operations)
+	if offset > 0 {
+		// Only a log written with commits can have a checkpoint
+		firstCommit = -1
+	}
 
-	for {
-		if len(b) == 0 {
-			break
-		} else if len(b) < sizeOfLength {
-			return 0, fmt.Errorf("bytes not correct size")
-		}
-
-		var l length
-		if err := binary.Read(bytes.NewReader(b[:sizeOfLength]), endianness, &l); err != nil {
-			return 0, fmt.Errorf("could not decode message length: %v", err)
-		}
-		b = b[sizeOfLength:]
-
-		var operation Operation
-		if err := proto.Unmarshal(b[:l], &operation); err != nil {
-			return 0, fmt.Errorf("Could not read operation: %v", err)
-		}
-		b = b[l:]
-
+	for index, operation := range operations {
 		// Replaying the txn on the in-memory store
-		fmt.Printf("Txn: %d,\tOp: %s\tKey: %s\tVal: %s\n", operation.TxID, operation.Op, operation.Key, operation.Value)
+		logger.Debug("replaying operation", "txid", operation.TxID, "op", operation.Op, "key", operation.Key)
 
+		if operation.Op == "format" {
+			// Every committed txn in this log has a commit
+			firstCommit = -1
+			continue
+		}
 		if operation.TxID > lastTxn {
 			lastTxn = operation.TxID
 		}
@@ -415,9 +1552,28 @@ func replayLog(tree *binTree.BinTree) (uint64, error) {
 
 		if operation.Op == "abort" {
 			delete(transactionMap.Transactions, operation.TxID)
+		} else if operation.Op == "prepare" {
+			prepared[operation.TxID] = operation.Key
+		} else if operation.Op == "commit" {
+			committed[operation.TxID] = true
+			if index < firstCommit {
+				firstCommit = index
+			}
 		} else {
 			transaction.replayOps = append(transaction.replayOps, operation)
 			transactionMap.Transactions[operation.TxID] = transaction
+			lastOpIndex[operation.TxID] = index
+		}
+	}
+
+	// Txns without a commit were still in flight when the log ends. Logs written before
+	// commits were logged have no format entry and no commits at all, so there txns from
+	// before the first commit count.
+	// Prepared txns are in doubt until their coordinator decides, so they're replayed
+	// but kept active.
+	for txnID := range transactionMap.Transactions {
+		if !committed[txnID] && prepared[txnID] == "" && lastOpIndex[txnID] > firstCommit {
+			delete(transactionMap.Transactions, txnID)
 		}
 	}
 
@@ -427,12 +1583,17 @@ func replayLog(tree *binTree.BinTree) (uint64, error) {
 	}
 	sort.Slice(transactions, func(i, j int) bool { return transactions[i] < transactions[j] })
 	for _, transactionID := range transactions {
-		fmt.Printf("About to batch perform txn: %d", transactionID)
+		logger.Debug("replaying txn", "txid", transactionID)
 		txn := transactionMap.Transactions[transactionID]
 		err := txn.BatchExecute(tree)
 		if err != nil {
 			return 0, err
 		}
+		if gid := prepared[transactionID]; gid != "" && !committed[transactionID] {
+			restorePreparedTxn(gid, txn)
+		}
 	}
+
+	lastReplay = replayStats{offset: offset, operations: len(operations), txns: len(transactions), lastTxID: lastTxn, duration: time.Since(start)}
 	return lastTxn, nil
 }
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"OttoDB/server/config"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Every flag is a setting, which can also come from an OTTODB_ environment variable or
+// the config file. Live settings are read through settings, since CONFIG SET changes them.
+var (
+	_        = flag.String("config", "", "Config file of name value lines, for settings without a flag or environment variable")
+	bindAddr = flag.String("bind", "", "Address to listen for clients on, every address when empty")
+	port     = flag.Int("port", 8080, "Port to listen for clients on")
+	dataDir  = flag.String("dir", ".", "Data directory holding the log and the engine, raft, cluster and replica state")
+
+	_ = flag.String("wal-sync", "everysec", "When the log is synced to disk: always, after every write, everysec, once a second, or no, leaving it to the OS")
+	_ = flag.String("loglevel", "info", "Least severe messages that are logged: debug, info, warn or error")
+	_ = flag.Int("maxclients", 10000, "Most clients connected at once")
+	_ = flag.Int("timeout", 0, "Seconds a client can be idle before it's disconnected, never when 0")
+
+	settings = config.New(flag.CommandLine)
+
+	connectedClients = struct {
+		sync.Mutex
+		count int
+	}{}
+)
+
+// Settings CONFIG SET can change, and what checks their new value
+var liveSettings = map[string]func(value string) error{
+	"wal-sync":                oneOf("always", "everysec", "no"),
+	"loglevel":                setLogLevel,
+	"maxclients":              atLeast(1),
+	"timeout":                 atLeast(0),
+	"memtable-keys":           atLeast(1),
+	"slowlog-log-slower-than": atLeast(-1),
+	"slowlog-txn-slower-than": atLeast(-1),
+	"slowlog-max-len":         atLeast(0),
+	"tls-cert-file":           fileOrEmpty,
+	"tls-key-file":            fileOrEmpty,
+	"tls-ca-cert-file":        fileOrEmpty,
+	"tls-auth-clients":        oneOf("yes", "optional", "no"),
+	"wal-key-file":            setWalKeyFile,
+}
+
+func oneOf(values ...string) func(value string) error {
+	return func(value string) error {
+		for _, allowed := range values {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s", strings.Join(values, ", "))
+	}
+}
+
+func atLeast(min int) func(value string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min {
+			return fmt.Errorf("expected a number of at least %d", min)
+		}
+		return nil
+	}
+}
+
+func loadSettings(args []string) error {
+	if err := settings.Load(args, "config"); err != nil {
+		return err
+	}
+	for name, check := range liveSettings {
+		if err := check(settings.String(name)); err != nil {
+			return fmt.Errorf("invalid %s: %v", name, err)
+		}
+		settings.Live(name, check)
+	}
+
+	if err := os.MkdirAll(*dataDir, 0755); err != nil {
+		return fmt.Errorf("could not create %s: %v", *dataDir, err)
+	}
+	walPath = dataPath(walName)
+	replicaStatePath = dataPath(replicaStateName)
+	return loadACL()
+}
+
+// Resolves a path relative to the data directory
+func dataPath(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(*dataDir, path)
+}
+
+func listenAddr() string {
+	return net.JoinHostPort(*bindAddr, strconv.Itoa(*port))
+}
+
+// Accepts a client unless -maxclients are connected already
+func acceptClient(conn redcon.Conn) bool {
+	connectedClients.Lock()
+	defer connectedClients.Unlock()
+	if connectedClients.count >= settings.Int("maxclients") {
+		conn.WriteError("ERR max number of clients reached")
+		return false
+	}
+	connectedClients.count++
+	registerClient(conn)
+	extendClientTimeout(conn)
+	return true
+}
+
+func clientClosed() {
+	connectedClients.Lock()
+	defer connectedClients.Unlock()
+	connectedClients.count--
+}
+
+// Disconnects the client if it sends nothing for -timeout seconds from now
+func extendClientTimeout(conn redcon.Conn) {
+	deadline := time.Time{}
+	if timeout := settings.Int("timeout"); timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	conn.NetConn().SetReadDeadline(deadline)
+}
+
+// Subscribers, CDC streams and replicas wait on the server, so they never time out
+func clearClientTimeout(conn redcon.Conn) {
+	conn.NetConn().SetReadDeadline(time.Time{})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"OttoDB/server/hlc"
+	"flag"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	_ = flag.Int("slowlog-log-slower-than", 10000, "Microseconds a command can take before it's added to the slow log, 0 to log every command and -1 to log none")
+	_ = flag.Int("slowlog-txn-slower-than", 1000000, "Microseconds a txn can stay open between BEGIN and COMMIT or ABORT before it's added to the slow log, -1 to log none")
+	_ = flag.Int("slowlog-max-len", 128, "Entries kept in the slow log")
+)
+
+// Like Redis, long arguments and long argument lists are cut short in entries
+const (
+	slowlogMaxArgs   = 32
+	slowlogMaxArgLen = 128
+)
+
+type slowlogEntry struct {
+	id       uint64
+	time     time.Time
+	duration time.Duration
+	args     []string
+	client   string
+	name     string
+	txID     uint64
+}
+
+var slowlog = struct {
+	sync.Mutex
+	nextID  uint64
+	entries []slowlogEntry // Newest first
+}{entries: make([]slowlogEntry, 0)}
+
+// Adds a command to the slow log if it ran for longer than -slowlog-log-slower-than
+func observeCommand(conn redcon.Conn, cmd redcon.Command, txID uint64, start time.Time) {
+	duration := time.Since(start)
+	threshold := settings.Int("slowlog-log-slower-than")
+	if threshold < 0 || duration < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+	args := make([]string, 0, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		args = append(args, string(arg))
+	}
+	// Passwords are kept out of the slow log
+	if strings.ToLower(args[0]) == "auth" {
+		for i := 1; i < len(args); i++ {
+			args[i] = "(redacted)"
+		}
+	}
+	addSlowlogEntry(slowlogEntry{time: start, duration: duration, args: args, client: conn.RemoteAddr(), name: clientName(conn), txID: txID})
+}
+
+// Adds a txn ended by command to the slow log if it was open for longer than
+// -slowlog-txn-slower-than
+func observeTxn(client string, name string, txID uint64, command string) {
+	started := hlc.Time(txID)
+	duration := time.Since(started)
+	threshold := settings.Int("slowlog-txn-slower-than")
+	if threshold < 0 || duration < time.Duration(threshold)*time.Microsecond {
+		return
+	}
+	addSlowlogEntry(slowlogEntry{time: started, duration: duration, args: []string{"TXN", command}, client: client, name: name, txID: txID})
+}
+
+func addSlowlogEntry(entry slowlogEntry) {
+	if len(entry.args) > slowlogMaxArgs {
+		more := len(entry.args) - slowlogMaxArgs + 1
+		entry.args = append(entry.args[:slowlogMaxArgs-1], "... ("+strconv.Itoa(more)+" more arguments)")
+	}
+	for i, arg := range entry.args {
+		if len(arg) > slowlogMaxArgLen {
+			entry.args[i] = arg[:slowlogMaxArgLen] + "... (" + strconv.Itoa(len(arg)-slowlogMaxArgLen) + " more bytes)"
+		}
+	}
+
+	slowlog.Lock()
+	defer slowlog.Unlock()
+	entry.id = slowlog.nextID
+	slowlog.nextID++
+	slowlog.entries = append([]slowlogEntry{entry}, slowlog.entries...)
+	if maxLen := settings.Int("slowlog-max-len"); len(slowlog.entries) > maxLen {
+		slowlog.entries = slowlog.entries[:maxLen]
+	}
+}
+
+// SLOWLOG GET [count] | SLOWLOG LEN | SLOWLOG RESET. Entries are replied newest first,
+// in Redis' layout with the txID added at the end.
+func slowlogCommand(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
+		return
+	}
+	slowlog.Lock()
+	defer slowlog.Unlock()
+
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "get":
+		count := 10
+		if len(cmd.Args) > 3 {
+			conn.WriteError("ERR wrong number of arguments for 'slowlog get' command")
+			return
+		} else if len(cmd.Args) == 3 {
+			n, err := strconv.Atoi(string(cmd.Args[2]))
+			if err != nil || n < -1 {
+				conn.WriteError("ERR count should be greater than or equal to -1")
+				return
+			}
+			count = n
+		}
+		if count == -1 || count > len(slowlog.entries) {
+			count = len(slowlog.entries)
+		}
+		conn.WriteArray(count)
+		for _, entry := range slowlog.entries[:count] {
+			conn.WriteArray(7)
+			conn.WriteUint64(entry.id)
+			conn.WriteInt64(entry.time.Unix())
+			conn.WriteInt64(entry.duration.Microseconds())
+			conn.WriteArray(len(entry.args))
+			for _, arg := range entry.args {
+				conn.WriteBulkString(arg)
+			}
+			conn.WriteBulkString(entry.client)
+			conn.WriteBulkString(entry.name)
+			conn.WriteUint64(entry.txID)
+		}
+	case "len":
+		conn.WriteInt(len(slowlog.entries))
+	case "reset":
+		slowlog.entries = make([]slowlogEntry, 0)
+		conn.WriteString("OK")
+	default:
+		conn.WriteError("ERR unknown SLOWLOG subcommand '" + string(cmd.Args[1]) + "'")
+	}
+}
@@ -3,6 +3,7 @@ package binTree
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +17,19 @@ const (
 	Committed
 )
 
+func (status txnStatus) String() string {
+	switch status {
+	case InProgress:
+		return "in-progress"
+	case Aborted:
+		return "aborted"
+	case Committed:
+		return "committed"
+	default:
+		return "unknown"
+	}
+}
+
 type Record struct {
 	Value        string
 	CreatedBy    uint64
@@ -27,7 +41,7 @@ type Record struct {
 type recordList struct {
 	sync.RWMutex
 	key     string
-	records []Record
+	records []*Record // Pointers, so records handed to txns survive the slice growing
 }
 
 type node struct {
@@ -39,46 +53,141 @@ type node struct {
 
 type BinTree struct {
 	sync.RWMutex
-	root *node
+	root   *node
+	logger *slog.Logger
 }
 
 func NewTree() *BinTree {
-	tree := BinTree{}
+	return NewTreeWithLogger(slog.Default())
+}
+
+// Tree tracing its reads and writes to logger at debug level
+func NewTreeWithLogger(logger *slog.Logger) *BinTree {
+	tree := BinTree{logger: logger}
 	return &tree
 }
 
+var ErrVersionMismatch = errors.New("Latest visible version does not match the expected version")
+
+// Why a write conflicts with another txn's write to the key
+var (
+	ErrLaterWrite   = errors.New("A later transaction wrote/is writing to this key")
+	ErrActiveWrite  = errors.New("An active transaction wrote to this key")
+	ErrLaterDelete  = errors.New("A later transaction deleted/is deleting this key")
+	ErrActiveDelete = errors.New("An active transaction is deleting this key")
+)
+
 func (tree *BinTree) Get(key string, timestamp uint64, activeTxns map[uint64]bool) (string, error) {
-	fmt.Printf("About to start tree search on %s\n", key)
+	value, _, err := tree.GetVersion(key, timestamp, activeTxns)
+	return value, err
+}
+
+// Returns the visible value along with the txID that created it (its version)
+func (tree *BinTree) GetVersion(key string, timestamp uint64, activeTxns map[uint64]bool) (string, uint64, error) {
 	getNode := tree.Search(tree.root, key)
 	if getNode == nil {
-		return "", errors.New("No value found")
+		tree.logger.Debug("key not found", "key", key, "txid", timestamp)
+		return "", 0, errors.New("No value found")
 	}
 
-	recordList := getNode.data.records
-	fmt.Printf("Found key: %s\n", getNode.data.key)
+	getNode.data.RLock()
+	defer getNode.data.RUnlock()
 
 	// Find value scoped in current timestamp that's committed
 	var returnValue string
-	for i := len(recordList) - 1; i >= 0; i-- {
-		currRecord := recordList[i]
-		if currRecord.isVisible(timestamp, activeTxns) {
-			returnValue = currRecord.Value
-			break
-		}
+	var version uint64
+	if visibleIndex := getNode.data.latestVisible(timestamp, activeTxns); visibleIndex >= 0 {
+		returnValue = getNode.data.records[visibleIndex].Value
+		version = getNode.data.records[visibleIndex].CreatedBy
 	}
 
 	// If return value isn't string zero value, return proper value
 	if returnValue != "" {
-		fmt.Printf("Going to send value: %s\n", returnValue)
-		return returnValue, nil
+		tree.logger.Debug("found visible version", "key", key, "txid", timestamp, "version", version)
+		return returnValue, version, nil
+	}
+	tree.logger.Debug("no visible version", "key", key, "txid", timestamp)
+	return "", 0, errors.New("No value for provided timestamp")
+}
+
+func (tree *BinTree) GetAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, error) {
+	value, _, err := tree.GetVersionAsOf(key, asOf, activeTxns)
+	return value, err
+}
+
+// Returns the value (and its version) the key held as of the asOf txID, ignoring
+// any versions written or deleted by later transactions
+func (tree *BinTree) GetVersionAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, uint64, error) {
+	getNode := tree.Search(tree.root, key)
+	if getNode == nil {
+		return "", 0, errors.New("No value found")
+	}
+
+	getNode.data.RLock()
+	defer getNode.data.RUnlock()
+
+	recordList := getNode.data.records
+	for i := len(recordList) - 1; i >= 0; i-- {
+		if recordList[i].isVisibleAsOf(asOf, activeTxns) && recordList[i].Value != "" {
+			return recordList[i].Value, recordList[i].CreatedBy, nil
+		}
+	}
+	return "", 0, errors.New("No value for provided timestamp")
+}
+
+// Sets key to value only if the latest version visible to timestamp was created by
+// expectedVersion. An expectedVersion of 0 expects the key to have no visible value.
+// Returns the expired record (if any) and the inserted record.
+func (tree *BinTree) CompareAndSet(key string, expectedVersion uint64, value string, timestamp uint64, activeTxns map[uint64]bool) (*Record, *Record, error) {
+	casNode := tree.Search(tree.root, key)
+	if casNode == nil {
+		if expectedVersion != 0 {
+			return nil, nil, ErrVersionMismatch
+		}
+		insertedRecord, err := tree.Set(key, value, timestamp, activeTxns)
+		return nil, insertedRecord, err
+	}
+
+	casNode.data.Lock()
+	defer casNode.data.Unlock()
+
+	var currentVersion uint64
+	visibleIndex := casNode.data.latestVisible(timestamp, activeTxns)
+	if visibleIndex >= 0 {
+		currentVersion = casNode.data.records[visibleIndex].CreatedBy
 	}
-	return "", errors.New("No value for provided timestamp")
+	if currentVersion != expectedVersion {
+		return nil, nil, ErrVersionMismatch
+	}
+
+	// Check for concurrent write
+	lastRecord := casNode.data.records[len(casNode.data.records)-1]
+	if isAlreadyEdited, error := lastRecord.isConcurrentEdited(timestamp, activeTxns); isAlreadyEdited {
+		return nil, nil, error
+	}
+	if visibleIndex >= 0 {
+		if isAlreadyEdited, error := casNode.data.records[visibleIndex].isConcurrentEdited(timestamp, activeTxns); isAlreadyEdited {
+			return nil, nil, error
+		}
+	}
+
+	// Append before taking record pointers, so they point into the current backing array
+	casNode.data.records = append(casNode.data.records, &Record{Value: value, CreatedBy: timestamp, ExpiredBy: 0})
+	insertedRecord := casNode.data.records[len(casNode.data.records)-1]
+
+	var expiredRecord *Record
+	if visibleIndex >= 0 {
+		expiredRecord = casNode.data.records[visibleIndex]
+		expiredRecord.OldExpiredBy = expiredRecord.ExpiredBy
+		expiredRecord.ExpiredBy = timestamp
+	}
+	return expiredRecord, insertedRecord, nil
 }
 
 func (tree *BinTree) Set(key string, value string, timestamp uint64, activeTxns map[uint64]bool) (*Record, error) {
 
 	var newRecord = Record{Value: value, CreatedBy: timestamp, ExpiredBy: 0}
-	var singleRecordList = recordList{key: key, records: []Record{newRecord}}
+	var singleRecordList = recordList{key: key, records: []*Record{&newRecord}}
 
 	insertedRecord, err := tree.insert(key, singleRecordList, timestamp, activeTxns)
 	if err != nil {
@@ -91,11 +200,9 @@ func (tree *BinTree) Search(root *node, key string) *node {
 	if root == nil || key == root.data.key {
 		return root
 	}
-	if key < tree.root.data.key {
-		fmt.Println("key is less than root key")
+	if key < root.data.key {
 		return tree.Search(root.left, key)
 	} else {
-		fmt.Println("key is greater than root key")
 		return tree.Search(root.right, key)
 	}
 }
@@ -107,15 +214,15 @@ func (tree *BinTree) insert(key string, singleRecordList recordList, timestamp u
 
 	if tree.root == nil {
 		tree.root = &newNode
-		insertedRecord = &newNode.data.records[0]
+		insertedRecord = newNode.data.records[0]
 	} else {
-		fmt.Println("calling to insert node")
 		var err error
 		insertedRecord, err = tree.iterativeInsert(tree.root, &newNode, timestamp, activeTxns)
 		if err != nil {
 			return nil, err
 		}
 	}
+	tree.logger.Debug("added version", "key", key, "txid", timestamp)
 	return insertedRecord, nil
 }
 
@@ -124,14 +231,14 @@ func (tree *BinTree) iterativeInsert(root *node, newNode *node, timestamp uint64
 		if newNode.data.key < root.data.key {
 			if root.left == nil {
 				root.left = newNode
-				return &newNode.data.records[0], nil
+				return newNode.data.records[0], nil
 			}
 			root = root.left
 
 		} else if newNode.data.key > root.data.key {
 			if root.right == nil {
 				root.right = newNode
-				return &newNode.data.records[0], nil
+				return newNode.data.records[0], nil
 			}
 			root = root.right
 
@@ -148,8 +255,7 @@ func (tree *BinTree) iterativeInsert(root *node, newNode *node, timestamp uint64
 			}
 
 			root.data.records = append(root.data.records, newNode.data.records[0])
-			fmt.Println("new node inserted")
-			return &newNode.data.records[0], nil
+			return root.data.records[len(root.data.records)-1], nil
 		}
 	}
 }
@@ -168,7 +274,7 @@ func (tree *BinTree) Expire(key string, timestamp uint64, activeTxns map[uint64]
 		defer delNode.data.Unlock()
 
 		recordLen := len(delNode.data.records)
-		delRecord := &delNode.data.records[recordLen-1]
+		delRecord := delNode.data.records[recordLen-1]
 
 		if isAlreadyEdited, error := delRecord.isConcurrentEdited(timestamp, activeTxns); isAlreadyEdited {
 			return nil, error
@@ -176,7 +282,7 @@ func (tree *BinTree) Expire(key string, timestamp uint64, activeTxns map[uint64]
 
 		delRecord.OldExpiredBy = delRecord.ExpiredBy
 		delRecord.ExpiredBy = timestamp
-		return &delNode.data.records[recordLen-1], nil
+		return delRecord, nil
 	}
 	return nil, nil
 }
@@ -185,12 +291,16 @@ func (tree *BinTree) Expire(key string, timestamp uint64, activeTxns map[uint64]
 func (tree *BinTree) ExpireReplay(key string, timestamp uint64) (*Record, error) {
 	delNode := tree.Search(tree.root, key)
 	if delNode != nil {
+		// Replays also run while serving reads, e.g. on a replica
+		delNode.data.Lock()
+		defer delNode.data.Unlock()
+
 		recordLen := len(delNode.data.records)
-		delRecord := &delNode.data.records[recordLen-1]
+		delRecord := delNode.data.records[recordLen-1]
 
 		delRecord.OldExpiredBy = delRecord.ExpiredBy
 		delRecord.ExpiredBy = timestamp
-		return &delNode.data.records[recordLen-1], nil
+		return delRecord, nil
 	}
 	return nil, nil
 }
@@ -282,6 +392,16 @@ func (tree *BinTree) Sorted() bool {
 	return true
 }
 
+// Returns the index of the newest record visible to txnID, or -1 if none is visible
+func (list *recordList) latestVisible(txnID uint64, activeTxns map[uint64]bool) int {
+	for i := len(list.records) - 1; i >= 0; i-- {
+		if list.records[i].isVisible(txnID, activeTxns) {
+			return i
+		}
+	}
+	return -1
+}
+
 func (currRecord *Record) isVisible(txnID uint64, activeTxns map[uint64]bool) bool {
 	// We can't view a record if its been aborted
 	if currRecord.Status == Aborted {
@@ -305,31 +425,206 @@ func (currRecord *Record) isVisible(txnID uint64, activeTxns map[uint64]bool) bo
 	return true
 }
 
+// Like isVisible, but for reading the past: deletes made after asOf don't hide a record.
+// Work still in progress is never visible, since it wasn't committed as of asOf either.
+func (currRecord *Record) isVisibleAsOf(asOf uint64, activeTxns map[uint64]bool) bool {
+	if currRecord.Status == Aborted {
+		return false
+	}
+	if currRecord.CreatedBy > asOf || activeTxns[currRecord.CreatedBy] {
+		return false
+	}
+	if currRecord.ExpiredBy != 0 && currRecord.ExpiredBy <= asOf && !activeTxns[currRecord.ExpiredBy] {
+		return false
+	}
+	return true
+}
+
 func (lastRecord *Record) isConcurrentEdited(txnID uint64, activeTxns map[uint64]bool) (bool, error) {
 	// Catches all committed and noncommitted future transaction writes
 	if lastRecord.CreatedBy > txnID {
-		return true, errors.New("A later transaction wrote/is writing to this key")
+		return true, ErrLaterWrite
 	} else if activeTxns[lastRecord.CreatedBy] && lastRecord.CreatedBy != txnID {
 		// Catches all uncommitted previous transaction writes
-		return true, errors.New("An active transaction wrote to this key")
+		return true, ErrActiveWrite
 	}
 
 	if lastRecord.ExpiredBy > txnID {
-		return true, errors.New("A later transaction deleted/is deleting this key")
+		return true, ErrLaterDelete
 	} else if activeTxns[lastRecord.ExpiredBy] && lastRecord.ExpiredBy != txnID {
-		return true, errors.New("An active transaction is deleting this key")
+		return true, ErrActiveDelete
 	}
 
 	return false, nil
 }
 
+// Returns a copy of every version of key, newest first. A missing key has no versions.
+func (tree *BinTree) History(key string) []Record {
+	historyNode := tree.Search(tree.root, key)
+	if historyNode == nil {
+		return []Record{}
+	}
+
+	historyNode.data.RLock()
+	defer historyNode.data.RUnlock()
+
+	records := historyNode.data.records
+	history := make([]Record, 0, len(records))
+	for i := len(records) - 1; i >= 0; i-- {
+		history = append(history, *records[i])
+	}
+	return history
+}
+
+// Adds versions copied from another tree to key, oldest first. They keep the txIDs
+// they were created and expired by.
+func (tree *BinTree) Restore(key string, versions []Record) error {
+	for _, version := range versions {
+		restored := version
+		restored.OldExpiredBy = 0
+		restored.Status = InProgress
+		if _, err := tree.insertReplay(key, recordList{key: key, records: []*Record{&restored}}, restored.CreatedBy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds a key that isn't in the tree yet with all of its versions at once, so readers
+// never see part of them
+func (tree *BinTree) Load(key string, versions []Record) error {
+	if len(versions) == 0 {
+		return errors.New("No versions to load")
+	}
+	if tree.Search(tree.root, key) != nil {
+		return errors.New("Key is already in the tree")
+	}
+	records := make([]*Record, 0, len(versions))
+	for _, version := range versions {
+		loaded := version
+		records = append(records, &loaded)
+	}
+	_, err := tree.insertReplay(key, recordList{key: key, records: records}, records[0].CreatedBy)
+	return err
+}
+
+// Removes every key evict returns true for, and rebuilds the rest into a balanced tree.
+// Nodes are relinked rather than copied, so records handed out for kept keys stay valid.
+// Nothing else may use the tree while this runs.
+func (tree *BinTree) Evict(evict func(key string) bool) int {
+	kept := make([]*node, 0)
+	evicted := 0
+	var collect func(currNode *node)
+	collect = func(currNode *node) {
+		if currNode == nil {
+			return
+		}
+		collect(currNode.left)
+		if evict(currNode.data.key) {
+			evicted++
+		} else {
+			kept = append(kept, currNode)
+		}
+		collect(currNode.right)
+	}
+	collect(tree.root)
+
+	tree.root = buildBalanced(kept, nil)
+	return evicted
+}
+
+func buildBalanced(nodes []*node, parent *node) *node {
+	if len(nodes) == 0 {
+		return nil
+	}
+	middle := len(nodes) / 2
+	root := nodes[middle]
+	root.parent = parent
+	root.left = buildBalanced(nodes[:middle], root)
+	root.right = buildBalanced(nodes[middle+1:], root)
+	return root
+}
+
+// Returns every key in the tree in order, including keys whose versions are all deleted
+func (tree *BinTree) Keys() []string {
+	keys := make([]string, 0)
+	tree.keys(tree.root, &keys)
+	return keys
+}
+
+func (tree *BinTree) keys(currNode *node, keys *[]string) {
+	if currNode == nil {
+		return
+	}
+	tree.keys(currNode.left, keys)
+	*keys = append(*keys, currNode.data.key)
+	tree.keys(currNode.right, keys)
+}
+
+// Returns the keys starting with prefix in order, only visiting the subtrees they can be in
+func (tree *BinTree) KeysWithPrefix(prefix string) []string {
+	keys := make([]string, 0)
+	tree.keysWithPrefix(tree.root, prefix, &keys)
+	return keys
+}
+
+func (tree *BinTree) keysWithPrefix(currNode *node, prefix string, keys *[]string) {
+	if currNode == nil {
+		return
+	}
+	key := currNode.data.key
+	matches := strings.HasPrefix(key, prefix)
+	if key > prefix {
+		tree.keysWithPrefix(currNode.left, prefix, keys)
+	}
+	if matches {
+		*keys = append(*keys, key)
+	}
+	// A key past the prefix that doesn't start with it is after every key that does
+	if key < prefix || matches {
+		tree.keysWithPrefix(currNode.right, prefix, keys)
+	}
+}
+
+// Number of keys and of versions they have, aborted ones included
+func (tree *BinTree) Stats() (int, int) {
+	keys, versions := 0, 0
+	tree.stats(tree.root, &keys, &versions)
+	return keys, versions
+}
+
+func (tree *BinTree) stats(currNode *node, keys *int, versions *int) {
+	if currNode == nil {
+		return
+	}
+	tree.stats(currNode.left, keys, versions)
+	currNode.data.RLock()
+	*keys++
+	*versions += len(currNode.data.records)
+	currNode.data.RUnlock()
+	tree.stats(currNode.right, keys, versions)
+}
+
+// Status of the txn that created the record. Records are never marked committed, so a
+// record that isn't aborted or written by an active txn is reported as committed.
+func (currRecord *Record) CreatorStatus(activeTxns map[uint64]bool) txnStatus {
+	if currRecord.Status == Aborted {
+		return Aborted
+	} else if activeTxns[currRecord.CreatedBy] {
+		return InProgress
+	}
+	return Committed
+}
+
 func (tree *BinTree) RecordListPrint(key string) string {
 	nodeToPrint := tree.Search(tree.root, key)
 	var sb strings.Builder
+	if nodeToPrint == nil {
+		return "no records for key"
+	}
 	recordList := nodeToPrint.data.records
 	for index, record := range recordList {
 		sb.WriteString("index: ")
-		fmt.Printf("index: %d", index)
 		sb.WriteString(strconv.Itoa(int(index)))
 		sb.WriteString("   |")
 
@@ -357,7 +652,7 @@ func (tree *BinTree) RecordListPrint(key string) string {
 func (tree *BinTree) SetReplay(key string, value string, timestamp uint64) (*Record, error) {
 
 	var newRecord = Record{Value: value, CreatedBy: timestamp, ExpiredBy: 0}
-	var singleRecordList = recordList{key: key, records: []Record{newRecord}}
+	var singleRecordList = recordList{key: key, records: []*Record{&newRecord}}
 
 	insertedRecord, err := tree.insertReplay(key, singleRecordList, timestamp)
 	if err != nil {
@@ -373,15 +668,15 @@ func (tree *BinTree) insertReplay(key string, singleRecordList recordList, times
 
 	if tree.root == nil {
 		tree.root = &newNode
-		insertedRecord = &newNode.data.records[0]
+		insertedRecord = newNode.data.records[0]
 	} else {
-		fmt.Println("calling to insert node")
 		var err error
 		insertedRecord, err = tree.iterativeInsertReplay(tree.root, &newNode, timestamp)
 		if err != nil {
 			return nil, err
 		}
 	}
+	tree.logger.Debug("replayed version", "key", key, "txid", timestamp)
 	return insertedRecord, nil
 }
 
@@ -390,21 +685,23 @@ func (tree *BinTree) iterativeInsertReplay(root *node, newNode *node, timestamp
 		if newNode.data.key < root.data.key {
 			if root.left == nil {
 				root.left = newNode
-				return &newNode.data.records[0], nil
+				return newNode.data.records[0], nil
 			}
 			root = root.left
 
 		} else if newNode.data.key > root.data.key {
 			if root.right == nil {
 				root.right = newNode
-				return &newNode.data.records[0], nil
+				return newNode.data.records[0], nil
 			}
 			root = root.right
 
 		} else {
+			root.data.Lock()
+			defer root.data.Unlock()
+
 			root.data.records = append(root.data.records, newNode.data.records[0])
-			fmt.Println("new node inserted")
-			return &newNode.data.records[0], nil
+			return root.data.records[len(root.data.records)-1], nil
 		}
 	}
 }
@@ -0,0 +1,218 @@
+package binTree
+
+import "testing"
+
+func TestSearchDeepKeys(t *testing.T) {
+	tree := NewTree()
+	keys := []string{"m", "c", "e", "x", "p", "a"}
+	for i, key := range keys {
+		tree.SetReplay(key, "value", uint64(i+1))
+	}
+	for _, key := range keys {
+		if tree.Search(tree.root, key) == nil {
+			t.Errorf("expected to find key %s", key)
+		}
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	tree := NewTree()
+	tree.Set("goolash", "2", 1, map[uint64]bool{})
+	tree.Expire("goolash", 4, map[uint64]bool{})
+	tree.Set("goolash", "3", 4, map[uint64]bool{})
+
+	keyVal, version, err := tree.GetVersion("goolash", 5, map[uint64]bool{})
+	if err != nil || keyVal != "3" || version != 4 {
+		t.Errorf("expected value 3 at version 4, got %s at version %d (%v)", keyVal, version, err)
+	}
+
+	// The newer version is still in progress, so only the first one is visible
+	keyVal, version, err = tree.GetVersion("goolash", 5, map[uint64]bool{4: true})
+	if err != nil || keyVal != "2" || version != 1 {
+		t.Errorf("expected value 2 at version 1, got %s at version %d (%v)", keyVal, version, err)
+	}
+}
+
+func TestCompareAndSet(t *testing.T) {
+	tree := NewTree()
+	if _, _, err := tree.CompareAndSet("piper", 0, "1", 2, map[uint64]bool{}); err != nil {
+		t.Fatalf("expected create with version 0 to succeed: %v", err)
+	}
+
+	if _, _, err := tree.CompareAndSet("piper", 1, "2", 3, map[uint64]bool{}); err != ErrVersionMismatch {
+		t.Errorf("expected version mismatch, got %v", err)
+	}
+
+	expiredRecord, insertedRecord, err := tree.CompareAndSet("piper", 2, "2", 3, map[uint64]bool{})
+	if err != nil {
+		t.Fatalf("expected matching version to succeed: %v", err)
+	}
+	if expiredRecord == nil || expiredRecord.ExpiredBy != 3 || insertedRecord.CreatedBy != 3 {
+		t.Errorf("expected version 2 to be expired by txn 3")
+	}
+
+	keyVal, version, _ := tree.GetVersion("piper", 4, map[uint64]bool{})
+	if keyVal != "2" || version != 3 {
+		t.Errorf("expected value 2 at version 3, got %s at version %d", keyVal, version)
+	}
+}
+
+func TestCompareAndSetConcurrentWrite(t *testing.T) {
+	tree := NewTree()
+	tree.Set("squash", "1", 1, map[uint64]bool{})
+	tree.Expire("squash", 2, map[uint64]bool{2: true})
+	tree.Set("squash", "2", 2, map[uint64]bool{2: true})
+
+	// Txn 3 still sees version 1, but txn 2 hasn't committed its write yet
+	_, _, err := tree.CompareAndSet("squash", 1, "3", 3, map[uint64]bool{2: true})
+	if err == nil || err == ErrVersionMismatch {
+		t.Errorf("expected a concurrent write error, got %v", err)
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	tree := NewTree()
+	tree.Set("pizza", "1", 1, map[uint64]bool{})
+	tree.Expire("pizza", 3, map[uint64]bool{})
+	tree.Set("pizza", "2", 3, map[uint64]bool{})
+	tree.Expire("pizza", 5, map[uint64]bool{})
+
+	if keyVal, err := tree.GetAsOf("pizza", 2, map[uint64]bool{}); keyVal != "1" {
+		t.Errorf("expected value 1 as of txn 2, got %s (%v)", keyVal, err)
+	}
+	if keyVal, err := tree.GetAsOf("pizza", 4, map[uint64]bool{}); keyVal != "2" {
+		t.Errorf("expected value 2 as of txn 4, got %s (%v)", keyVal, err)
+	}
+	if _, err := tree.GetAsOf("pizza", 6, map[uint64]bool{}); err == nil {
+		t.Errorf("expected no value as of txn 6")
+	}
+	// The delete by txn 5 hasn't committed yet, so the value is still there
+	if keyVal, _ := tree.GetAsOf("pizza", 6, map[uint64]bool{5: true}); keyVal != "2" {
+		t.Errorf("expected value 2 while the delete is in progress, got %s", keyVal)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tree := NewTree()
+	tree.Set("yellow", "1", 1, map[uint64]bool{})
+	tree.Expire("yellow", 2, map[uint64]bool{})
+	tree.Set("yellow", "2", 2, map[uint64]bool{})
+	tree.Expire("yellow", 3, map[uint64]bool{3: true})
+	tree.Set("yellow", "3", 3, map[uint64]bool{3: true})
+
+	history := tree.History("yellow")
+	if len(history) != 3 || history[0].Value != "3" || history[2].Value != "1" {
+		t.Fatalf("expected 3 versions newest first, got %v", history)
+	}
+	if status := history[0].CreatorStatus(map[uint64]bool{3: true}); status != InProgress {
+		t.Errorf("expected newest version to be in progress, got %s", status)
+	}
+	if status := history[1].CreatorStatus(map[uint64]bool{3: true}); status != Committed {
+		t.Errorf("expected version 2 to be committed, got %s", status)
+	}
+
+	if len(tree.History("missing")) != 0 {
+		t.Errorf("expected no history for a missing key")
+	}
+}
+
+func TestSetReturnsStoredRecord(t *testing.T) {
+	tree := NewTree()
+	tree.Set("apple", "1", 1, map[uint64]bool{})
+	insertedRecord, _ := tree.Set("apple", "2", 2, map[uint64]bool{2: true})
+
+	// Aborting through the returned record has to hide the stored version
+	insertedRecord.Status = Aborted
+	if keyVal, _ := tree.Get("apple", 3, map[uint64]bool{}); keyVal != "1" {
+		t.Errorf("expected aborted version to be hidden, got %s", keyVal)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	source := NewTree()
+	source.Set("apple", "1", 5, map[uint64]bool{})
+	source.Expire("apple", 9, map[uint64]bool{})
+	source.Set("apple", "2", 9, map[uint64]bool{})
+
+	history := source.History("apple")
+	versions := []Record{history[1], history[0]}
+	tree := NewTree()
+	tree.Set("banana", "1", 1, map[uint64]bool{})
+	if err := tree.Restore("apple", versions); err != nil {
+		t.Fatal(err)
+	}
+
+	// The versions keep their txIDs, so reads see the same history as on the source
+	if keyVal, _ := tree.Get("apple", 10, map[uint64]bool{}); keyVal != "2" {
+		t.Errorf("expected restored latest version, got %s", keyVal)
+	}
+	if keyVal, _ := tree.GetAsOf("apple", 6, map[uint64]bool{}); keyVal != "1" {
+		t.Errorf("expected restored older version, got %s", keyVal)
+	}
+	if keys := tree.Keys(); len(keys) != 2 || keys[0] != "apple" || keys[1] != "banana" {
+		t.Errorf("expected keys in order, got %v", keys)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	tree := NewTree()
+	for i, key := range []string{"d", "b", "f", "a", "c", "e", "g"} {
+		tree.Set(key, "1", uint64(i+1), map[uint64]bool{})
+	}
+	kept, _ := tree.Set("c", "2", 10, map[uint64]bool{10: true})
+
+	evicted := tree.Evict(func(key string) bool { return key != "c" && key != "f" })
+	if evicted != 5 {
+		t.Errorf("expected 5 keys evicted, got %d", evicted)
+	}
+	if keys := tree.Keys(); len(keys) != 2 || keys[0] != "c" || keys[1] != "f" {
+		t.Errorf("expected c and f to be kept, got %v", keys)
+	}
+
+	// Records handed out before evicting still belong to the tree
+	kept.Status = Aborted
+	if keyVal, _ := tree.Get("c", 11, map[uint64]bool{}); keyVal != "1" {
+		t.Errorf("expected the aborted version to be hidden, got %s", keyVal)
+	}
+	if err := tree.Load("a", []Record{{Value: "x", CreatedBy: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.Load("a", []Record{{Value: "y", CreatedBy: 2}}); err == nil {
+		t.Errorf("expected loading an existing key to fail")
+	}
+}
+
+func TestRecordsSurviveGrowth(t *testing.T) {
+	tree := NewTree()
+	tree.Set("a", "1", 1, map[uint64]bool{})
+
+	// Setting after expiring grows the key's records, which mustn't strand the expired one
+	expiredRecord, _ := tree.Expire("a", 2, map[uint64]bool{2: true})
+	insertedRecord, _ := tree.Set("a", "2", 2, map[uint64]bool{2: true})
+	expiredRecord.ExpiredBy = expiredRecord.OldExpiredBy
+	insertedRecord.Status = Aborted
+
+	if keyVal, _ := tree.Get("a", 3, map[uint64]bool{}); keyVal != "1" {
+		t.Errorf("expected the aborted txn to leave 1, got %s", keyVal)
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	tree := NewTree()
+	for i, key := range []string{"m", "app:2", "b", "app", "ap", "app:1", "apq", "z", "app:10"} {
+		tree.SetReplay(key, "value", uint64(i+1))
+	}
+	keys := tree.KeysWithPrefix("app:")
+	expected := []string{"app:1", "app:10", "app:2"}
+	if len(keys) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+	for i := range expected {
+		if keys[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, keys)
+		}
+	}
+	if keys := tree.KeysWithPrefix(""); len(keys) != 9 {
+		t.Errorf("expected every key for an empty prefix, got %v", keys)
+	}
+}
@@ -0,0 +1,602 @@
+package lsm
+
+import (
+	"OttoDB/server/store/binTree"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Number of tables that starts a compaction merging them into one
+const compactionThreshold = 4
+
+const manifestName = "MANIFEST"
+
+// A storage engine for data sets bigger than memory. Writes go to the memtable, an
+// in memory binTree. Keys no active txn is writing are flushed to sorted, immutable
+// tables on disk, which are merged in the background as they pile up. A key being
+// written is loaded into the memtable with its whole history first, so txns work
+// on it exactly like they would on a binTree.
+type Tree struct {
+	sync.RWMutex // Taken for writing only to flush or swap tables
+	dir          string
+	memtable     *binTree.BinTree
+	tables       []*table // Oldest first
+	manifest     manifest
+	logger       *slog.Logger
+
+	residentLock sync.Mutex
+	resident     map[string]uint64 // Keys in the memtable, with the newest txID already on disk for them
+
+	compacting sync.Mutex
+}
+
+// Where the server's log stood when the engine last caught up with it. Replaying the
+// log from Offset rebuilds everything that isn't in the tables.
+type LogPosition struct {
+	Offset int64  `json:"offset"` // -1 leaves the position where it is
+	TxID   uint64 `json:"txid"`   // Newest txID handed out before Offset
+}
+
+type manifest struct {
+	Tables    []string    `json:"tables"` // Oldest first
+	NextTable uint64      `json:"next_table"`
+	Log       LogPosition `json:"log"`
+}
+
+// Opens the engine in dir, creating it if needed. Flushes and compactions are logged
+// to logger.
+func Open(dir string, logger *slog.Logger) (*Tree, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create %s: %v", dir, err)
+	}
+	tree := &Tree{dir: dir, memtable: binTree.NewTreeWithLogger(logger), logger: logger, resident: make(map[string]uint64)}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	} else if err == nil {
+		if err := json.Unmarshal(b, &tree.manifest); err != nil {
+			return nil, fmt.Errorf("could not decode manifest: %v", err)
+		}
+	}
+
+	inManifest := make(map[string]bool)
+	for _, name := range tree.manifest.Tables {
+		t, err := openTable(filepath.Join(dir, name), name)
+		if err != nil {
+			tree.Close()
+			return nil, err
+		}
+		tree.tables = append(tree.tables, t)
+		inManifest[name] = true
+	}
+
+	// Tables left behind by a flush or compaction that didn't finish
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		tree.Close()
+		return nil, fmt.Errorf("could not list %s: %v", dir, err)
+	}
+	for _, file := range files {
+		name := file.Name()
+		if (strings.HasSuffix(name, ".sst") && !inManifest[name]) || strings.HasSuffix(name, ".tmp") {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return tree, nil
+}
+
+func (tree *Tree) Close() error {
+	tree.Lock()
+	defer tree.Unlock()
+	var firstErr error
+	for _, t := range tree.tables {
+		if err := t.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	tree.tables = nil
+	return firstErr
+}
+
+// Where to start replaying the log from
+func (tree *Tree) Checkpoint() LogPosition {
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.manifest.Log
+}
+
+// Number of keys in the memtable
+func (tree *Tree) MemtableSize() int {
+	tree.residentLock.Lock()
+	defer tree.residentLock.Unlock()
+	return len(tree.resident)
+}
+
+func (tree *Tree) Get(key string, timestamp uint64, activeTxns map[uint64]bool) (string, error) {
+	value, _, err := tree.GetVersion(key, timestamp, activeTxns)
+	return value, err
+}
+
+func (tree *Tree) GetVersion(key string, timestamp uint64, activeTxns map[uint64]bool) (string, uint64, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	view, err := tree.view(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return view.GetVersion(key, timestamp, activeTxns)
+}
+
+func (tree *Tree) GetAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, error) {
+	value, _, err := tree.GetVersionAsOf(key, asOf, activeTxns)
+	return value, err
+}
+
+func (tree *Tree) GetVersionAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, uint64, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	view, err := tree.view(key)
+	if err != nil {
+		return "", 0, err
+	}
+	return view.GetVersionAsOf(key, asOf, activeTxns)
+}
+
+func (tree *Tree) History(key string) []binTree.Record {
+	tree.RLock()
+	defer tree.RUnlock()
+	view, err := tree.view(key)
+	if err != nil {
+		return []binTree.Record{}
+	}
+	return view.History(key)
+}
+
+func (tree *Tree) RecordListPrint(key string) string {
+	tree.RLock()
+	defer tree.RUnlock()
+	view, err := tree.view(key)
+	if err != nil {
+		return err.Error()
+	}
+	return view.RecordListPrint(key)
+}
+
+func (tree *Tree) CompareAndSet(key string, expectedVersion uint64, value string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, *binTree.Record, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	if _, err := tree.load(key); err != nil {
+		return nil, nil, err
+	}
+	return tree.memtable.CompareAndSet(key, expectedVersion, value, timestamp, activeTxns)
+}
+
+func (tree *Tree) Set(key string, value string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	if _, err := tree.load(key); err != nil {
+		return nil, err
+	}
+	return tree.memtable.Set(key, value, timestamp, activeTxns)
+}
+
+func (tree *Tree) Expire(key string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	if _, err := tree.load(key); err != nil {
+		return nil, err
+	}
+	return tree.memtable.Expire(key, timestamp, activeTxns)
+}
+
+// Replaying the log can hit txns that were flushed already, since the log is only
+// trimmed once the memtable is empty. Their writes are skipped, returning no record.
+func (tree *Tree) SetReplay(key string, value string, timestamp uint64) (*binTree.Record, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	flushed, err := tree.load(key)
+	if err != nil || timestamp <= flushed {
+		return nil, err
+	}
+	return tree.memtable.SetReplay(key, value, timestamp)
+}
+
+func (tree *Tree) ExpireReplay(key string, timestamp uint64) (*binTree.Record, error) {
+	tree.RLock()
+	defer tree.RUnlock()
+	flushed, err := tree.load(key)
+	if err != nil || timestamp <= flushed {
+		return nil, err
+	}
+	return tree.memtable.ExpireReplay(key, timestamp)
+}
+
+// Versions the key already has, from replaying a restore that was flushed, are skipped
+func (tree *Tree) Restore(key string, versions []binTree.Record) error {
+	tree.RLock()
+	defer tree.RUnlock()
+	if _, err := tree.load(key); err != nil {
+		return err
+	}
+
+	existing := make(map[uint64]bool)
+	for _, record := range tree.memtable.History(key) {
+		existing[record.CreatedBy] = true
+	}
+	missing := make([]binTree.Record, 0, len(versions))
+	for _, version := range versions {
+		if !existing[version.CreatedBy] {
+			missing = append(missing, version)
+		}
+	}
+	return tree.memtable.Restore(key, missing)
+}
+
+// Every key in the memtable or a table, in order
+func (tree *Tree) Keys() []string {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, key := range tree.memtable.Keys() {
+		seen[key] = true
+	}
+	for _, t := range tree.tables {
+		iterator := t.iterate()
+		for ; iterator.entry != nil; iterator.next() {
+			seen[iterator.entry.key] = true
+		}
+		if iterator.err != nil {
+			tree.logger.Error("could not list keys", "table", t.name, "err", iterator.err)
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Returns the keys starting with prefix in order, reading only that range of each table
+func (tree *Tree) KeysWithPrefix(prefix string) []string {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	seen := make(map[string]bool)
+	for _, key := range tree.memtable.KeysWithPrefix(prefix) {
+		seen[key] = true
+	}
+	for _, t := range tree.tables {
+		iterator := t.iterateFrom(prefix)
+		for ; iterator.entry != nil && strings.HasPrefix(iterator.entry.key, prefix); iterator.next() {
+			seen[iterator.entry.key] = true
+		}
+		if iterator.err != nil {
+			tree.logger.Error("could not list keys", "table", t.name, "err", iterator.err)
+		}
+	}
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Number of keys and of versions they have. Reads every table, like Keys.
+func (tree *Tree) Stats() (int, int) {
+	tree.RLock()
+	defer tree.RUnlock()
+
+	keys, versions := tree.memtable.Stats()
+	seen := make(map[string]bool)
+	for _, key := range tree.memtable.Keys() {
+		seen[key] = true
+	}
+	// A key's newest table has all of its versions
+	for i := len(tree.tables) - 1; i >= 0; i-- {
+		iterator := tree.tables[i].iterate()
+		for ; iterator.entry != nil; iterator.next() {
+			if !seen[iterator.entry.key] {
+				seen[iterator.entry.key] = true
+				keys++
+				versions += len(iterator.entry.records)
+			}
+		}
+		if iterator.err != nil {
+			tree.logger.Error("could not count keys", "table", tree.tables[i].name, "err", iterator.err)
+		}
+	}
+	return keys, versions
+}
+
+// Returns a tree holding key's versions. Must be called with the read lock held.
+func (tree *Tree) view(key string) (*binTree.BinTree, error) {
+	tree.residentLock.Lock()
+	_, resident := tree.resident[key]
+	tree.residentLock.Unlock()
+	if resident {
+		return tree.memtable, nil
+	}
+
+	records, err := tree.fromTables(key)
+	if err != nil || records == nil {
+		return tree.memtable, err
+	}
+	view := binTree.NewTreeWithLogger(tree.logger)
+	return view, view.Load(key, records)
+}
+
+// Brings key into the memtable if it isn't there yet, so it can be written. Returns the
+// newest txID that wrote key before it was last flushed. Must be called with the read
+// lock held.
+func (tree *Tree) load(key string) (uint64, error) {
+	tree.residentLock.Lock()
+	defer tree.residentLock.Unlock()
+	if flushed, ok := tree.resident[key]; ok {
+		return flushed, nil
+	}
+
+	records, err := tree.fromTables(key)
+	if err != nil {
+		return 0, err
+	}
+	var flushed uint64
+	if records != nil {
+		if err := tree.memtable.Load(key, records); err != nil {
+			return 0, err
+		}
+		flushed = newestTxID(records)
+	}
+	tree.resident[key] = flushed
+	return flushed, nil
+}
+
+// The newest table holding key has every version of it
+func (tree *Tree) fromTables(key string) ([]binTree.Record, error) {
+	for i := len(tree.tables) - 1; i >= 0; i-- {
+		records, err := tree.tables[i].get(key)
+		if err != nil || records != nil {
+			return records, err
+		}
+	}
+	return nil, nil
+}
+
+// Writes every key that no txn in activeTxns is writing to a new table, and drops them
+// from the memtable. activeTxns is called once nothing else is using the tree, so no
+// txn can start writing in between. If the memtable ends up empty with no txns active,
+// position becomes the new checkpoint.
+func (tree *Tree) Flush(activeTxns func() map[uint64]bool, position LogPosition) error {
+	tree.Lock()
+	defer tree.Unlock()
+	active := activeTxns()
+
+	settled := make(map[string]bool)
+	entries := make([]*tableEntry, 0)
+	for _, key := range tree.memtable.Keys() {
+		history := tree.memtable.History(key)
+		if !isSettled(history, active) {
+			continue
+		}
+		settled[key] = true
+
+		records := make([]binTree.Record, 0, len(history))
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Status != binTree.Aborted {
+				records = append(records, binTree.Record{Value: history[i].Value, CreatedBy: history[i].CreatedBy, ExpiredBy: history[i].ExpiredBy})
+			}
+		}
+		if len(records) > 0 {
+			entries = append(entries, &tableEntry{key: key, records: records})
+		}
+	}
+
+	updated := tree.manifest
+	updated.Tables = append([]string{}, tree.manifest.Tables...)
+	var flushedTable *table
+	if len(entries) > 0 {
+		name := tableName(updated.NextTable)
+		updated.NextTable++
+		path := filepath.Join(tree.dir, name)
+		next := 0
+		_, err := writeTable(path, func() (*tableEntry, error) {
+			if next == len(entries) {
+				return nil, nil
+			}
+			next++
+			return entries[next-1], nil
+		})
+		if err == nil {
+			flushedTable, err = openTable(path, name)
+		}
+		if err != nil {
+			os.Remove(path)
+			return err
+		}
+		updated.Tables = append(updated.Tables, name)
+	}
+
+	remaining := len(tree.memtable.Keys()) - len(settled)
+	if position.Offset >= 0 && remaining == 0 && len(active) == 0 {
+		updated.Log = position
+	}
+	if err := tree.saveManifest(updated); err != nil {
+		if flushedTable != nil {
+			flushedTable.close()
+			os.Remove(filepath.Join(tree.dir, flushedTable.name))
+		}
+		return err
+	}
+	tree.manifest = updated
+	if flushedTable != nil {
+		tree.tables = append(tree.tables, flushedTable)
+		tree.logger.Info("flushed memtable", "table", flushedTable.name, "keys", len(entries), "remaining", remaining)
+	}
+
+	tree.memtable.Evict(func(key string) bool { return settled[key] })
+	tree.residentLock.Lock()
+	stillResident := make(map[string]uint64)
+	for _, key := range tree.memtable.Keys() {
+		stillResident[key] = tree.resident[key]
+	}
+	tree.resident = stillResident
+	tree.residentLock.Unlock()
+
+	if len(tree.tables) >= compactionThreshold {
+		go func() {
+			if err := tree.Compact(); err != nil {
+				tree.logger.Error("could not compact tables", "err", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// A key is settled once every txn that wrote it has committed or aborted
+func isSettled(history []binTree.Record, active map[uint64]bool) bool {
+	for _, record := range history {
+		if record.Status == binTree.Aborted {
+			continue
+		}
+		if active[record.CreatedBy] || (record.ExpiredBy != 0 && active[record.ExpiredBy]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges every table into one. Reads and writes carry on while the merged table is
+// written, and only the tables it replaces are swapped out for it.
+func (tree *Tree) Compact() error {
+	tree.compacting.Lock()
+	defer tree.compacting.Unlock()
+
+	tree.Lock()
+	inputs := append([]*table{}, tree.tables...)
+	name := tableName(tree.manifest.NextTable)
+	tree.manifest.NextTable++
+	tree.Unlock()
+	if len(inputs) < 2 {
+		return nil
+	}
+
+	// Only compaction closes tables, so the inputs stay open without holding the lock
+	path := filepath.Join(tree.dir, name)
+	_, err := writeTable(path, mergeTables(inputs))
+	var merged *table
+	if err == nil {
+		merged, err = openTable(path, name)
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	tree.Lock()
+	defer tree.Unlock()
+	updated := tree.manifest
+	updated.Tables = append([]string{name}, tree.manifest.Tables[len(inputs):]...)
+	if err := tree.saveManifest(updated); err != nil {
+		merged.close()
+		os.Remove(path)
+		return err
+	}
+	tree.manifest = updated
+	tree.tables = append([]*table{merged}, tree.tables[len(inputs):]...)
+
+	for _, t := range inputs {
+		t.close()
+		os.Remove(filepath.Join(tree.dir, t.name))
+	}
+	tree.logger.Info("compacted tables", "table", name, "merged", len(inputs))
+	return nil
+}
+
+// Returns the entries of tables in key order. A key in more than one table takes its
+// versions from the newest one, which has all of them.
+func mergeTables(tables []*table) func() (*tableEntry, error) {
+	iterators := make([]*tableIterator, 0, len(tables))
+	for _, t := range tables {
+		iterators = append(iterators, t.iterate())
+	}
+
+	return func() (*tableEntry, error) {
+		var newest *tableEntry
+		for _, iterator := range iterators {
+			if iterator.err != nil {
+				return nil, iterator.err
+			}
+			if iterator.entry != nil && (newest == nil || iterator.entry.key <= newest.key) {
+				newest = iterator.entry
+			}
+		}
+		if newest == nil {
+			return nil, nil
+		}
+		for _, iterator := range iterators {
+			if iterator.entry != nil && iterator.entry.key == newest.key {
+				iterator.next()
+			}
+		}
+		return newest, nil
+	}
+}
+
+func (tree *Tree) saveManifest(updated manifest) error {
+	b, err := json.Marshal(updated)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(tree.dir, manifestName)
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", tmpPath, err)
+	}
+	defer os.Remove(tmpPath)
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %v", tmpPath, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("could not sync %s: %v", tmpPath, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close %s: %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", tmpPath, path, err)
+	}
+	return nil
+}
+
+func tableName(number uint64) string {
+	return fmt.Sprintf("%06d.sst", number)
+}
+
+func newestTxID(records []binTree.Record) uint64 {
+	var newest uint64
+	for _, record := range records {
+		if record.CreatedBy > newest {
+			newest = record.CreatedBy
+		}
+		if record.ExpiredBy > newest {
+			newest = record.ExpiredBy
+		}
+	}
+	return newest
+}
@@ -0,0 +1,187 @@
+package lsm
+
+import (
+	"OttoDB/server/store/binTree"
+	"fmt"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+var noActiveTxns = map[uint64]bool{}
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func openTree(t *testing.T, dir string) *Tree {
+	tree, err := Open(dir, discardLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tree.Close() })
+	return tree
+}
+
+func flush(t *testing.T, tree *Tree, active map[uint64]bool, position LogPosition) {
+	if err := tree.Flush(func() map[uint64]bool { return active }, position); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlushedKeysAreReadFromTables(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir)
+	for i := 0; i < 100; i++ {
+		tree.Set(fmt.Sprintf("key%03d", i), "old", 1, noActiveTxns)
+	}
+	tree.Set("key050", "new", 2, noActiveTxns)
+	flush(t, tree, noActiveTxns, LogPosition{Offset: 123, TxID: 2})
+
+	if size := tree.MemtableSize(); size != 0 {
+		t.Errorf("expected an empty memtable, got %d keys", size)
+	}
+	tree.Close()
+
+	reopened := openTree(t, dir)
+	if position := reopened.Checkpoint(); position.Offset != 123 || position.TxID != 2 {
+		t.Errorf("expected the checkpoint to be saved, got %+v", position)
+	}
+	if keyVal, _ := reopened.Get("key050", 3, noActiveTxns); keyVal != "new" {
+		t.Errorf("expected new, got %s", keyVal)
+	}
+	if keyVal, _ := reopened.GetAsOf("key050", 1, noActiveTxns); keyVal != "old" {
+		t.Errorf("expected old as of txn 1, got %s", keyVal)
+	}
+	if _, err := reopened.Get("missing", 3, noActiveTxns); err == nil {
+		t.Errorf("expected a missing key to have no value")
+	}
+	if keys := reopened.Keys(); len(keys) != 100 {
+		t.Errorf("expected 100 keys, got %d", len(keys))
+	}
+
+	// Writing a flushed key sees its whole history
+	if _, err := reopened.Set("key050", "older", 1, noActiveTxns); err == nil {
+		t.Errorf("expected a conflict with the flushed version from txn 2")
+	}
+	if _, err := reopened.Set("key050", "newer", 4, noActiveTxns); err != nil {
+		t.Fatal(err)
+	}
+	if history := reopened.History("key050"); len(history) != 3 {
+		t.Errorf("expected 3 versions, got %v", history)
+	}
+}
+
+func TestActiveTxnsStayInMemory(t *testing.T) {
+	tree := openTree(t, t.TempDir())
+	tree.Set("done", "1", 1, noActiveTxns)
+	active := map[uint64]bool{2: true}
+	inserted, _ := tree.Set("writing", "2", 2, active)
+
+	flush(t, tree, active, LogPosition{Offset: 50, TxID: 2})
+	if size := tree.MemtableSize(); size != 1 {
+		t.Errorf("expected only the key being written to stay, got %d keys", size)
+	}
+	if position := tree.Checkpoint(); position.Offset != 0 {
+		t.Errorf("expected no checkpoint while a txn is active, got %+v", position)
+	}
+
+	// The txn can still abort through its record
+	inserted.Status = binTree.Aborted
+	flush(t, tree, noActiveTxns, LogPosition{Offset: 60, TxID: 2})
+	if _, err := tree.Get("writing", 3, noActiveTxns); err == nil {
+		t.Errorf("expected the aborted write to be gone")
+	}
+	if position := tree.Checkpoint(); position.Offset != 60 {
+		t.Errorf("expected the checkpoint to move, got %+v", position)
+	}
+}
+
+func TestReplayingFlushedTxnsIsSkipped(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir)
+	tree.SetReplay("a", "1", 1)
+	tree.ExpireReplay("a", 2)
+	tree.SetReplay("a", "2", 2)
+	tree.Restore("b", []binTree.Record{{Value: "x", CreatedBy: 1}})
+	flush(t, tree, noActiveTxns, LogPosition{Offset: -1})
+	tree.Close()
+
+	// The checkpoint didn't move, so the whole log is replayed again
+	reopened := openTree(t, dir)
+	reopened.SetReplay("a", "1", 1)
+	reopened.ExpireReplay("a", 2)
+	reopened.SetReplay("a", "2", 2)
+	reopened.Restore("b", []binTree.Record{{Value: "x", CreatedBy: 1}})
+	reopened.ExpireReplay("a", 3)
+	reopened.SetReplay("a", "3", 3)
+
+	if history := reopened.History("a"); len(history) != 3 || history[0].Value != "3" {
+		t.Errorf("expected 3 versions of a ending in 3, got %v", history)
+	}
+	if history := reopened.History("b"); len(history) != 1 {
+		t.Errorf("expected b to be restored once, got %v", history)
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	tree := openTree(t, dir)
+	for txID := uint64(1); txID < compactionThreshold; txID++ {
+		tree.Set("shared", fmt.Sprint(txID), txID, noActiveTxns)
+		tree.Set(fmt.Sprintf("only%d", txID), "1", txID, noActiveTxns)
+		flush(t, tree, noActiveTxns, LogPosition{Offset: -1})
+	}
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(tree.tables) != 1 {
+		t.Fatalf("expected the tables to be merged into one, got %d", len(tree.tables))
+	}
+	tree.Close()
+
+	reopened := openTree(t, dir)
+	if history := reopened.History("shared"); len(history) != compactionThreshold-1 {
+		t.Errorf("expected every version of shared, got %v", history)
+	}
+	if keyVal, _ := reopened.Get("only1", 10, noActiveTxns); keyVal != "1" {
+		t.Errorf("expected only1 to survive compaction, got %s", keyVal)
+	}
+	if keys := reopened.Keys(); len(keys) != compactionThreshold {
+		t.Errorf("expected %d keys, got %v", compactionThreshold, keys)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tree := openTree(t, t.TempDir())
+	tree.Set("a", "1", 1, noActiveTxns)
+	tree.Set("b", "1", 1, noActiveTxns)
+	flush(t, tree, noActiveTxns, LogPosition{Offset: -1})
+	tree.Set("b", "2", 2, noActiveTxns)
+	tree.Set("c", "1", 2, noActiveTxns)
+
+	if keys, versions := tree.Stats(); keys != 3 || versions != 4 {
+		t.Errorf("expected 3 keys and 4 versions, got %d and %d", keys, versions)
+	}
+	flush(t, tree, noActiveTxns, LogPosition{Offset: -1})
+	if keys, versions := tree.Stats(); keys != 3 || versions != 4 {
+		t.Errorf("expected 3 keys and 4 versions after flushing, got %d and %d", keys, versions)
+	}
+}
+
+func TestKeysWithPrefix(t *testing.T) {
+	tree := openTree(t, t.TempDir())
+	for i := 0; i < 100; i++ {
+		tree.Set(fmt.Sprintf("a:%03d", i), "1", 1, noActiveTxns)
+		tree.Set(fmt.Sprintf("b:%03d", i), "1", 1, noActiveTxns)
+	}
+	flush(t, tree, noActiveTxns, LogPosition{Offset: -1})
+	tree.Set("b:050x", "1", 2, noActiveTxns)
+	tree.Set("c", "1", 2, noActiveTxns)
+
+	keys := tree.KeysWithPrefix("b:05")
+	if len(keys) != 11 || keys[0] != "b:050" || keys[1] != "b:050x" || keys[10] != "b:059" {
+		t.Errorf("expected b:050 to b:059 and b:050x, got %v", keys)
+	}
+	if keys := tree.KeysWithPrefix("a:"); len(keys) != 100 {
+		t.Errorf("expected 100 keys, got %d", len(keys))
+	}
+}
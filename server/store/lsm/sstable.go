@@ -0,0 +1,373 @@
+package lsm
+
+import (
+	"OttoDB/server/store/binTree"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+)
+
+// Table layout: entries sorted by key, then a sparse index, a bloom filter and a footer.
+// An entry is a key and every version it has, so the newest table holding a key has
+// its whole history.
+const (
+	tableMagic      = 0x315453534f54544f // OTTOSST1, little endian
+	footerSize      = 24
+	indexInterval   = 32 // Entries between index points
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+var errCorruptTable = errors.New("corrupt table")
+
+type tableEntry struct {
+	key     string
+	records []binTree.Record
+}
+
+type indexPoint struct {
+	key    string
+	offset int64
+}
+
+// An open, immutable table. The index and bloom filter are kept in memory, entries
+// are read from disk when needed.
+type table struct {
+	name    string
+	file    *os.File
+	dataEnd int64
+	index   []indexPoint
+	bloom   bloom
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Writes the entries next returns, in key order, to a new table at path. next returns
+// nil once there are no more. Returns the number of entries written.
+func writeTable(path string, next func() (*tableEntry, error)) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %v", path, err)
+	}
+	defer f.Close()
+	writer := bufio.NewWriter(f)
+
+	var offset int64
+	index := make([]indexPoint, 0)
+	hashes := make([]uint64, 0)
+	buf := make([]byte, 0, 4096)
+	lastKey := ""
+	for count := 0; ; count++ {
+		entry, err := next()
+		if err != nil {
+			return 0, err
+		}
+		if entry == nil {
+			break
+		}
+		if count > 0 && entry.key <= lastKey {
+			return 0, fmt.Errorf("table entries out of order at %q", entry.key)
+		}
+		lastKey = entry.key
+
+		if count%indexInterval == 0 {
+			index = append(index, indexPoint{key: entry.key, offset: offset})
+		}
+		hashes = append(hashes, keyHash(entry.key))
+
+		buf = appendEntry(buf[:0], entry)
+		if _, err := writer.Write(buf); err != nil {
+			return 0, fmt.Errorf("could not write %s: %v", path, err)
+		}
+		offset += int64(len(buf))
+	}
+
+	indexOffset := offset
+	buf = appendUvarint(buf[:0], uint64(len(index)))
+	for _, point := range index {
+		buf = appendString(buf, point.key)
+		buf = appendUvarint(buf, uint64(point.offset))
+	}
+	bloomOffset := indexOffset + int64(len(buf))
+	filter := newBloom(hashes)
+	buf = append(buf, filter...)
+
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer[0:], uint64(indexOffset))
+	binary.LittleEndian.PutUint64(footer[8:], uint64(bloomOffset))
+	binary.LittleEndian.PutUint64(footer[16:], tableMagic)
+	buf = append(buf, footer...)
+
+	if _, err := writer.Write(buf); err != nil {
+		return 0, fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, fmt.Errorf("could not write %s: %v", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return 0, fmt.Errorf("could not sync %s: %v", path, err)
+	}
+	return len(hashes), f.Close()
+}
+
+func openTable(path string, name string) (*table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	t, err := readTableMeta(f, name)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	return t, nil
+}
+
+func readTableMeta(f *os.File, name string) (*table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < footerSize {
+		return nil, errCorruptTable
+	}
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, info.Size()-footerSize); err != nil {
+		return nil, err
+	}
+	indexOffset := int64(binary.LittleEndian.Uint64(footer[0:]))
+	bloomOffset := int64(binary.LittleEndian.Uint64(footer[8:]))
+	if binary.LittleEndian.Uint64(footer[16:]) != tableMagic || indexOffset > bloomOffset || bloomOffset > info.Size()-footerSize {
+		return nil, errCorruptTable
+	}
+
+	meta := make([]byte, info.Size()-footerSize-indexOffset)
+	if _, err := f.ReadAt(meta, indexOffset); err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(meta[:bloomOffset-indexOffset])
+	count, err := binary.ReadUvarint(reader)
+	if err != nil || count > uint64(len(meta)) {
+		return nil, errCorruptTable
+	}
+	index := make([]indexPoint, 0, count)
+	for i := uint64(0); i < count; i++ {
+		key, err := readString(reader)
+		if err != nil {
+			return nil, errCorruptTable
+		}
+		offset, err := binary.ReadUvarint(reader)
+		if err != nil || int64(offset) > indexOffset {
+			return nil, errCorruptTable
+		}
+		index = append(index, indexPoint{key: key, offset: int64(offset)})
+	}
+
+	return &table{name: name, file: f, dataEnd: indexOffset, index: index, bloom: bloom(meta[bloomOffset-indexOffset:])}, nil
+}
+
+// Returns every version of key, oldest first, or nil if the table doesn't have it
+func (t *table) get(key string) ([]binTree.Record, error) {
+	if !t.bloom.mayContain(key) {
+		return nil, nil
+	}
+	// The last index point at or before key starts the only run of entries it can be in
+	point := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1
+	if point < 0 {
+		return nil, nil
+	}
+	end := t.dataEnd
+	if point+1 < len(t.index) {
+		end = t.index[point+1].offset
+	}
+
+	block := make([]byte, end-t.index[point].offset)
+	if _, err := t.file.ReadAt(block, t.index[point].offset); err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", t.name, err)
+	}
+	reader := bytes.NewReader(block)
+	for reader.Len() > 0 {
+		entry, err := readEntry(reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %v", t.name, err)
+		}
+		if entry.key == key {
+			return entry.records, nil
+		} else if entry.key > key {
+			break
+		}
+	}
+	return nil, nil
+}
+
+// Reads the table's entries in key order, one at a time
+type tableIterator struct {
+	reader *bufio.Reader
+	entry  *tableEntry
+	err    error
+}
+
+func (t *table) iterate() *tableIterator {
+	iterator := &tableIterator{reader: bufio.NewReader(io.NewSectionReader(t.file, 0, t.dataEnd))}
+	iterator.next()
+	return iterator
+}
+
+// Reads the table's entries in key order from the first one at or after key, starting
+// at the index point before it rather than the start of the table
+func (t *table) iterateFrom(key string) *tableIterator {
+	offset := int64(0)
+	if point := sort.Search(len(t.index), func(i int) bool { return t.index[i].key > key }) - 1; point >= 0 {
+		offset = t.index[point].offset
+	}
+	iterator := &tableIterator{reader: bufio.NewReader(io.NewSectionReader(t.file, offset, t.dataEnd-offset))}
+	for iterator.next(); iterator.entry != nil && iterator.entry.key < key; {
+		iterator.next()
+	}
+	return iterator
+}
+
+// Moves on to the next entry. entry is nil once the table is done or reading failed.
+func (iterator *tableIterator) next() {
+	entry, err := readEntry(iterator.reader)
+	if err == io.EOF {
+		iterator.entry = nil
+		return
+	} else if err != nil {
+		iterator.entry, iterator.err = nil, err
+		return
+	}
+	iterator.entry = &entry
+}
+
+func (t *table) close() error {
+	return t.file.Close()
+}
+
+func appendEntry(buf []byte, entry *tableEntry) []byte {
+	buf = appendString(buf, entry.key)
+	buf = appendUvarint(buf, uint64(len(entry.records)))
+	for _, record := range entry.records {
+		buf = appendString(buf, record.Value)
+		buf = appendUvarint(buf, record.CreatedBy)
+		buf = appendUvarint(buf, record.ExpiredBy)
+	}
+	return buf
+}
+
+// Returns io.EOF only if there are no entries left
+func readEntry(reader byteReader) (tableEntry, error) {
+	key, err := readString(reader)
+	if err != nil {
+		return tableEntry{}, err
+	}
+	count, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return tableEntry{}, unexpectedEOF(err)
+	}
+	if count > 1<<24 {
+		return tableEntry{}, errCorruptTable
+	}
+	records := make([]binTree.Record, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var record binTree.Record
+		if record.Value, err = readString(reader); err != nil {
+			return tableEntry{}, unexpectedEOF(err)
+		}
+		if record.CreatedBy, err = binary.ReadUvarint(reader); err != nil {
+			return tableEntry{}, unexpectedEOF(err)
+		}
+		if record.ExpiredBy, err = binary.ReadUvarint(reader); err != nil {
+			return tableEntry{}, unexpectedEOF(err)
+		}
+		records = append(records, record)
+	}
+	return tableEntry{key: key, records: records}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], x)]...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = appendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func readString(reader byteReader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if length > 1<<31 {
+		return "", errCorruptTable
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return "", unexpectedEOF(err)
+	}
+	return string(b), nil
+}
+
+// Tells if a table might have a key, without reading it
+type bloom []byte
+
+func newBloom(hashes []uint64) bloom {
+	bits := len(hashes) * bloomBitsPerKey
+	if bits < 64 {
+		bits = 64
+	}
+	filter := make(bloom, (bits+7)/8)
+	for _, hash := range hashes {
+		for _, bit := range filter.bits(hash) {
+			filter[bit/8] |= 1 << (bit % 8)
+		}
+	}
+	return filter
+}
+
+func (filter bloom) mayContain(key string) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	for _, bit := range filter.bits(keyHash(key)) {
+		if filter[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Double hashing, deriving every probe from the two halves of one hash
+func (filter bloom) bits(hash uint64) [bloomHashes]uint64 {
+	var bits [bloomHashes]uint64
+	size := uint64(len(filter)) * 8
+	low, high := hash&0xffffffff, hash>>32
+	for i := range bits {
+		bits[i] = (low + uint64(i)*high) % size
+	}
+	return bits
+}
+
+func keyHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return hash.Sum64()
+}
@@ -0,0 +1,26 @@
+package store
+
+import "OttoDB/server/store/binTree"
+
+// What the server needs from a storage engine. binTree.BinTree keeps every key in
+// memory, lsm.Tree keeps them on disk. Records returned by writes must stay valid
+// until the txn that wrote them ends, since aborting goes through them.
+type Engine interface {
+	Get(key string, timestamp uint64, activeTxns map[uint64]bool) (string, error)
+	GetVersion(key string, timestamp uint64, activeTxns map[uint64]bool) (string, uint64, error)
+	GetAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, error)
+	GetVersionAsOf(key string, asOf uint64, activeTxns map[uint64]bool) (string, uint64, error)
+	CompareAndSet(key string, expectedVersion uint64, value string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, *binTree.Record, error)
+	Set(key string, value string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, error)
+	Expire(key string, timestamp uint64, activeTxns map[uint64]bool) (*binTree.Record, error)
+	SetReplay(key string, value string, timestamp uint64) (*binTree.Record, error)
+	ExpireReplay(key string, timestamp uint64) (*binTree.Record, error)
+	Restore(key string, versions []binTree.Record) error
+	History(key string) []binTree.Record
+	Keys() []string
+	KeysWithPrefix(prefix string) []string
+	Stats() (keys int, versions int)
+	RecordListPrint(key string) string
+}
+
+var _ Engine = (*binTree.BinTree)(nil)
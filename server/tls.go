@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var (
+	tlsPort = flag.Int("tls-port", 0, "Port to listen for TLS clients on, none when 0. Clients can still connect without TLS on -port, unless it's 0")
+
+	_ = flag.String("tls-cert-file", "", "Certificate the TLS port serves, relative to -dir")
+	_ = flag.String("tls-key-file", "", "Private key of -tls-cert-file, relative to -dir")
+	_ = flag.String("tls-ca-cert-file", "", "CA certificates that client certificates are verified against, relative to -dir")
+	_ = flag.String("tls-auth-clients", "no", "Whether TLS clients need a certificate signed by -tls-ca-cert-file: yes, optional or no")
+)
+
+// Certificates are read again when their files change, so renewed certificates are
+// picked up by new connections without a restart
+var tlsFiles = struct {
+	sync.Mutex
+	certPath, keyPath, caPath string
+	certMod, keyMod, caMod    time.Time
+	cert                      *tls.Certificate
+	clientCAs                 *x509.CertPool
+}{}
+
+// Checks a file setting names a file, or nothing
+func fileOrEmpty(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, err := os.Stat(dataPath(value))
+	return err
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// TLS config for a new connection, from the current certificate settings
+func tlsConfig(*tls.ClientHelloInfo) (*tls.Config, error) {
+	tlsFiles.Lock()
+	defer tlsFiles.Unlock()
+	if err := reloadCertificates(); err != nil {
+		if tlsFiles.cert == nil {
+			return nil, err
+		}
+		// Files can be caught half written, the last certificates are used until then
+		logger.Warn("could not reload TLS certificates", "err", err)
+	}
+	if settings.String("tls-auth-clients") != "no" && tlsFiles.clientCAs == nil {
+		return nil, errors.New("-tls-auth-clients needs -tls-ca-cert-file")
+	}
+
+	config := &tls.Config{Certificates: []tls.Certificate{*tlsFiles.cert}, MinVersion: tls.VersionTLS12, ClientCAs: tlsFiles.clientCAs}
+	switch settings.String("tls-auth-clients") {
+	case "yes":
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func reloadCertificates() error {
+	certPath, keyPath := dataPath(settings.String("tls-cert-file")), dataPath(settings.String("tls-key-file"))
+	certMod, keyMod := modTime(certPath), modTime(keyPath)
+	if tlsFiles.cert == nil || certPath != tlsFiles.certPath || keyPath != tlsFiles.keyPath || !certMod.Equal(tlsFiles.certMod) || !keyMod.Equal(tlsFiles.keyMod) {
+		if settings.String("tls-cert-file") == "" || settings.String("tls-key-file") == "" {
+			return errors.New("-tls-port needs -tls-cert-file and -tls-key-file")
+		}
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return err
+		}
+		tlsFiles.cert = &cert
+		tlsFiles.certPath, tlsFiles.keyPath = certPath, keyPath
+		tlsFiles.certMod, tlsFiles.keyMod = certMod, keyMod
+		logger.Info("loaded TLS certificate", "cert", certPath)
+	}
+
+	caPath := ""
+	if settings.String("tls-ca-cert-file") != "" {
+		caPath = dataPath(settings.String("tls-ca-cert-file"))
+	}
+	caMod := modTime(caPath)
+	if caPath != tlsFiles.caPath || !caMod.Equal(tlsFiles.caMod) {
+		var pool *x509.CertPool
+		if caPath != "" {
+			pem, err := os.ReadFile(caPath)
+			if err != nil {
+				return err
+			}
+			pool = x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificates found in %s", caPath)
+			}
+		}
+		tlsFiles.clientCAs = pool
+		tlsFiles.caPath, tlsFiles.caMod = caPath, caMod
+	}
+	return nil
+}
+
+// Serves clients on -port, and over TLS on -tls-port when it's set
+func serveClients(handler func(conn redcon.Conn, cmd redcon.Command), accept func(conn redcon.Conn) bool, closed func(conn redcon.Conn, err error)) error {
+	if *tlsPort == 0 {
+		return redcon.ListenAndServe(listenAddr(), handler, accept, closed)
+	}
+
+	// Certificate problems are reported at startup rather than on the first handshake
+	if _, err := tlsConfig(nil); err != nil {
+		return err
+	}
+	listener, err := tls.Listen("tcp", net.JoinHostPort(*bindAddr, strconv.Itoa(*tlsPort)), &tls.Config{GetConfigForClient: tlsConfig})
+	if err != nil {
+		return err
+	}
+	if *port == 0 {
+		return redcon.Serve(listener, handler, accept, closed)
+	}
+	served := make(chan error, 2)
+	go func() { served <- redcon.Serve(listener, handler, accept, closed) }()
+	go func() { served <- redcon.ListenAndServe(listenAddr(), handler, accept, closed) }()
+	return <-served
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"OttoDB/server/store"
 	"OttoDB/server/store/binTree"
+	"encoding/json"
 	fmt "fmt"
 	"strconv"
 	"strings"
@@ -13,6 +15,10 @@ type Transaction struct {
 	insertedRecords []*binTree.Record
 	deletedRecords  []*binTree.Record
 	replayOps       []Operation
+	readOnly        bool
+	asOf            uint64          // Reads see the database as of this txID when non-zero
+	activeSnapshot  map[uint64]bool // Txns active when a read only txn began, used for all its reads
+	keys            []string        // Keys written, in order, with repeats
 }
 
 type TransactionMap struct {
@@ -34,7 +40,7 @@ func (txn *Transaction) Abort() {
 		record.ExpiredBy = record.OldExpiredBy
 	}
 
-	fmt.Printf("Inserted record size: %d", len(txn.insertedRecords))
+	logger.Debug("aborting txn", "txid", txn.timestamp, "inserted", len(txn.insertedRecords), "expired", len(txn.deletedRecords))
 
 	// set inserted nodes as aborted
 	for _, record := range txn.insertedRecords {
@@ -89,7 +95,11 @@ func (txn *Transaction) String() string {
 	return sb.String()
 }
 
-func (txn *Transaction) Execute(tree *binTree.BinTree, operation Operation) error {
+func (txn *Transaction) Execute(tree store.Engine, operation Operation) error {
+	if isIndexDefKey(operation.Key) {
+		markIndexesStale()
+	}
+	txn.keys = append(txn.keys, operation.Key)
 	switch operation.Op {
 	case "set":
 		expiredRecord, err := tree.ExpireReplay(operation.Key, operation.TxID)
@@ -105,7 +115,10 @@ func (txn *Transaction) Execute(tree *binTree.BinTree, operation Operation) erro
 		if err != nil {
 			return fmt.Errorf("Ran into error while setting key: %s on txn: %d", operation.Key, operation.TxID)
 		}
-		txn.insertedRecords = append(txn.insertedRecords, insertedRecord)
+		// Engines return no record for writes they already have
+		if insertedRecord != nil {
+			txn.insertedRecords = append(txn.insertedRecords, insertedRecord)
+		}
 
 		return nil
 
@@ -115,15 +128,59 @@ func (txn *Transaction) Execute(tree *binTree.BinTree, operation Operation) erro
 			txn.Abort()
 			return fmt.Errorf("Ran into an error whil expiring key: %s on txn: %d", operation.Key, operation.TxID)
 		}
-		txn.deletedRecords = append(txn.deletedRecords, expiredRecord)
+		if expiredRecord != nil {
+			txn.deletedRecords = append(txn.deletedRecords, expiredRecord)
+		}
+
+		return nil
 
+	case "json.set", "json.del":
+		expiredRecord, err := tree.ExpireReplay(operation.Key, operation.TxID)
+		if err != nil {
+			txn.Abort()
+			return fmt.Errorf("Ran into an error whil expiring key: %s on txn: %d", operation.Key, operation.TxID)
+		}
+		if expiredRecord != nil {
+			txn.deletedRecords = append(txn.deletedRecords, expiredRecord)
+		}
+
+		var patch jsonPatch
+		if err := json.Unmarshal([]byte(operation.Value), &patch); err != nil {
+			return fmt.Errorf("Ran into error while decoding patch of key: %s on txn: %d", operation.Key, operation.TxID)
+		}
+		value, err := applyJSONPatch(operation.Op, expiredValue(expiredRecord), patch)
+		if err != nil {
+			if expiredRecord == nil {
+				// The engine already has this write, and skipped the expire too
+				return nil
+			}
+			return fmt.Errorf("Ran into error while patching key: %s on txn: %d: %v", operation.Key, operation.TxID, err)
+		}
+
+		insertedRecord, err := tree.SetReplay(operation.Key, value, operation.TxID)
+		if err != nil {
+			return fmt.Errorf("Ran into error while setting key: %s on txn: %d", operation.Key, operation.TxID)
+		}
+		if insertedRecord != nil {
+			txn.insertedRecords = append(txn.insertedRecords, insertedRecord)
+		}
+		return nil
+
+	case "restore":
+		versions, err := decodeVersions(operation.Value)
+		if err != nil {
+			return fmt.Errorf("Ran into error while decoding versions of key: %s on txn: %d", operation.Key, operation.TxID)
+		}
+		if err := tree.Restore(operation.Key, versions); err != nil {
+			return fmt.Errorf("Ran into error while restoring key: %s on txn: %d", operation.Key, operation.TxID)
+		}
 		return nil
 	default:
 		return nil
 	}
 }
 
-func (txn *Transaction) BatchExecute(tree *binTree.BinTree) error {
+func (txn *Transaction) BatchExecute(tree store.Engine) error {
 	for _, operation := range txn.replayOps {
 		err := txn.Execute(tree, operation)
 		if err != nil {
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"OttoDB/server/rdb"
+	"OttoDB/server/resp"
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// One key in a JSON lines export
+type exportedKey struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Number of GETs export sends before reading their replies
+const exportPipeline = 1000
+
+// ottodb export [-addr host:port] [-user name -pass password] [-format jsonl|csv] [-header=false] [-asof txid|time] [-match pattern] [-o file]
+// Dumps every key visible at one snapshot of a running server, read in a read only txn.
+func runExport(args []string) int {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "Server to export from")
+	user := flags.String("user", "default", "User to authenticate as")
+	pass := flags.String("pass", "", "Password to authenticate with, none when empty")
+	format := flags.String("format", "jsonl", "Output format, jsonl or csv")
+	header := flags.Bool("header", true, "Start csv output with a key,value header row")
+	asOf := flags.String("asof", "", "Export the database as of this txid or RFC 3339 time instead of now")
+	match := flags.String("match", "*", "Only export keys matching this pattern")
+	output := flags.String("o", "", "File to write to instead of stdout")
+	flags.Parse(args)
+
+	if *format != "jsonl" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "unknown format %s, expected jsonl or csv\n", *format)
+		return 2
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	writer := bufio.NewWriter(out)
+
+	client, err := resp.DialAuth(*addr, *user, *pass)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+
+	count, err := exportKeys(client, *format, *header, *asOf, *match, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "export failed after %d keys: %v\n", count, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d keys\n", count)
+	return 0
+}
+
+func exportKeys(client *resp.Client, format string, header bool, asOf string, match string, writer io.Writer) (int, error) {
+	begin := []string{"BEGIN", "READ", "ONLY"}
+	if asOf != "" {
+		begin = append(begin, "ASOF", asOf)
+	}
+	if _, err := client.Do(begin...); err != nil {
+		return 0, err
+	}
+	defer client.Do("COMMIT")
+
+	reply, err := client.Do("KEYS", match)
+	if err != nil {
+		return 0, err
+	}
+	keys, ok := reply.([]interface{})
+	if !ok {
+		return 0, fmt.Errorf("unexpected reply to KEYS: %v", reply)
+	}
+
+	var csvWriter *csv.Writer
+	if format == "csv" {
+		csvWriter = csv.NewWriter(writer)
+		if header {
+			csvWriter.Write([]string{"key", "value"})
+		}
+	}
+	encoder := json.NewEncoder(writer)
+
+	count := 0
+	for start := 0; start < len(keys); start += exportPipeline {
+		end := start + exportPipeline
+		if end > len(keys) {
+			end = len(keys)
+		}
+		for _, key := range keys[start:end] {
+			keyName, err := resp.String(key)
+			if err != nil {
+				return count, err
+			}
+			if err := client.Send("GET", keyName); err != nil {
+				return count, err
+			}
+		}
+
+		for _, key := range keys[start:end] {
+			keyName, _ := resp.String(key)
+			reply, err := client.Receive()
+			if err != nil {
+				return count, err
+			}
+			if reply == nil {
+				continue
+			}
+			value, err := resp.String(reply)
+			if err != nil {
+				return count, err
+			}
+
+			if csvWriter != nil {
+				err = csvWriter.Write([]string{keyName, value})
+			} else {
+				err = encoder.Encode(exportedKey{Key: keyName, Value: value})
+			}
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	if csvWriter != nil {
+		csvWriter.Flush()
+		return count, csvWriter.Error()
+	}
+	return count, nil
+}
+
+// ottodb import [-addr host:port] [-user name -pass password] [-format jsonl|csv|rdb] [-header=false] [-batch n] [-db n] file
+// Loads keys into a running server, batch keys per txn. A failed batch is rolled back
+// and stops the import, so everything before it is in and nothing after it.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	addr := flags.String("addr", "127.0.0.1:8080", "Server to import into")
+	user := flags.String("user", "default", "User to authenticate as")
+	pass := flags.String("pass", "", "Password to authenticate with, none when empty")
+	format := flags.String("format", "jsonl", "Input format, jsonl, csv or rdb")
+	header := flags.Bool("header", true, "The first csv row is a header rather than a key, as export writes it")
+	batchSize := flags.Int("batch", 1000, "Keys written per transaction")
+	db := flags.Int("db", 0, "Redis database to import from an RDB file, or -1 for all of them")
+	flags.Parse(args)
+	if flags.NArg() != 1 || *batchSize < 1 {
+		fmt.Fprintln(os.Stderr, "usage: ottodb import [-addr host:port] [-format jsonl|csv|rdb] [-header=false] [-batch n] [-db n] file")
+		return 2
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+
+	client, err := resp.DialAuth(*addr, *user, *pass)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer client.Close()
+
+	importer := &batchImporter{client: client, batchSize: *batchSize}
+	switch *format {
+	case "jsonl":
+		err = readJSONLines(f, importer.add)
+	case "csv":
+		err = readCSV(f, *header, importer.add)
+	case "rdb":
+		var stats rdb.Stats
+		skippedDBs := 0
+		stats, err = rdb.Parse(bufio.NewReader(f), func(entry rdb.Entry) error {
+			if *db >= 0 && entry.DB != *db {
+				skippedDBs++
+				return nil
+			}
+			return importer.add(entry.Key, entry.Value)
+		})
+		fmt.Fprintf(os.Stderr, "Skipped %d expired keys, %d keys that aren't strings and %d keys in other databases\n", stats.Expired, stats.NonString, skippedDBs)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %s, expected jsonl, csv or rdb\n", *format)
+		return 2
+	}
+	if err == nil {
+		err = importer.flush()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed after %d keys: %v\n", importer.imported, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d keys\n", importer.imported)
+	return 0
+}
+
+type batchImporter struct {
+	client    *resp.Client
+	batchSize int
+	batch     []exportedKey
+	imported  int
+}
+
+func (importer *batchImporter) add(key string, value string) error {
+	importer.batch = append(importer.batch, exportedKey{Key: key, Value: value})
+	if len(importer.batch) < importer.batchSize {
+		return nil
+	}
+	return importer.flush()
+}
+
+// Writes the batch in one txn. Commands are sent one at a time, since a failed SET
+// aborts the txn and any SETs already sent after it would run on their own.
+func (importer *batchImporter) flush() error {
+	if len(importer.batch) == 0 {
+		return nil
+	}
+	if _, err := importer.client.Do("BEGIN"); err != nil {
+		return err
+	}
+	for _, pair := range importer.batch {
+		if _, err := importer.client.Do("SET", pair.Key, pair.Value); err != nil {
+			// Conflicts already aborted the txn, anything else leaves it open
+			importer.client.Do("ABORT")
+			return fmt.Errorf("could not set %q: %v", pair.Key, err)
+		}
+	}
+	if _, err := importer.client.Do("COMMIT"); err != nil {
+		return err
+	}
+	importer.imported += len(importer.batch)
+	importer.batch = importer.batch[:0]
+	return nil
+}
+
+func readJSONLines(r io.Reader, add func(key string, value string) error) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for line := 1; ; line++ {
+		var pair exportedKey
+		if err := decoder.Decode(&pair); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("record %d: %v", line, err)
+		}
+		if err := add(pair.Key, pair.Value); err != nil {
+			return err
+		}
+	}
+}
+
+// Reads key,value records, skipping the first row when it's a header
+func readCSV(r io.Reader, header bool, add func(key string, value string) error) error {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = 2
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if line == 1 && header {
+			continue
+		}
+		if err := add(record[0], record[1]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package twopc
+
+import (
+	"OttoDB/server/resp"
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Returned by Commit when the commit was decided but some participants couldn't be told.
+// Their part stays prepared until Recover is run against them.
+var ErrIncomplete = errors.New("transaction committed but not every participant acknowledged it")
+
+const (
+	Commit   = "commit"
+	Rollback = "rollback"
+)
+
+// Drives transactions that span several OttoDB nodes. Every commit decision is logged
+// before any participant is told about it, so in-doubt participants can always be
+// resolved from the log. Txns without a logged decision were rolled back (presumed abort).
+type Coordinator struct {
+	sync.Mutex
+	log       *os.File
+	decisions map[string]decision
+	user      string // Participants are authenticated with, when password isn't empty
+	password  string
+}
+
+// One line of the decision log
+type decision struct {
+	GID          string   `json:"gid"`
+	Decision     string   `json:"decision"`
+	Participants []string `json:"participants"`
+}
+
+// Opens the decision log at path, creating it if needed
+func Open(path string) (*Coordinator, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s: %v", path, err)
+	}
+	coordinator := &Coordinator{log: f, decisions: make(map[string]decision)}
+
+	decoder := json.NewDecoder(bufio.NewReader(f))
+	var end int64 // Just past the last whole decision
+	for {
+		var logged decision
+		err := decoder.Decode(&logged)
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			// A torn write at the end was never acted on. It's cut off, or the next
+			// decision would be appended to it and the log couldn't be read again.
+			if err := truncateLog(f, end); err != nil {
+				f.Close()
+				return nil, fmt.Errorf("could not truncate %s: %v", path, err)
+			}
+			break
+		} else if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("could not decode %s: %v", path, err)
+		}
+		coordinator.decisions[logged.GID] = logged
+		end = decoder.InputOffset()
+	}
+	return coordinator, nil
+}
+
+// Cuts the log off at end, which is just past a decision or 0, keeping the line ending
+func truncateLog(f *os.File, end int64) error {
+	if err := f.Truncate(end); err != nil {
+		return err
+	}
+	if end > 0 {
+		if _, err := f.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// Authenticates as user on every participant from now on
+func (coordinator *Coordinator) SetAuth(user string, password string) {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	coordinator.user = user
+	coordinator.password = password
+}
+
+func (coordinator *Coordinator) dial(addr string) (*resp.Client, error) {
+	coordinator.Lock()
+	user, password := coordinator.user, coordinator.password
+	coordinator.Unlock()
+	return resp.DialAuth(addr, user, password)
+}
+
+func (coordinator *Coordinator) Close() error {
+	return coordinator.log.Close()
+}
+
+// Returns the logged decision for gid, if there is one
+func (coordinator *Coordinator) Decision(gid string) (string, bool) {
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	logged, ok := coordinator.decisions[gid]
+	return logged.Decision, ok
+}
+
+func (coordinator *Coordinator) logDecision(logged decision) error {
+	b, err := json.Marshal(logged)
+	if err != nil {
+		return err
+	}
+
+	coordinator.Lock()
+	defer coordinator.Unlock()
+	if _, err := coordinator.log.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("could not write decision: %v", err)
+	}
+	if err := coordinator.log.Sync(); err != nil {
+		return fmt.Errorf("could not sync decision: %v", err)
+	}
+	coordinator.decisions[logged.GID] = logged
+	return nil
+}
+
+// Starts a transaction with a new global ID
+func (coordinator *Coordinator) Begin() (*Txn, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &Txn{
+		GID:          hex.EncodeToString(b),
+		coordinator:  coordinator,
+		participants: make(map[string]*resp.Client),
+	}, nil
+}
+
+// A transaction spanning the nodes it has sent commands to
+type Txn struct {
+	GID          string
+	coordinator  *Coordinator
+	participants map[string]*resp.Client
+	order        []string // Participant addresses in the order they joined
+	done         bool
+}
+
+// Runs a command on the node at addr as part of the transaction. The node joins the
+// transaction the first time it's used.
+func (txn *Txn) Do(addr string, args ...string) (interface{}, error) {
+	if txn.done {
+		return nil, errors.New("transaction is already finished")
+	}
+	client, joined := txn.participants[addr]
+	if !joined {
+		var err error
+		client, err = txn.coordinator.dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := client.Do("BEGIN"); err != nil {
+			client.Close()
+			return nil, err
+		}
+		txn.participants[addr] = client
+		txn.order = append(txn.order, addr)
+	}
+	return client.Do(args...)
+}
+
+// Prepares the transaction on every participant, then commits it everywhere if they all
+// prepared. If any participant fails to prepare, the transaction is rolled back.
+func (txn *Txn) Commit() error {
+	if txn.done {
+		return errors.New("transaction is already finished")
+	}
+	txn.done = true
+	defer txn.close()
+
+	prepared := make([]string, 0, len(txn.order))
+	for _, addr := range txn.order {
+		if _, err := txn.participants[addr].Do("PREPARE", txn.GID); err != nil {
+			txn.rollback(prepared)
+			return fmt.Errorf("%s failed to prepare: %v", addr, err)
+		}
+		prepared = append(prepared, addr)
+	}
+
+	err := txn.coordinator.logDecision(decision{GID: txn.GID, Decision: Commit, Participants: txn.order})
+	if err != nil {
+		txn.rollback(prepared)
+		return err
+	}
+
+	failed := make([]string, 0)
+	for _, addr := range txn.order {
+		if _, err := txn.participants[addr].Do("COMMIT", "PREPARED", txn.GID); err != nil {
+			failed = append(failed, addr)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: %s", ErrIncomplete, strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// Aborts the transaction on every participant
+func (txn *Txn) Rollback() error {
+	if txn.done {
+		return errors.New("transaction is already finished")
+	}
+	txn.done = true
+	defer txn.close()
+	txn.rollback(nil)
+	return nil
+}
+
+// Rolls back the participants that prepared and aborts the rest. Failures are left
+// to Recover, which rolls back anything without a commit decision.
+func (txn *Txn) rollback(prepared []string) {
+	isPrepared := make(map[string]bool)
+	for _, addr := range prepared {
+		isPrepared[addr] = true
+	}
+	for _, addr := range txn.order {
+		if isPrepared[addr] {
+			txn.participants[addr].Do("ROLLBACK", "PREPARED", txn.GID)
+		} else {
+			txn.participants[addr].Do("ABORT")
+		}
+	}
+}
+
+func (txn *Txn) close() {
+	for _, client := range txn.participants {
+		client.Close()
+	}
+}
+
+// What Recover did with an in-doubt transaction
+type Resolution struct {
+	Addr     string
+	GID      string
+	Decision string
+	Err      error
+}
+
+// Finishes every prepared transaction on the nodes at addrs: committed if a commit was
+// logged for it, rolled back otherwise. Only run it while no transactions are being
+// committed, or it can roll back a transaction between its prepares and its decision.
+func (coordinator *Coordinator) Recover(addrs []string) ([]Resolution, error) {
+	resolutions := make([]Resolution, 0)
+	for _, addr := range addrs {
+		client, err := coordinator.dial(addr)
+		if err != nil {
+			return resolutions, fmt.Errorf("could not connect to %s: %v", addr, err)
+		}
+		gids, err := listPrepared(client)
+		if err != nil {
+			client.Close()
+			return resolutions, fmt.Errorf("could not list prepared transactions on %s: %v", addr, err)
+		}
+
+		for _, gid := range gids {
+			resolution := Resolution{Addr: addr, GID: gid, Decision: Rollback}
+			if decided, ok := coordinator.Decision(gid); ok && decided == Commit {
+				resolution.Decision = Commit
+			}
+			if resolution.Decision == Commit {
+				_, resolution.Err = client.Do("COMMIT", "PREPARED", gid)
+			} else {
+				_, resolution.Err = client.Do("ROLLBACK", "PREPARED", gid)
+			}
+			resolutions = append(resolutions, resolution)
+		}
+		client.Close()
+	}
+	return resolutions, nil
+}
+
+// Global IDs of the transactions prepared on a node
+func listPrepared(client *resp.Client) ([]string, error) {
+	reply, err := client.Do("PREPARED")
+	if err != nil {
+		return nil, err
+	}
+	pairs, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+	gids := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		fields, ok := pair.([]interface{})
+		if !ok || len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected reply %v", reply)
+		}
+		gid, err := resp.String(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		gids = append(gids, gid)
+	}
+	sort.Strings(gids)
+	return gids, nil
+}
@@ -0,0 +1,256 @@
+package twopc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Stands in for an OttoDB node. Only keeps track of what was prepared and how it ended.
+type fakeNode struct {
+	sync.Mutex
+	listener    net.Listener
+	failPrepare bool
+	failCommit  bool
+	prepared    map[string]bool
+	committed   []string
+	rolledBack  []string
+	aborted     int
+}
+
+func startFakeNode(t *testing.T) *fakeNode {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &fakeNode{listener: listener, prepared: make(map[string]bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go node.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return node
+}
+
+func (node *fakeNode) addr() string {
+	return node.listener.Addr().String()
+}
+
+func (node *fakeNode) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		fmt.Fprint(conn, node.handle(args))
+	}
+}
+
+func (node *fakeNode) handle(args []string) string {
+	node.Lock()
+	defer node.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "PREPARE":
+		if node.failPrepare {
+			return "-Txn Aborted: conflict\r\n"
+		}
+		node.prepared[args[1]] = true
+	case "COMMIT", "ROLLBACK":
+		if node.failCommit && strings.ToUpper(args[0]) == "COMMIT" {
+			return "-ERR connection lost\r\n"
+		}
+		if !node.prepared[args[2]] {
+			return "-ERR no prepared transaction with that identifier\r\n"
+		}
+		delete(node.prepared, args[2])
+		if strings.ToUpper(args[0]) == "COMMIT" {
+			node.committed = append(node.committed, args[2])
+		} else {
+			node.rolledBack = append(node.rolledBack, args[2])
+		}
+	case "ABORT":
+		node.aborted++
+		return "-Aborted txn from manual client call\r\n"
+	case "PREPARED":
+		reply := fmt.Sprintf("*%d\r\n", len(node.prepared))
+		for gid := range node.prepared {
+			reply += fmt.Sprintf("*2\r\n$%d\r\n%s\r\n:1\r\n", len(gid), gid)
+		}
+		return reply
+	}
+	return "+OK\r\n"
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(arg, "\r\n"))
+	}
+	return args, nil
+}
+
+func openCoordinator(t *testing.T, path string) *Coordinator {
+	coordinator, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { coordinator.Close() })
+	return coordinator
+}
+
+func TestCommitAcrossNodes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coordinator.log")
+	coordinator := openCoordinator(t, path)
+	first, second := startFakeNode(t), startFakeNode(t)
+
+	txn, err := coordinator.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Do(first.addr(), "SET", "a", "1")
+	txn.Do(second.addr(), "SET", "b", "1")
+	if err := txn.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, node := range []*fakeNode{first, second} {
+		if len(node.committed) != 1 || node.committed[0] != txn.GID {
+			t.Errorf("expected %s to be committed, got %v", txn.GID, node.committed)
+		}
+	}
+	// The decision outlives the coordinator
+	if decided, ok := openCoordinator(t, path).Decision(txn.GID); !ok || decided != Commit {
+		t.Errorf("expected a logged commit decision, got %s", decided)
+	}
+}
+
+func TestFailedPrepareRollsBack(t *testing.T) {
+	coordinator := openCoordinator(t, filepath.Join(t.TempDir(), "coordinator.log"))
+	first, second := startFakeNode(t), startFakeNode(t)
+	second.failPrepare = true
+
+	txn, _ := coordinator.Begin()
+	txn.Do(first.addr(), "SET", "a", "1")
+	txn.Do(second.addr(), "SET", "b", "1")
+	if err := txn.Commit(); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+
+	if len(first.rolledBack) != 1 || len(first.committed) != 0 {
+		t.Errorf("expected the prepared node to be rolled back, committed %v rolled back %v", first.committed, first.rolledBack)
+	}
+	if second.aborted != 1 || len(second.committed) != 0 || len(second.prepared) != 0 {
+		t.Errorf("expected the failed node's txn to be aborted")
+	}
+	if _, ok := coordinator.Decision(txn.GID); ok {
+		t.Errorf("expected no decision to be logged")
+	}
+}
+
+func TestRecoverResolvesInDoubtTxns(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coordinator.log")
+	coordinator := openCoordinator(t, path)
+	node := startFakeNode(t)
+
+	// Prepared everywhere and decided, but the coordinator died before telling the node
+	coordinator.logDecision(decision{GID: "decided", Decision: Commit, Participants: []string{node.addr()}})
+	node.prepared["decided"] = true
+	// Prepared, but the coordinator died before deciding
+	node.prepared["undecided"] = true
+
+	resolutions, err := openCoordinator(t, path).Recover([]string{node.addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resolutions) != 2 {
+		t.Fatalf("expected 2 resolutions, got %v", resolutions)
+	}
+	for _, resolution := range resolutions {
+		if resolution.Err != nil {
+			t.Errorf("unexpected error resolving %s: %v", resolution.GID, resolution.Err)
+		}
+	}
+	if len(node.committed) != 1 || node.committed[0] != "decided" {
+		t.Errorf("expected the decided txn to be committed, got %v", node.committed)
+	}
+	if len(node.rolledBack) != 1 || node.rolledBack[0] != "undecided" {
+		t.Errorf("expected the undecided txn to be rolled back, got %v", node.rolledBack)
+	}
+}
+
+func TestIncompleteCommit(t *testing.T) {
+	coordinator := openCoordinator(t, filepath.Join(t.TempDir(), "coordinator.log"))
+	node := startFakeNode(t)
+	node.failCommit = true
+
+	txn, _ := coordinator.Begin()
+	txn.Do(node.addr(), "SET", "a", "1")
+	if err := txn.Commit(); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected ErrIncomplete, got %v", err)
+	}
+
+	// The txn stays prepared on the node until recovery commits it
+	node.failCommit = false
+	if _, err := coordinator.Recover([]string{node.addr()}); err != nil {
+		t.Fatal(err)
+	}
+	if len(node.committed) != 1 || node.committed[0] != txn.GID {
+		t.Errorf("expected recovery to commit %s, got %v", txn.GID, node.committed)
+	}
+}
+
+func TestTornDecisionIsCutOff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "coordinator.log")
+	coordinator := openCoordinator(t, path)
+	coordinator.logDecision(decision{GID: "first", Decision: Commit})
+	coordinator.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"gid":"torn","deci`)
+	f.Close()
+
+	// Decisions logged after the torn one have to be readable too
+	openCoordinator(t, path).logDecision(decision{GID: "second", Decision: Commit})
+	reopened := openCoordinator(t, path)
+	for _, gid := range []string{"first", "second"} {
+		if _, ok := reopened.Decision(gid); !ok {
+			t.Errorf("expected a decision for %s", gid)
+		}
+	}
+	if _, ok := reopened.Decision("torn"); ok {
+		t.Error("expected the torn decision to be dropped")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"OttoDB/server/hlc"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errNoSuchTxn = errors.New("ERR no active transaction with that txid")
+
+// Who holds each active txn: a client address, or the gid of a prepared txn
+func txnHolders() map[uint64]string {
+	holders := make(map[uint64]string)
+	transactionManager.RLock()
+	for client, txID := range transactionManager.Transactions {
+		holders[txID] = client
+	}
+	transactionManager.RUnlock()
+	preparedTxns.Lock()
+	for gid, txID := range preparedTxns.txns {
+		holders[txID] = "prepared:" + gid
+	}
+	preparedTxns.Unlock()
+	return holders
+}
+
+func activeTxIDs() []uint64 {
+	activeTransactions.RLock()
+	txIDs := make([]uint64, 0, len(activeTransactions.ActiveTransactions))
+	for txID := range activeTransactions.ActiveTransactions {
+		txIDs = append(txIDs, txID)
+	}
+	activeTransactions.RUnlock()
+	sort.Slice(txIDs, func(i, j int) bool { return txIDs[i] < txIDs[j] })
+	return txIDs
+}
+
+// TXN LIST, one line of fields per active txn, oldest first. Txns of a single command
+// and internal ones, like index builds, have no client.
+func listTxns() string {
+	holders := txnHolders()
+	now := time.Now()
+	var sb strings.Builder
+	for _, txID := range activeTxIDs() {
+		transactionMap.RLock()
+		transaction, ok := transactionMap.Transactions[txID]
+		transactionMap.RUnlock()
+		if !ok {
+			transaction = NewTransaction(txID)
+		}
+		started := hlc.Time(txID)
+		sb.WriteString(fmt.Sprintf("txid=%d client=%s start=%s age=%d inserted=%d deleted=%d keys=%d\n",
+			txID, holders[txID], started.UTC().Format(time.RFC3339), int64(now.Sub(started).Seconds()),
+			len(transaction.insertedRecords), len(transaction.deletedRecords), len(writtenKeys(transaction))))
+	}
+	return sb.String()
+}
+
+// Keys an active txn has written, which no other txn can write until it ends
+func txnKeys(txID uint64) ([]string, error) {
+	activeTransactions.RLock()
+	active := activeTransactions.ActiveTransactions[txID]
+	activeTransactions.RUnlock()
+	if !active {
+		return nil, errNoSuchTxn
+	}
+	transactionMap.RLock()
+	transaction := transactionMap.Transactions[txID]
+	transactionMap.RUnlock()
+	return writtenKeys(transaction), nil
+}
+
+func writtenKeys(transaction Transaction) []string {
+	seen := make(map[string]bool)
+	keys := make([]string, 0, len(transaction.keys))
+	for _, key := range transaction.keys {
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Aborts a client's txn for it. Prepared txns are left to ROLLBACK PREPARED, since their
+// coordinator may have decided to commit them.
+func abortTxn(txID uint64) error {
+	activeTransactions.RLock()
+	active := activeTransactions.ActiveTransactions[txID]
+	activeTransactions.RUnlock()
+	if !active {
+		return errNoSuchTxn
+	}
+	holder := txnHolders()[txID]
+	if strings.HasPrefix(holder, "prepared:") {
+		return fmt.Errorf("ERR transaction is prepared as %s, use ROLLBACK PREPARED", strings.TrimPrefix(holder, "prepared:"))
+	} else if holder == "" {
+		return errors.New("ERR transaction isn't held by a client")
+	}
+	if !abortClientTxn(holder, txID) {
+		return errNoSuchTxn
+	}
+	return nil
+}
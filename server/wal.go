@@ -0,0 +1,484 @@
+package main
+
+import (
+	"OttoDB/server/walcrypt"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// Size of the channel each log follower receives new entries on. A follower that
+// falls this far behind is dropped and has to catch up from the log file.
+const followerBufferSize = 1024
+
+// A single operation in the log, along with its length prefixed encoding
+type logEntry struct {
+	operation Operation
+	frame     []byte
+}
+
+var _ = flag.String("wal-key-file", "", "Key file of id hexkey lines to encrypt the log and backups with, relative to -dir, which needs -engine memory. The last key encrypts new entries, the others still decrypt older ones. Not encrypted when empty")
+
+// Keys of -wal-key-file, nil when the log isn't encrypted
+var walKeys = struct {
+	sync.RWMutex
+	keyring *walcrypt.Keyring
+}{}
+
+// Value of the format entry logs start with. Logs from before commits were logged have
+// none, and they're the only ones where a txn without a commit counts as committed.
+const logFormat = "commits"
+
+var (
+	walLock      sync.Mutex
+	walWriter    *os.File // Opened by the first append
+	walUnsynced  bool     // Written since the last sync
+	walStarted   bool     // Checked for a format entry, written when the log was empty
+	walChain     logChain // Loaded when the log is opened
+	logFollowers = make(map[chan logEntry]bool)
+)
+
+// Decodes every length prefixed operation in the log at path
+func readLog(path string) ([]Operation, error) {
+	entries, err := readLogEntries(path, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	operations := make([]Operation, 0, len(entries))
+	for _, entry := range entries {
+		operations = append(operations, entry.operation)
+	}
+	return operations, nil
+}
+
+// Decodes the log at path starting at offset, which has to be the start of an entry.
+// Encrypted entries are chained from the start of the log, so it's all decoded.
+func readLogEntries(path string, offset int64) ([]logEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+	if offset > int64(len(b)) {
+		return nil, fmt.Errorf("offset %d is past the end of the log", offset)
+	}
+
+	var chain logChain
+	var position int64
+	entries := make([]logEntry, 0)
+	for position < offset {
+		entry, err := chain.decode(b[position:])
+		if err != nil {
+			return nil, err
+		}
+		position += int64(len(entry.frame))
+	}
+	if position != offset {
+		return nil, fmt.Errorf("offset %d is not the start of an entry", offset)
+	}
+	for position < int64(len(b)) {
+		entry, err := chain.decode(b[position:])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		position += int64(len(entry.frame))
+	}
+	return entries, nil
+}
+
+// Tag of the last encrypted entry of a log. Every encrypted entry is bound to the one
+// before it, so entries can't be dropped, moved or repeated without decrypting them
+// failing, and entries after an encrypted one have to be encrypted too.
+type logChain []byte
+
+// Encodes an operation as the next entry of the log: its length, then the operation,
+// encrypted when -wal-key-file is set
+func (chain *logChain) encode(operation *Operation) ([]byte, error) {
+	b, err := proto.Marshal(operation)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode operation: %v", err)
+	}
+	walKeys.RLock()
+	keyring := walKeys.keyring
+	walKeys.RUnlock()
+	if keyring != nil {
+		if b, err = keyring.Seal(b, *chain); err != nil {
+			return nil, fmt.Errorf("could not encrypt operation: %v", err)
+		}
+		*chain = walcrypt.Tag(b)
+	}
+
+	var frame bytes.Buffer
+	if err := binary.Write(&frame, endianness, length(len(b))); err != nil {
+		return nil, fmt.Errorf("could not enocde length of message: %v", err)
+	}
+	frame.Write(b)
+	return frame.Bytes(), nil
+}
+
+// Decodes the entry at the start of b, the next entry of the log
+func (chain *logChain) decode(b []byte) (logEntry, error) {
+	frame, record, err := splitFrame(b)
+	if err != nil {
+		return logEntry{}, err
+	}
+	if walcrypt.IsSealed(record) {
+		walKeys.RLock()
+		keyring := walKeys.keyring
+		walKeys.RUnlock()
+		opened, err := keyring.Open(record, *chain)
+		if err != nil {
+			return logEntry{}, fmt.Errorf("could not decrypt operation: %v", err)
+		}
+		*chain = append(logChain(nil), walcrypt.Tag(record)...)
+		record = opened
+	} else if *chain != nil {
+		return logEntry{}, errors.New("operation is not encrypted, but ones before it are")
+	}
+
+	var operation Operation
+	if err := proto.Unmarshal(record, &operation); err != nil {
+		return logEntry{}, fmt.Errorf("Could not read operation: %v", err)
+	}
+	return logEntry{operation: operation, frame: frame}, nil
+}
+
+// Splits the length prefixed entry at the start of b into its frame and the record in it
+func splitFrame(b []byte) ([]byte, []byte, error) {
+	if len(b) < sizeOfLength {
+		return nil, nil, fmt.Errorf("bytes not correct size")
+	}
+
+	var l length
+	if err := binary.Read(bytes.NewReader(b[:sizeOfLength]), endianness, &l); err != nil {
+		return nil, nil, fmt.Errorf("could not decode message length: %v", err)
+	}
+	if l < 0 || int64(len(b)-sizeOfLength) < int64(l) {
+		return nil, nil, fmt.Errorf("bytes not correct size")
+	}
+	return b[:sizeOfLength+int(l)], b[sizeOfLength : sizeOfLength+int(l)], nil
+}
+
+// Cuts off an entry that was only partly written when the log at path was last appended
+// to. Its txn never committed, and it would keep every later entry from being read.
+func truncateTornEntry(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read %s: %v", path, err)
+	}
+	var position int
+	for position < len(b) {
+		frame, _, err := splitFrame(b[position:])
+		if err != nil {
+			break
+		}
+		position += len(frame)
+	}
+	if position == len(b) {
+		return nil
+	}
+	logger.Warn("cutting off a partly written entry at the end of the log", "path", path, "offset", position, "bytes", len(b)-position)
+	if err := os.Truncate(path, int64(position)); err != nil {
+		return fmt.Errorf("could not truncate %s: %v", path, err)
+	}
+	return nil
+}
+
+// Chain of the log at path, without decrypting it
+func loadLogChain(path string) (logChain, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", path, err)
+	}
+
+	var chain logChain
+	for len(b) > 0 {
+		frame, record, err := splitFrame(b)
+		if err != nil {
+			return nil, err
+		}
+		if walcrypt.IsSealed(record) {
+			chain = append(logChain(nil), walcrypt.Tag(record)...)
+		}
+		b = b[len(frame):]
+	}
+	return chain, nil
+}
+
+// Loads the keys of -wal-key-file, when CONFIG SET changes it too, so a new key can be
+// added without a restart. The lsm engine's tables aren't encrypted, so it can't be used
+// with a key file.
+func setWalKeyFile(value string) error {
+	var keyring *walcrypt.Keyring
+	if value != "" {
+		if *engineName == "lsm" {
+			return errors.New("the lsm engine doesn't encrypt its tables, use -engine memory to encrypt data at rest")
+		}
+		var err error
+		if keyring, err = walcrypt.Load(dataPath(value)); err != nil {
+			return err
+		}
+	}
+	walKeys.Lock()
+	defer walKeys.Unlock()
+	walKeys.keyring = keyring
+	return nil
+}
+
+// ID of the key new entries are encrypted with, 0 when they aren't
+func walKeyID() int {
+	walKeys.RLock()
+	defer walKeys.RUnlock()
+	if walKeys.keyring == nil {
+		return 0
+	}
+	return int(walKeys.keyring.Current())
+}
+
+// Starts an empty log with the format entry. Only entries that start on this node do
+// this, since a replica's log has to stay a copy of its primary's.
+func startLog() error {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if walStarted {
+		return nil
+	}
+	if info, err := os.Stat(walPath); err == nil && info.Size() > 0 {
+		walStarted = true
+		return nil
+	}
+	if err := appendOperation(&Operation{Op: "format", Value: logFormat}); err != nil {
+		return err
+	}
+	walStarted = true
+	return nil
+}
+
+// Encodes an operation as the next entry of the log, appends it and passes it on to
+// the followers
+func appendToLog(operation *Operation) error {
+	// Appends have to be serialized, so entries never interleave or break the chain
+	walLock.Lock()
+	defer walLock.Unlock()
+	return appendOperation(operation)
+}
+
+// Must be called with walLock held
+func appendOperation(operation *Operation) error {
+	if err := openLog(); err != nil {
+		return err
+	}
+	chain := walChain
+	frame, err := chain.encode(operation)
+	if err != nil {
+		return err
+	}
+	if err := appendFrame(frame, *operation); err != nil {
+		return err
+	}
+	walChain = chain
+	return nil
+}
+
+// Appends an entry copied from the primary's log as it is, once it's checked to be
+// the next entry of this log
+func copyToLog(frame []byte) (Operation, error) {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if err := openLog(); err != nil {
+		return Operation{}, err
+	}
+	chain := walChain
+	entry, err := chain.decode(frame)
+	if err != nil {
+		return Operation{}, err
+	} else if len(entry.frame) != len(frame) {
+		return Operation{}, errors.New("log entry from primary has trailing bytes")
+	}
+	if err := appendFrame(entry.frame, entry.operation); err != nil {
+		return Operation{}, err
+	}
+	walChain = chain
+	return entry.operation, nil
+}
+
+// Must be called with walLock held
+func openLog() error {
+	if walWriter != nil {
+		return nil
+	}
+	chain, err := loadLogChain(walPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(walPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %v", walPath, err)
+	}
+	walWriter = f
+	walChain = chain
+	return nil
+}
+
+// Must be called with walLock held
+func appendFrame(frame []byte, operation Operation) error {
+	_, err := walWriter.Write(frame)
+	if err != nil {
+		return fmt.Errorf("could not write task to file: %v", err)
+	}
+	walBytes.Add(float64(len(frame)))
+
+	if settings.String("wal-sync") == "always" {
+		if err := syncLog(); err != nil {
+			return fmt.Errorf("could not sync %s: %v", walPath, err)
+		}
+	} else {
+		walUnsynced = true
+	}
+
+	notifyLogFollowers(logEntry{operation: operation, frame: frame})
+	return nil
+}
+
+// Syncs the log once a second while -wal-sync is everysec
+func syncLogEverySecond() {
+	for range time.Tick(time.Second) {
+		if settings.String("wal-sync") != "everysec" {
+			continue
+		}
+		walLock.Lock()
+		if walWriter != nil && walUnsynced {
+			if err := syncLog(); err != nil {
+				logger.Error("could not sync log", "path", walPath, "err", err)
+			} else {
+				walUnsynced = false
+			}
+		}
+		walLock.Unlock()
+	}
+}
+
+// Syncs what's been appended to the log whatever -wal-sync says, for records a
+// coordinator acts on once they're acknowledged
+func forceSyncLog() error {
+	walLock.Lock()
+	defer walLock.Unlock()
+	if walWriter == nil || !walUnsynced {
+		return nil
+	}
+	if err := syncLog(); err != nil {
+		return fmt.Errorf("ERR could not sync %s: %v", walPath, err)
+	}
+	walUnsynced = false
+	return nil
+}
+
+// Must be called with walLock held
+func syncLog() error {
+	start := time.Now()
+	err := walWriter.Sync()
+	walSyncDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Returns every entry logged from offset on, and a channel that receives every entry
+// logged after them. Nothing can be logged in between the two.
+func followLog(offset int64) ([]logEntry, chan logEntry, error) {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	entries := make([]logEntry, 0)
+	if _, err := os.Stat(walPath); err == nil {
+		entries, err = readLogEntries(walPath, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if offset != 0 {
+		return nil, nil, fmt.Errorf("offset %d is past the end of the log", offset)
+	}
+
+	return entries, addLogFollower(), nil
+}
+
+// Returns a channel that receives every entry logged from now on
+func tailLog() chan logEntry {
+	walLock.Lock()
+	defer walLock.Unlock()
+	return addLogFollower()
+}
+
+// Must be called with walLock held
+func addLogFollower() chan logEntry {
+	follower := make(chan logEntry, followerBufferSize)
+	logFollowers[follower] = true
+	return follower
+}
+
+func unfollowLog(follower chan logEntry) {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	if logFollowers[follower] {
+		delete(logFollowers, follower)
+		close(follower)
+	}
+}
+
+// Must be called with walLock held
+func notifyLogFollowers(entry logEntry) {
+	for follower := range logFollowers {
+		select {
+		case follower <- entry:
+		default:
+			// Follower isn't keeping up, closing the channel tells it to go away
+			delete(logFollowers, follower)
+			close(follower)
+		}
+	}
+}
+
+// Size of the log, which is also the offset the next entry is written at
+func logSize() int64 {
+	walLock.Lock()
+	defer walLock.Unlock()
+
+	info, err := os.Stat(walPath)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// A replica's log is a byte for byte copy of its primary's, which replication resumes
+// from by offset, so nothing but replication appends to it. Its txns can't have logged
+// any writes, so their commits and aborts are left out.
+func writeCommitToLog(txID uint64) error {
+	if isReplica() {
+		txnCommits.Inc()
+		return nil
+	}
+	operation := &Operation{
+		TxID: txID,
+		Op:   "commit",
+	}
+
+	err := writeToLog(operation, txID)
+	if err != nil {
+		return fmt.Errorf("error writing commit to log: %v", err)
+	}
+	txnCommits.Inc()
+	return nil
+}
@@ -0,0 +1,152 @@
+package walcrypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Sealed records start with this byte. Encoded operations never do, since a protobuf
+// field tag can't be 0, so plaintext and sealed records can share a log.
+const Marker = 0x00
+
+// Marker, key ID, then the nonce
+const headerSize = 2
+
+// Size of the GCM authentication tag at the end of a sealed record
+const tagSize = 16
+
+var ErrNoKeys = errors.New("record is encrypted but no key file is set")
+
+// AES-GCM keys by ID. Records are sealed with the newest key and opened with the key
+// whose ID they're tagged with, so old keys can stay around to read older records.
+type Keyring struct {
+	keys    map[byte]cipher.AEAD
+	current byte
+}
+
+// Reads a key file of "id hexkey" lines, ids from 1 to 255 and keys of 16, 24 or 32
+// bytes. The key on the last line seals new records.
+func Load(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keyring, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return keyring, nil
+}
+
+func Parse(r io.Reader) (*Keyring, error) {
+	keyring := &Keyring{keys: make(map[byte]cipher.AEAD)}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a key ID and a key in hex", line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 8)
+		if err != nil || id == 0 {
+			return nil, fmt.Errorf("line %d: key ID has to be from 1 to 255", line)
+		}
+		if _, exists := keyring.keys[byte(id)]; exists {
+			return nil, fmt.Errorf("line %d: key %d is defined twice", line, id)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: key is not in hex", line)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		keyring.keys[byte(id)] = aead
+		keyring.current = byte(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keyring.keys) == 0 {
+		return nil, errors.New("no keys found")
+	}
+	return keyring, nil
+}
+
+// ID of the key new records are sealed with
+func (keyring *Keyring) Current() byte {
+	return keyring.current
+}
+
+func IsSealed(record []byte) bool {
+	return len(record) > 0 && record[0] == Marker
+}
+
+// Encrypts a record with the current key and a random nonce, which are written before
+// the ciphertext. Both are authenticated along with it, and so is bound, which the
+// record can only be opened with again.
+func (keyring *Keyring) Seal(record []byte, bound []byte) ([]byte, error) {
+	aead := keyring.keys[keyring.current]
+	sealed := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(record)+aead.Overhead())
+	sealed[0] = Marker
+	sealed[1] = keyring.current
+	nonce := sealed[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("could not generate nonce: %v", err)
+	}
+	return aead.Seal(sealed, nonce, record, additionalData(sealed[:headerSize], bound)), nil
+}
+
+func additionalData(header []byte, bound []byte) []byte {
+	return append(append(make([]byte, 0, len(header)+len(bound)), header...), bound...)
+}
+
+// Authentication tag at the end of a sealed record. Binding a record to the tag of the
+// one before it chains them, so they can't be dropped or moved without it showing.
+func Tag(sealed []byte) []byte {
+	if len(sealed) < headerSize+tagSize {
+		return nil
+	}
+	return sealed[len(sealed)-tagSize:]
+}
+
+// Decrypts a sealed record with the key it's tagged with, which only works with what it
+// was bound to when it was sealed. A nil keyring can't open any.
+func (keyring *Keyring) Open(sealed []byte, bound []byte) ([]byte, error) {
+	if keyring == nil {
+		return nil, ErrNoKeys
+	}
+	if len(sealed) < headerSize || sealed[0] != Marker {
+		return nil, errors.New("record is not encrypted")
+	}
+	aead, ok := keyring.keys[sealed[1]]
+	if !ok {
+		return nil, fmt.Errorf("record is encrypted with key %d, which isn't in the key file", sealed[1])
+	}
+	if len(sealed) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("encrypted record is truncated")
+	}
+	nonce := sealed[headerSize : headerSize+aead.NonceSize()]
+	record, err := aead.Open(nil, nonce, sealed[headerSize+aead.NonceSize():], additionalData(sealed[:headerSize], bound))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt record with key %d: %v", sealed[1], err)
+	}
+	return record, nil
+}
@@ -0,0 +1,104 @@
+package walcrypt
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const (
+	key1 = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	key2 = "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+)
+
+func TestSealAndOpen(t *testing.T) {
+	keyring, err := Parse(strings.NewReader("# keys\n1 " + key1 + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []byte("\x08\x01\x12\x03set")
+	sealed, err := keyring.Seal(record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsSealed(sealed) || IsSealed(record) {
+		t.Fatal("expected only the sealed record to be marked")
+	}
+	if bytes.Contains(sealed, []byte("set")) {
+		t.Error("sealed record contains the plaintext")
+	}
+	again, _ := keyring.Seal(record, nil)
+	if bytes.Equal(sealed, again) {
+		t.Error("expected a new nonce for every record")
+	}
+
+	opened, err := keyring.Open(sealed, nil)
+	if err != nil || !bytes.Equal(opened, record) {
+		t.Fatalf("expected %q, got %q and %v", record, opened, err)
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := keyring.Open(sealed, nil); err == nil {
+		t.Error("expected a tampered record to fail")
+	}
+	var missing *Keyring
+	if _, err := missing.Open(again, nil); err != ErrNoKeys {
+		t.Errorf("expected ErrNoKeys, got %v", err)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	old, err := Parse(strings.NewReader("1 " + key1 + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedWithOld, _ := old.Seal([]byte("old"), nil)
+
+	rotated, err := Parse(strings.NewReader("1 " + key1 + "\n2 " + key2 + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Current() != 2 {
+		t.Fatalf("expected the last key to be current, got %d", rotated.Current())
+	}
+	sealedWithNew, _ := rotated.Seal([]byte("new"), nil)
+	if sealedWithNew[1] != 2 {
+		t.Errorf("expected record tagged with key 2, got %d", sealedWithNew[1])
+	}
+	if opened, err := rotated.Open(sealedWithOld, nil); err != nil || string(opened) != "old" {
+		t.Errorf("expected old record to open, got %q and %v", opened, err)
+	}
+	if _, err := old.Open(sealedWithNew, nil); err == nil {
+		t.Error("expected a record with an unknown key to fail")
+	}
+}
+
+func TestBound(t *testing.T) {
+	keyring, err := Parse(strings.NewReader("1 " + key1 + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := keyring.Seal([]byte("first"), nil)
+	second, _ := keyring.Seal([]byte("second"), Tag(first))
+	if len(Tag(first)) != tagSize {
+		t.Fatalf("expected a %d byte tag, got %d", tagSize, len(Tag(first)))
+	}
+
+	if opened, err := keyring.Open(second, Tag(first)); err != nil || string(opened) != "second" {
+		t.Errorf("expected the record to open after the one it's bound to, got %q and %v", opened, err)
+	}
+	if _, err := keyring.Open(second, nil); err == nil {
+		t.Error("expected a record to fail without what it's bound to")
+	}
+	if _, err := keyring.Open(second, Tag(second)); err == nil {
+		t.Error("expected a record to fail after the wrong record")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, file := range []string{"", "0 " + key1, "1 " + key1 + "\n1 " + key2, "1 abc", "1 zz", "1"} {
+		if _, err := Parse(strings.NewReader(file)); err == nil {
+			t.Errorf("expected %q to be rejected", file)
+		}
+	}
+}